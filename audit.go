@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var auditBucket = "audit"
+
+// AuditChange is one field of an entry before and after an action.
+type AuditChange struct {
+	From interface{} `json:"from"`
+
+	To interface{} `json:"to"`
+}
+
+// AuditEvent records an action on an auth entry. Events are only ever added;
+// there is no API to change or remove them.
+type AuditEvent struct {
+	Seq int64 `json:"seq"`
+
+	// unix millis
+	Time int64 `json:"time"`
+
+	Actor string `json:"actor"`
+
+	SourceIP string `json:"source_ip"`
+
+	Action string `json:"action"`
+
+	EntryId string `json:"entry_id"`
+
+	Before map[string]interface{} `json:"before,omitempty"`
+
+	After map[string]interface{} `json:"after,omitempty"`
+
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+
+	// SHA-256 chain over the events, see chainAudit
+	PrevHash string `json:"prev_hash"`
+
+	Hash string `json:"hash"`
+}
+
+var auditSeq = struct {
+	sync.Mutex
+	last int64
+}{}
+
+// nextAuditSeq orders events by time; two events of the same nanosecond still
+// get distinct, increasing keys.
+func nextAuditSeq() int64 {
+	auditSeq.Lock()
+	defer auditSeq.Unlock()
+	seq := time.Now().UnixNano()
+	if seq <= auditSeq.last {
+		seq = auditSeq.last + 1
+	}
+	auditSeq.last = seq
+	return seq
+}
+
+// raiseAuditSeq makes later events of this process come after seq.
+func raiseAuditSeq(seq int64) {
+	auditSeq.Lock()
+	defer auditSeq.Unlock()
+	if seq > auditSeq.last {
+		auditSeq.last = seq
+	}
+}
+
+func auditKey(seq int64) []byte {
+	return []byte(fmt.Sprintf("%020d", seq))
+}
+
+// auditSecrets never go into the audit log, only whether they changed.
+var auditSecrets = []string{"auth_key", "sign"}
+
+func redactSecret(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return "***"
+}
+
+func auditSnapshot(ae *AuthDataEntity) map[string]interface{} {
+	if ae == nil {
+		return nil
+	}
+	var m map[string]interface{}
+	b, _ := json.Marshal(ae)
+	json.Unmarshal(b, &m)
+	for _, s := range auditSecrets {
+		m[s] = redactSecret(m[s])
+	}
+	return m
+}
+
+func auditChanges(before, after *AuthDataEntity) map[string]AuditChange {
+	var b, a map[string]interface{}
+	if before != nil {
+		raw, _ := json.Marshal(before)
+		json.Unmarshal(raw, &b)
+	}
+	if after != nil {
+		raw, _ := json.Marshal(after)
+		json.Unmarshal(raw, &a)
+	}
+	changes := make(map[string]AuditChange)
+	for _, m := range []map[string]interface{}{b, a} {
+		for k := range m {
+			if _, seen := changes[k]; seen || fmt.Sprint(b[k]) == fmt.Sprint(a[k]) {
+				continue
+			}
+			c := AuditChange{From: b[k], To: a[k]}
+			if containsString(auditSecrets, k) {
+				c = AuditChange{From: redactSecret(b[k]), To: redactSecret(a[k])}
+			}
+			changes[k] = c
+		}
+	}
+	return changes
+}
+
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditActor is who made a change and from where; changes made without a
+// request, like the trash purge, are the server's own.
+func auditActor(r *http.Request) (string, string) {
+	if r == nil {
+		return "system", ""
+	}
+	return RequestUser(r), requestIP(r)
+}
+
+// audit records action on an entry in the transaction that makes the change,
+// so that a change is never stored without its event.
+func audit(tx *nutsdb.Tx, r *http.Request, action, id string, before, after *AuthDataEntity) error {
+	actor, ip := auditActor(r)
+	ev := AuditEvent{
+		Seq:      nextAuditSeq(),
+		Time:     time.Now().UnixNano() / int64(time.Millisecond),
+		Actor:    actor,
+		SourceIP: ip,
+		Action:   action,
+		EntryId:  id,
+		Before:   auditSnapshot(before),
+		After:    auditSnapshot(after),
+		Changes:  auditChanges(before, after),
+	}
+	if err := chainAudit(tx, &ev); err != nil {
+		return err
+	}
+	key := auditKey(ev.Seq)
+	if _, err := tx.Get(auditBucket, key); err == nil {
+		return fmt.Errorf("audit record %s exists", key)
+	}
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return tx.Put(auditBucket, key, val, 0)
+}
+
+// AuditFilter selects events; empty fields match everything, From and To are
+// unix millis.
+type AuditFilter struct {
+	Actor   string
+	Action  []string
+	EntryId string
+	From    int64
+	To      int64
+}
+
+func (f AuditFilter) Match(ev AuditEvent) bool {
+	if f.Actor != "" && ev.Actor != f.Actor {
+		return false
+	}
+	if len(f.Action) > 0 && !containsString(f.Action, ev.Action) {
+		return false
+	}
+	if f.EntryId != "" && !strings.Contains(ev.EntryId, f.EntryId) {
+		return false
+	}
+	if f.From > 0 && ev.Time < f.From {
+		return false
+	}
+	if f.To > 0 && ev.Time > f.To {
+		return false
+	}
+	return true
+}
+
+// loadAudit returns the matching events, newest first.
+func loadAudit(f AuditFilter) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(auditBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var ev AuditEvent
+			if err := json.Unmarshal(e.Value, &ev); err != nil {
+				return err
+			}
+			if f.Match(ev) {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Seq > events[j].Seq
+	})
+	return events, nil
+}
+
+func parseAuditFilter(r *http.Request) AuditFilter {
+	q := r.URL.Query()
+	f := AuditFilter{
+		Actor:   q.Get("actor"),
+		Action:  splitQuery(q.Get("action")),
+		EntryId: q.Get("id"),
+	}
+	f.From, _ = strconv.ParseInt(q.Get("from"), 10, 64)
+	f.To, _ = strconv.ParseInt(q.Get("to"), 10, 64)
+	return f
+}
+
+func writeAuditCSV(w http.ResponseWriter, events []AuditEvent) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="frps-auth-audit.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"seq", "time", "actor", "source_ip", "action", "entry_id", "changes"})
+	for _, ev := range events {
+		changes, _ := json.Marshal(ev.Changes)
+		cw.Write([]string{
+			strconv.FormatInt(ev.Seq, 10),
+			time.Unix(0, ev.Time*int64(time.Millisecond)).Format(time.RFC3339),
+			ev.Actor,
+			ev.SourceIP,
+			ev.Action,
+			ev.EntryId,
+			string(changes),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// AuditLogServeHTTP queries the audit log with the actor, action (comma
+// separated), id, from and to parameters. Pages follow the layui table's page
+// and limit; export=csv or export=json downloads every match instead.
+func AuditLogServeHTTP(w http.ResponseWriter, r *http.Request) {
+	events, err := loadAudit(parseAuditFilter(r))
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AuditLog-1].", 500)
+		return
+	}
+	q := r.URL.Query()
+	switch q.Get("export") {
+	case "csv":
+		if err := writeAuditCSV(w, events); err != nil {
+			Log.Error(err)
+		}
+		return
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="frps-auth-audit.json"`)
+		json.NewEncoder(w).Encode(events)
+		return
+	}
+	count := len(events)
+	if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit > 0 {
+		page, _ := strconv.Atoi(q.Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		start := (page - 1) * limit
+		if start > len(events) {
+			start = len(events)
+		}
+		end := start + limit
+		if end > len(events) {
+			end = len(events)
+		}
+		events = events[start:end]
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AuditLog-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, count, data))
+}
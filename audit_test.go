@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNextAuditSeq(t *testing.T) {
+	last := nextAuditSeq()
+	for i := 0; i < 1000; i++ {
+		seq := nextAuditSeq()
+		if seq <= last {
+			t.Fatalf("%d after %d", seq, last)
+		}
+		last = seq
+	}
+}
+
+func TestAuditChanges(t *testing.T) {
+	before := &AuthDataEntity{Id: "a", ProxyName: "a", AuthKey: "k1", Sign: "s1", Memo: "m"}
+	after := &AuthDataEntity{Id: "a", ProxyName: "a", AuthKey: "k2", Sign: "s2", Memo: "m", Disabled: true}
+	changes := auditChanges(before, after)
+	want := map[string]AuditChange{
+		"auth_key": {"***", "***"},
+		"sign":     {"***", "***"},
+		"disabled": {false, true},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("got %+v", changes)
+	}
+	if s := auditSnapshot(before); s["auth_key"] != "***" || s["memo"] != "m" {
+		t.Errorf("snapshot %+v", s)
+	}
+	if c := auditChanges(nil, after); c["proxy_name"].From != nil || c["proxy_name"].To != "a" {
+		t.Errorf("add: %+v", c)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	ev := AuditEvent{Time: 2000, Actor: "admin", Action: "update", EntryId: "tcp-ssh-6000"}
+	cases := []struct {
+		f    AuditFilter
+		want bool
+	}{
+		{AuditFilter{}, true},
+		{AuditFilter{Actor: "admin"}, true},
+		{AuditFilter{Actor: "bob"}, false},
+		{AuditFilter{Action: []string{"add", "update"}}, true},
+		{AuditFilter{Action: []string{"delete"}}, false},
+		{AuditFilter{EntryId: "ssh"}, true},
+		{AuditFilter{EntryId: "www"}, false},
+		{AuditFilter{From: 1000, To: 3000}, true},
+		{AuditFilter{From: 2001}, false},
+		{AuditFilter{To: 1999}, false},
+	}
+	for _, c := range cases {
+		if got := c.f.Match(ev); got != c.want {
+			t.Errorf("%+v: got %v", c.f, got)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	resetBuckets(t, auditBucket)
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1000"
+	r = withPrincipal(r, Principal{User: "admin", Role: RoleAdmin})
+	ae := AuthDataEntity{Id: "tcp-ssh-6000", ProxyName: "ssh", AuthKey: "k"}
+	off := ae
+	off.Disabled = true
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := audit(tx, r, "add", ae.Id, nil, &ae); err != nil {
+			return err
+		}
+		if err := audit(tx, r, "disable", ae.Id, &ae, &off); err != nil {
+			return err
+		}
+		return audit(tx, r, "delete", ae.Id, &off, nil)
+	})
+	cases := []struct {
+		query   string
+		count   int
+		actions []string
+	}{
+		{"", 3, []string{"delete", "disable", "add"}},
+		{"action=add,delete", 2, []string{"delete", "add"}},
+		{"actor=bob", 0, nil},
+		{"limit=2&page=2", 3, []string{"add"}},
+		{"limit=2&page=9", 3, nil},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		AuditLogServeHTTP(rec, httptest.NewRequest("GET", "/audit-log?"+c.query, nil))
+		var res struct {
+			Count int          `json:"count"`
+			Data  []AuditEvent `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%q: %d %q", c.query, rec.Code, rec.Body)
+		}
+		var actions []string
+		for _, ev := range res.Data {
+			actions = append(actions, ev.Action)
+			if ev.Actor != "admin" || ev.SourceIP != "192.0.2.1" {
+				t.Errorf("%q: event %+v", c.query, ev)
+			}
+		}
+		if res.Count != c.count || !reflect.DeepEqual(actions, c.actions) {
+			t.Errorf("%q: got %d %v, want %d %v", c.query, res.Count, actions, c.count, c.actions)
+		}
+	}
+	rec := httptest.NewRecorder()
+	AuditLogServeHTTP(rec, httptest.NewRequest("GET", "/audit-log?export=csv&action=disable", nil))
+	rows, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+	if err != nil || len(rows) != 2 || rows[0][0] != "seq" || rows[1][4] != "disable" || !strings.Contains(rows[1][6], `"disabled":{"from":false,"to":true}`) {
+		t.Errorf("csv: %v %q", err, rows)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	auditChainBucket      = "audit-chain"
+	auditCheckpointBucket = "audit-checkpoint"
+	auditHeadKey          = []byte("head")
+)
+
+// AuditHead is the last event of the chain, kept next to the events so that a
+// cut off tail shows.
+type AuditHead struct {
+	Seq int64 `json:"seq"`
+
+	Hash string `json:"hash"`
+}
+
+// AuditCheckpoint is the head signed with the server's Ed25519 key. Rewriting
+// the chain behind a checkpoint needs the private key.
+type AuditCheckpoint struct {
+	Seq int64 `json:"seq"`
+
+	Hash string `json:"hash"`
+
+	// unix millis
+	Time int64 `json:"time"`
+
+	Signature string `json:"signature"`
+}
+
+func (cp AuditCheckpoint) message() []byte {
+	return []byte(fmt.Sprintf("frps-auth-audit-checkpoint\n%d\n%s\n%d", cp.Seq, cp.Hash, cp.Time))
+}
+
+// chainHash is the SHA-256 of the event with Hash unset; PrevHash is part of it.
+func (ev AuditEvent) chainHash() string {
+	ev.Hash = ""
+	b, _ := json.Marshal(ev)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func getAuditHead(tx *nutsdb.Tx) (AuditHead, error) {
+	if v, ok := txLocals.get(tx, "audit-head"); ok {
+		return v.(AuditHead), nil
+	}
+	var head AuditHead
+	e, err := tx.Get(auditChainBucket, auditHeadKey)
+	if err != nil {
+		// no chain yet.
+		return head, nil
+	}
+	err = json.Unmarshal(e.Value, &head)
+	return head, err
+}
+
+// chainAudit links ev to the head and makes it the new head. Update
+// transactions are serialized, the head cannot move underneath. The clock may
+// have been set back since the head was written, so ev comes after the head
+// whatever the time.
+func chainAudit(tx *nutsdb.Tx, ev *AuditEvent) error {
+	head, err := getAuditHead(tx)
+	if err != nil {
+		return err
+	}
+	if ev.Seq <= head.Seq {
+		ev.Seq = head.Seq + 1
+		raiseAuditSeq(ev.Seq)
+	}
+	ev.PrevHash = head.Hash
+	ev.Hash = ev.chainHash()
+	head = AuditHead{Seq: ev.Seq, Hash: ev.Hash}
+	val, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	txLocals.set(tx, "audit-head", head)
+	return tx.Put(auditChainBucket, auditHeadKey, val, 0)
+}
+
+// loadAuditSigner reads the checkpoint key, creating it and its .pub file on
+// first use.
+func loadAuditSigner(keyFile string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+		pubDer, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyFile+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0644); err != nil {
+			return nil, err
+		}
+		Log.Info(fmt.Sprintf("created audit signing key %s", keyFile))
+		return priv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", keyFile)
+	}
+	return priv, nil
+}
+
+func loadAuditPublicKey(pubFile string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(pubFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", pubFile)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", pubFile)
+	}
+	return pub, nil
+}
+
+// checkpointAudit signs the head unless it is signed already.
+func checkpointAudit(priv ed25519.PrivateKey) error {
+	return dbUpdate(func(tx *nutsdb.Tx) error {
+		head, err := getAuditHead(tx)
+		if err != nil || head.Hash == "" {
+			return err
+		}
+		if _, err := tx.Get(auditCheckpointBucket, auditKey(head.Seq)); err == nil {
+			return nil
+		}
+		cp := AuditCheckpoint{
+			Seq:  head.Seq,
+			Hash: head.Hash,
+			Time: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+		cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, cp.message()))
+		val, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		return tx.Put(auditCheckpointBucket, auditKey(cp.Seq), val, 0)
+	})
+}
+
+func RunAuditCheckpoints() {
+	priv, err := loadAuditSigner(Config.AuditSigningKey)
+	if err != nil {
+		Log.Error(fmt.Sprintf("audit checkpoints disabled: %s", err))
+		return
+	}
+	for {
+		if err := checkpointAudit(priv); err != nil {
+			Log.Error(err)
+		}
+		time.Sleep(Config.AuditCheckpointInterval)
+	}
+}
+
+// AuditVerifyResult is what verify-audit found; Broken is empty when the chain
+// is intact.
+type AuditVerifyResult struct {
+	Records     int
+	Legacy      int
+	Checkpoints int
+	BrokenSeq   int64
+	Broken      string
+}
+
+// verifyAudit walks the chain from the oldest event, then checks the head and
+// every checkpoint against it.
+func verifyAudit(pub ed25519.PublicKey) (AuditVerifyResult, error) {
+	var res AuditVerifyResult
+	var events []AuditEvent
+	var head AuditHead
+	var checkpoints []AuditCheckpoint
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(auditBucket)
+		if err != nil && err != nutsdb.ErrBucketEmpty {
+			return err
+		}
+		for _, e := range entries {
+			var ev AuditEvent
+			if err := json.Unmarshal(e.Value, &ev); err != nil {
+				return fmt.Errorf("record %s: %s", e.Key, err)
+			}
+			events = append(events, ev)
+		}
+		if head, err = getAuditHead(tx); err != nil {
+			return err
+		}
+		cps, err := tx.GetAll(auditCheckpointBucket)
+		if err == nutsdb.ErrBucketEmpty {
+			// no checkpoint yet.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range cps {
+			var cp AuditCheckpoint
+			if err := json.Unmarshal(e.Value, &cp); err != nil {
+				return err
+			}
+			checkpoints = append(checkpoints, cp)
+		}
+		return nil
+	}); err != nil {
+		return res, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	broken := func(seq int64, format string, a ...interface{}) (AuditVerifyResult, error) {
+		res.BrokenSeq = seq
+		res.Broken = fmt.Sprintf(format, a...)
+		return res, nil
+	}
+	hashes := make(map[int64]string)
+	prev := ""
+	for _, ev := range events {
+		if ev.Hash == "" {
+			// written before the chain existed.
+			if prev != "" {
+				return broken(ev.Seq, "unchained record after the chain started")
+			}
+			res.Legacy++
+			continue
+		}
+		if ev.PrevHash != prev {
+			return broken(ev.Seq, "previous hash %s, want %s", ev.PrevHash, prev)
+		}
+		if h := ev.chainHash(); h != ev.Hash {
+			return broken(ev.Seq, "record hash %s, stored %s", h, ev.Hash)
+		}
+		hashes[ev.Seq] = ev.Hash
+		prev = ev.Hash
+		res.Records++
+	}
+	if head.Hash != prev {
+		return broken(head.Seq, "chain ends at %s, head is %s", prev, head.Hash)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Seq < checkpoints[j].Seq
+	})
+	for _, cp := range checkpoints {
+		sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+		if err != nil || !ed25519.Verify(pub, cp.message(), sig) {
+			return broken(cp.Seq, "bad checkpoint signature")
+		}
+		if hashes[cp.Seq] != cp.Hash {
+			return broken(cp.Seq, "checkpoint hash %s, chain has %s", cp.Hash, hashes[cp.Seq])
+		}
+		res.Checkpoints++
+	}
+	return res, nil
+}
+
+// verifyAuditCommand is `frps-auth verify-audit [-pub file]`. While the server
+// runs it verifies a snapshot the server takes through the backup API.
+func verifyAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	pubFile := fs.String("pub", Config.AuditSigningKey+".pub", "public key of the checkpoints")
+	fs.Parse(args)
+	pub, err := loadAuditPublicKey(*pubFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var res AuditVerifyResult
+	err = withLocalDB(func() error {
+		res, err = verifyAudit(pub)
+		return err
+	})
+	if err == errDbLocked {
+		// the server has the database; check a snapshot of it instead.
+		err = withServerSnapshot(func() error {
+			res, err = verifyAudit(pub)
+			return err
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if res.Broken != "" {
+		fmt.Printf("BROKEN at seq %d: %s\n", res.BrokenSeq, res.Broken)
+		return 1
+	}
+	fmt.Printf("ok: %d chained records, %d signed checkpoints, %d records from before the chain\n",
+		res.Records, res.Checkpoints, res.Legacy)
+	return 0
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeAuditEvents records n changes, two per transaction, and returns all
+// events oldest first.
+func writeAuditEvents(t *testing.T, n int) []AuditEvent {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/add-auth", nil)
+	for i := 0; i < n; i += 2 {
+		mustUpdate(t, func(tx *nutsdb.Tx) error {
+			for j := i; j < i+2 && j < n; j++ {
+				ae := &AuthDataEntity{Id: fmt.Sprint("e", j), ProxyName: "p", AuthKey: "secret"}
+				if err := audit(tx, r, "add", ae.Id, nil, ae); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	events, err := loadAudit(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Seq < events[j].Seq
+	})
+	return events
+}
+
+func putAuditEvent(t *testing.T, ev AuditEvent) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		val, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return tx.Put(auditBucket, auditKey(ev.Seq), val, 0)
+	})
+}
+
+func resetAudit(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	resetBuckets(t, auditBucket, auditChainBucket, auditCheckpointBucket)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func mustVerifyAudit(t *testing.T, pub ed25519.PublicKey) AuditVerifyResult {
+	t.Helper()
+	res, err := verifyAudit(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAuditChainIntact(t *testing.T) {
+	pub, priv := resetAudit(t)
+	if res := mustVerifyAudit(t, pub); res.Broken != "" || res.Records != 0 {
+		t.Fatalf("empty log: %+v", res)
+	}
+	writeAuditEvents(t, 3)
+	if err := checkpointAudit(priv); err != nil {
+		t.Fatal(err)
+	}
+	// the head is signed already.
+	if err := checkpointAudit(priv); err != nil {
+		t.Fatal(err)
+	}
+	writeAuditEvents(t, 2)
+	if err := checkpointAudit(priv); err != nil {
+		t.Fatal(err)
+	}
+	res := mustVerifyAudit(t, pub)
+	if res.Broken != "" || res.Records != 5 || res.Checkpoints != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	for _, ev := range writeAuditEvents(t, 0) {
+		if ev.After["auth_key"] == "secret" {
+			t.Fatal("secret in the audit log")
+		}
+	}
+}
+
+func TestAuditChainLegacyRecords(t *testing.T) {
+	pub, _ := resetAudit(t)
+	putAuditEvent(t, AuditEvent{Seq: 1, Action: "add", EntryId: "old"})
+	writeAuditEvents(t, 2)
+	res := mustVerifyAudit(t, pub)
+	if res.Broken != "" || res.Legacy != 1 || res.Records != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	// an unchained record within the chain is not legacy.
+	putAuditEvent(t, AuditEvent{Seq: nextAuditSeq(), Action: "delete", EntryId: "e0"})
+	if res := mustVerifyAudit(t, pub); !strings.Contains(res.Broken, "unchained") {
+		t.Fatalf("got %+v", res)
+	}
+}
+
+func TestAuditChainTampering(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(t *testing.T, events []AuditEvent)
+		seq    func(events []AuditEvent) int64
+		broken string
+	}{
+		{
+			"edited record",
+			func(t *testing.T, events []AuditEvent) {
+				ev := events[1]
+				ev.Actor = "somebody else"
+				putAuditEvent(t, ev)
+			},
+			func(events []AuditEvent) int64 { return events[1].Seq },
+			"record hash",
+		},
+		{
+			"removed record",
+			func(t *testing.T, events []AuditEvent) {
+				mustUpdate(t, func(tx *nutsdb.Tx) error {
+					return tx.Delete(auditBucket, auditKey(events[1].Seq))
+				})
+			},
+			func(events []AuditEvent) int64 { return events[2].Seq },
+			"previous hash",
+		},
+		{
+			"cut off tail",
+			func(t *testing.T, events []AuditEvent) {
+				mustUpdate(t, func(tx *nutsdb.Tx) error {
+					return tx.Delete(auditBucket, auditKey(events[3].Seq))
+				})
+			},
+			func(events []AuditEvent) int64 { return events[3].Seq },
+			"chain ends",
+		},
+		{
+			// without the key the rewritten chain no longer matches the
+			// checkpoint.
+			"rewritten chain",
+			func(t *testing.T, events []AuditEvent) {
+				prev := ""
+				for i, ev := range events {
+					if i == 0 {
+						ev.Actor = "somebody else"
+					}
+					ev.PrevHash = prev
+					ev.Hash = ev.chainHash()
+					prev = ev.Hash
+					putAuditEvent(t, ev)
+				}
+				mustUpdate(t, func(tx *nutsdb.Tx) error {
+					val, _ := json.Marshal(AuditHead{Seq: events[len(events)-1].Seq, Hash: prev})
+					return tx.Put(auditChainBucket, auditHeadKey, val, 0)
+				})
+			},
+			func(events []AuditEvent) int64 { return events[1].Seq },
+			"checkpoint hash",
+		},
+		{
+			"forged checkpoint",
+			func(t *testing.T, events []AuditEvent) {
+				_, other, _ := ed25519.GenerateKey(rand.Reader)
+				writeAuditEvents(t, 1)
+				if err := checkpointAudit(other); err != nil {
+					t.Fatal(err)
+				}
+			},
+			nil,
+			"bad checkpoint signature",
+		},
+	}
+	for _, c := range cases {
+		pub, priv := resetAudit(t)
+		events := writeAuditEvents(t, 2)
+		if err := checkpointAudit(priv); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, writeAuditEvents(t, 2)[2:]...)
+		c.tamper(t, events)
+		res := mustVerifyAudit(t, pub)
+		if !strings.Contains(res.Broken, c.broken) {
+			t.Errorf("%s: got %+v, want %q", c.name, res, c.broken)
+			continue
+		}
+		if c.seq != nil && res.BrokenSeq != c.seq(events) {
+			t.Errorf("%s: broken at %d, want %d", c.name, res.BrokenSeq, c.seq(events))
+		}
+	}
+}
+
+func TestAuditUnreadableCheckpoint(t *testing.T) {
+	pub, priv := resetAudit(t)
+	writeAuditEvents(t, 1)
+	if err := checkpointAudit(priv); err != nil {
+		t.Fatal(err)
+	}
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		return tx.Put(auditCheckpointBucket, auditKey(1), []byte("{"), 0)
+	})
+	if res, err := verifyAudit(pub); err == nil {
+		t.Fatalf("got %+v, want an error", res)
+	}
+}
+
+func putAuditHead(t *testing.T, head AuditHead) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		val, err := json.Marshal(head)
+		if err != nil {
+			return err
+		}
+		return tx.Put(auditChainBucket, auditHeadKey, val, 0)
+	})
+}
+
+// TestAuditSeqAfterHead stands for a clock set back across a restart: the
+// head is ahead of the time and of the process' last sequence number.
+func TestAuditSeqAfterHead(t *testing.T) {
+	pub, _ := resetAudit(t)
+	auditSeq.Lock()
+	saved := auditSeq.last
+	auditSeq.Unlock()
+	t.Cleanup(func() {
+		auditSeq.Lock()
+		auditSeq.last = saved
+		auditSeq.Unlock()
+	})
+	events := writeAuditEvents(t, 1)
+	ahead := events[0].Seq + int64(time.Hour)
+	putAuditHead(t, AuditHead{Seq: ahead, Hash: events[0].Hash})
+	auditSeq.Lock()
+	auditSeq.last = 0
+	auditSeq.Unlock()
+	events = writeAuditEvents(t, 3)[1:]
+	for i, ev := range events {
+		if want := ahead + int64(i) + 1; ev.Seq != want {
+			t.Errorf("event %d: seq %d, want %d", i, ev.Seq, want)
+		}
+	}
+	if res := mustVerifyAudit(t, pub); res.Broken != "" || res.Records != 4 {
+		t.Errorf("got %+v", res)
+	}
+	if seq := nextAuditSeq(); seq <= events[len(events)-1].Seq {
+		t.Errorf("next seq %d not after the chain", seq)
+	}
+}
+
+func TestAuditRefusesOverwrite(t *testing.T) {
+	resetAudit(t)
+	events := writeAuditEvents(t, 1)
+	ahead := events[0].Seq + int64(time.Hour)
+	putAuditHead(t, AuditHead{Seq: ahead, Hash: events[0].Hash})
+	putAuditEvent(t, AuditEvent{Seq: ahead + 1, Action: "add", EntryId: "kept"})
+	err := dbUpdate(func(tx *nutsdb.Tx) error {
+		return audit(tx, nil, "add", "new", nil, &AuthDataEntity{Id: "new"})
+	})
+	if err == nil || !strings.Contains(err.Error(), "exists") {
+		t.Fatalf("got %v", err)
+	}
+	got, err := loadAudit(AuditFilter{EntryId: "kept"})
+	if err != nil || len(got) != 1 || got[0].Action != "add" {
+		t.Errorf("record overwritten: %v %+v", err, got)
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
 	"github.com/xujiajun/nutsdb"
+	"html"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 var bucket = "auth"
@@ -63,19 +66,44 @@ type AddAuthRequest struct {
 
 	ProxyType string `json:"proxy_type"`
 
-	RemotePort uint16 `json:"remote_port"`
+	// a port, or "auto" for the next free one of the port pool
+	RemotePort RequestPort `json:"remote_port"`
 
 	ValidTo int64 `json:"auth_valid_to"`
 
 	Memo string `json:"memo"`
+
+	Email string `json:"email"`
+
+	Owner string `json:"owner"`
+
+	Contact string `json:"contact"`
+
+	Tags map[string]string `json:"tags"`
+
+	// only for users of no tenant; others add to their own
+	Tenant string `json:"tenant"`
 }
 
+// UpdateAuthRequest replaces the memo, email and valid to. Owner, contact,
+// tags and tenant are kept when left out; tags {} removes them all.
 type UpdateAuthRequest struct {
 	Id string `json:"id"`
 
 	ValidTo int64 `json:"auth_valid_to"`
 
 	Memo string `json:"memo"`
+
+	Email *string `json:"email"`
+
+	Owner *string `json:"owner"`
+
+	Contact *string `json:"contact"`
+
+	Tags map[string]string `json:"tags"`
+
+	// only users of no tenant may move an entry to another one
+	Tenant *string `json:"tenant"`
 }
 
 type AuthDataEntity struct {
@@ -91,11 +119,61 @@ type AuthDataEntity struct {
 
 	Memo string `json:"memo"`
 
+	Email string `json:"email"`
+
+	// who the entry is for and how to reach them
+	Owner string `json:"owner,omitempty"`
+
+	Contact string `json:"contact,omitempty"`
+
+	// key=value labels, e.g. customer=acme, env=prod
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// the tenant that owns the entry; empty for none
+	Tenant string `json:"tenant,omitempty"`
+
 	AuthKey string `json:"auth_key"`
 
 	Sign string `json:"sign"`
 
 	Disabled bool `json:"disabled"`
+
+	// the sync file the entry comes from; such entries are read-only
+	Managed string `json:"managed,omitempty"`
+}
+
+var errManaged = errors.New("the entry is managed by a sync file and read-only")
+
+// checkManaged refuses changes of synced entries made through the API; the
+// sync itself makes its changes without a request.
+func checkManaged(r *http.Request, ae *AuthDataEntity) error {
+	if r != nil && ae.Managed != "" {
+		return errManaged
+	}
+	return nil
+}
+
+// writeChangeError answers a failed change; errManaged, errIdTaken, a quota
+// and entries of other tenants are the client's fault.
+func writeChangeError(w http.ResponseWriter, err error, msg string) {
+	if err == errManaged || err == errIdTaken || err == errNoPortPool || err == errNoFreePort {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	if err == errNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if _, ok := err.(*QuotaError); ok {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	if _, ok := err.(*PortInUseError); ok {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	Log.Error(err)
+	http.Error(w, msg, 500)
 }
 
 func SignMD5(text string) string {
@@ -119,59 +197,112 @@ func AddAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var aa AddAuthRequest
 	err := json.NewDecoder(r.Body).Decode(&aa)
 	if err != nil {
-		fmt.Fprint(w, "Please send a valid request body.", 500)
+		http.Error(w, "Please send a valid request body.", 400)
 		return
 	}
-	Log.Info("add", aa)
-	kb := &KeyBuilder{
-		ProxyName:  aa.ProxyName,
-		ProxyType:  aa.ProxyType,
-		RemotePort: aa.RemotePort,
-		Subdomain:  aa.ProxyName,
+	if err := validateTags(aa.Tags); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
 	}
-	key := kb.Key()
-	signBody := &SignBody{
-		ProxyType:  aa.ProxyType,
-		RemotePort: aa.RemotePort,
-		Subdomain:  aa.ProxyName,
-		ValidTo:    strconv.FormatInt(aa.ValidTo, 10),
-		AuthKey:    createSignKey(),
+	tenant, err := requestTenant(r, aa.Tenant)
+	if err != nil {
+		http.Error(w, "the entry has to be of your tenant", 403)
+		return
 	}
-	sign := signBody.Sign()
+	if aa.RemotePort.Auto && containsString(portlessTypes, aa.ProxyType) {
+		http.Error(w, fmt.Sprintf("%s proxies have no remote port to allocate", aa.ProxyType), 400)
+		return
+	}
+	Log.Info("add", aa)
 	ai := &AuthDataEntity{
-		Id:         key,
 		ProxyName:  aa.ProxyName,
 		ProxyType:  aa.ProxyType,
-		RemotePort: aa.RemotePort,
+		RemotePort: aa.RemotePort.Port,
 		ValidTo:    aa.ValidTo,
 		Memo:       aa.Memo,
-		AuthKey:    signBody.AuthKey,
-		Sign:       sign,
-	}
-	val, err := json.Marshal(ai)
-	if err != nil {
-		Log.Error("Add auth failed.")
-		http.Error(w, "server error[AddAuth-0].", 500)
-		return
+		Email:      aa.Email,
+		Owner:      aa.Owner,
+		Contact:    aa.Contact,
+		Tags:       aa.Tags,
+		Tenant:     tenant,
+		AuthKey:    createSignKey(),
 	}
-	if err := Db.Update(
+	if err := dbUpdate(
 		func(tx *nutsdb.Tx) error {
-			if err := tx.Put(bucket, []byte(key), val, 0); err != nil {
+			// the port is part of the key and the sign, so both are made
+			// once it is known.
+			if aa.RemotePort.Auto {
+				port, err := allocatePort(tx, tenant)
+				if err != nil {
+					return err
+				}
+				ai.RemotePort = port
+			}
+			kb := &KeyBuilder{
+				ProxyName:  ai.ProxyName,
+				ProxyType:  ai.ProxyType,
+				RemotePort: ai.RemotePort,
+				Subdomain:  ai.ProxyName,
+			}
+			ai.Id = kb.Key()
+			signBody := &SignBody{
+				ProxyType:  ai.ProxyType,
+				RemotePort: ai.RemotePort,
+				Subdomain:  ai.ProxyName,
+				ValidTo:    strconv.FormatInt(ai.ValidTo, 10),
+				AuthKey:    ai.AuthKey,
+			}
+			ai.Sign = signBody.Sign()
+			var before *AuthDataEntity
+			if e, err := tx.Get(bucket, []byte(ai.Id)); err == nil {
+				before = &AuthDataEntity{}
+				if err := json.Unmarshal(e.Value, before); err != nil {
+					return err
+				}
+				if checkTenant(r, before) != nil {
+					return errIdTaken
+				}
+				if err := checkManaged(r, before); err != nil {
+					return err
+				}
+			}
+			if err := checkPortChange(tx, ai, before); err != nil {
 				return err
 			}
-			return nil
+			if err := checkQuota(tx, ai, before); err != nil {
+				return err
+			}
+			val, err := json.Marshal(ai)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(bucket, []byte(ai.Id), val, 0); err != nil {
+				return err
+			}
+			return recordChange(tx, r, "add", ai.Id, before, ai)
 		}); err != nil {
-		Log.Error(err)
-		http.Error(w, "server error[AddAuth-1].", 500)
+		writeChangeError(w, err, "server error[AddAuth-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"status":0}`)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      0,
+		"id":          ai.Id,
+		"remote_port": ai.RemotePort,
+	})
 }
 
+// ListAuthServeHTTP lists the entries, filtered by the parameters of
+// authFilterFromForm when there are any.
 func ListAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := authFilterFromForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	scopeFilter(r, &filter)
 	result := list.New()
-	if err := Db.View(
+	if err := dbView(
 		func(tx *nutsdb.Tx) error {
 			entries, err := tx.GetAll(bucket)
 			if err != nil {
@@ -184,7 +315,9 @@ func ListAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 				if err != nil {
 					return err
 				}
-				result.PushBack(ae)
+				if filter.Match(ae) {
+					result.PushBack(ae)
+				}
 			}
 			return nil
 		}); err != nil && err != nutsdb.ErrBucketEmpty {
@@ -197,6 +330,27 @@ func ListAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":[%s]}`, result.Len(), resultJson))
 }
 
+func loadAllAuth() ([]AuthDataEntity, error) {
+	var entries []AuthDataEntity
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		es, err := tx.GetAll(bucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range es {
+			var ae AuthDataEntity
+			if err := json.Unmarshal(e.Value, &ae); err != nil {
+				return err
+			}
+			entries = append(entries, ae)
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		return nil, err
+	}
+	return entries, nil
+}
+
 func prepareListAuthServeHTTPResp(list *list.List) string {
 	var buffer bytes.Buffer
 	for it := list.Front(); nil != it; {
@@ -218,7 +372,7 @@ func prepareListAuthServeHTTPResp(list *list.List) string {
 func GetAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	var ae AuthDataEntity
-	err := Db.View(func(tx *nutsdb.Tx) error {
+	err := dbView(func(tx *nutsdb.Tx) error {
 		e, err := tx.Get(bucket, []byte(params["id"]))
 		if nil != err {
 			return err
@@ -227,11 +381,10 @@ func GetAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if nil != err2 {
 			return err2
 		}
-		return nil
+		return checkTenant(r, &ae)
 	})
 	if nil != err {
-		Log.Error(err)
-		http.Error(w, "server error[GetAuth-1].", 500)
+		writeChangeError(w, err, "server error[GetAuth-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -247,7 +400,7 @@ func GetAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 func DisableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	Log.Info("disable", params["id"])
-	if err := Db.Update(func(tx *nutsdb.Tx) error {
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
 		var ae AuthDataEntity
 		e, err := tx.Get(bucket, []byte(params["id"]))
 		if nil != err {
@@ -257,6 +410,13 @@ func DisableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if nil != err2 {
 			return err2
 		}
+		before := ae
+		if err := checkTenant(r, &ae); err != nil {
+			return err
+		}
+		if err := checkManaged(r, &ae); err != nil {
+			return err
+		}
 
 		ae.Disabled = true
 		val, err := json.Marshal(ae)
@@ -266,10 +426,9 @@ func DisableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err := tx.Put(bucket, []byte(params["id"]), val, 0); err != nil {
 			return err
 		}
-		return nil
+		return recordChange(tx, r, "disable", params["id"], &before, &ae)
 	}); err != nil {
-		Log.Error(err)
-		http.Error(w, "server error[DisableAuth-1].", 500)
+		writeChangeError(w, err, "server error[DisableAuth-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -280,7 +439,7 @@ func DisableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 func EnableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	Log.Info("enable", params["id"])
-	if err := Db.Update(func(tx *nutsdb.Tx) error {
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
 		var ae AuthDataEntity
 		e, err := tx.Get(bucket, []byte(params["id"]))
 		if nil != err {
@@ -290,6 +449,13 @@ func EnableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if nil != err2 {
 			return err2
 		}
+		before := ae
+		if err := checkTenant(r, &ae); err != nil {
+			return err
+		}
+		if err := checkManaged(r, &ae); err != nil {
+			return err
+		}
 
 		ae.Disabled = false
 		val, err := json.Marshal(ae)
@@ -299,10 +465,9 @@ func EnableAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err := tx.Put(bucket, []byte(params["id"]), val, 0); err != nil {
 			return err
 		}
-		return nil
+		return recordChange(tx, r, "enable", params["id"], &before, &ae)
 	}); err != nil {
-		Log.Error(err)
-		http.Error(w, "server error[EnableAuth-1].", 500)
+		writeChangeError(w, err, "server error[EnableAuth-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -318,11 +483,19 @@ func UpdateAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var ua UpdateAuthRequest
 	err := json.NewDecoder(r.Body).Decode(&ua)
 	if err != nil {
-		fmt.Fprint(w, "Please send a valid request body.", 500)
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if err := validateTags(ua.Tags); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if ua.Tenant != nil && RequestPrincipal(r).Tenant != "" && *ua.Tenant != RequestPrincipal(r).Tenant {
+		http.Error(w, "the entry has to be of your tenant", 403)
 		return
 	}
 	Log.Info("update", ua)
-	if err := Db.Update(
+	if err := dbUpdate(
 		func(tx *nutsdb.Tx) error {
 
 			var ae AuthDataEntity
@@ -334,9 +507,40 @@ func UpdateAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if nil != err2 {
 				return err2
 			}
+			before := ae
+			if err := checkTenant(r, &ae); err != nil {
+				return err
+			}
+			if err := checkManaged(r, &ae); err != nil {
+				return err
+			}
 
 			ae.Memo = ua.Memo
 			ae.ValidTo = ua.ValidTo
+			if ua.Email != nil {
+				ae.Email = *ua.Email
+			}
+			if ua.Owner != nil {
+				ae.Owner = *ua.Owner
+			}
+			if ua.Contact != nil {
+				ae.Contact = *ua.Contact
+			}
+			if ua.Tags != nil {
+				ae.Tags = ua.Tags
+				if len(ae.Tags) == 0 {
+					ae.Tags = nil
+				}
+			}
+			if ua.Tenant != nil {
+				ae.Tenant = *ua.Tenant
+			}
+			if err := checkQuota(tx, &ae, &before); err != nil {
+				return err
+			}
+			if err := checkPortChange(tx, &ae, &before); err != nil {
+				return err
+			}
 			signBody := &SignBody{
 				ProxyType:  ae.ProxyType,
 				RemotePort: ae.RemotePort,
@@ -353,10 +557,9 @@ func UpdateAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if err := tx.Put(bucket, []byte(ua.Id), val, 0); err != nil {
 				return err
 			}
-			return nil
+			return recordChange(tx, r, "update", ua.Id, &before, &ae)
 		}); err != nil {
-		Log.Error(err)
-		http.Error(w, "server error[UpdateAuth-1].", 500)
+		writeChangeError(w, err, "server error[UpdateAuth-1].")
 		return
 	}
 
@@ -365,29 +568,90 @@ func UpdateAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func DeleteAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+// RotateAuthKeyServeHTTP gives the entry a new auth key; frpc has to be
+// reconfigured with the new meta_auth_key afterwards.
+func RotateAuthKeyServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
-	Log.Info("delete", params["id"])
-	err := Db.Update(func(tx *nutsdb.Tx) error {
-		err := tx.Delete(bucket, []byte(params["id"]))
+	Log.Info("rotate", params["id"])
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		var ae AuthDataEntity
+		e, err := tx.Get(bucket, []byte(params["id"]))
 		if nil != err {
 			return err
 		}
-		return nil
+		err2 := json.Unmarshal(e.Value, &ae)
+		if nil != err2 {
+			return err2
+		}
+		before := ae
+		if err := checkTenant(r, &ae); err != nil {
+			return err
+		}
+		if err := checkManaged(r, &ae); err != nil {
+			return err
+		}
+
+		signBody := &SignBody{
+			ProxyType:  ae.ProxyType,
+			RemotePort: ae.RemotePort,
+			Subdomain:  ae.ProxyName,
+			AuthKey:    createSignKey(),
+			ValidTo:    strconv.FormatInt(ae.ValidTo, 10),
+		}
+		ae.AuthKey = signBody.AuthKey
+		ae.Sign = signBody.Sign()
+		val, err := json.Marshal(ae)
+		if nil != err {
+			return err
+		}
+		if err := tx.Put(bucket, []byte(params["id"]), val, 0); err != nil {
+			return err
+		}
+		return recordChange(tx, r, "rotate", params["id"], &before, &ae)
+	}); err != nil {
+		writeChangeError(w, err, "server error[RotateAuthKey-1].")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+// DeleteAuthServeHTTP moves an entry to the trash, see trash.go.
+func DeleteAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("delete", params["id"], "by", RequestUser(r))
+	err := dbUpdate(func(tx *nutsdb.Tx) error {
+		return trashAuth(tx, r, params["id"])
 	})
 	if nil != err {
-		Log.Error(err)
-		http.Error(w, "server error[DeleteAuth-1].", 500)
+		writeChangeError(w, err, "server error[DeleteAuth-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, `{"status":0}`)
 }
 
+// authConfigInfo heads the config with who the entry is for, as ini
+// comments.
+func authConfigInfo(ae AuthDataEntity) string {
+	var sb strings.Builder
+	for _, line := range [][2]string{
+		{"owner", ae.Owner},
+		{"contact", ae.Contact},
+		{"tenant", ae.Tenant},
+		{"tags", formatTags(ae.Tags)},
+	} {
+		if line[1] != "" {
+			fmt.Fprintf(&sb, "\n\t\t<div># %s: %s</div>", line[0], html.EscapeString(line[1]))
+		}
+	}
+	return sb.String()
+}
+
 func GetAuthConfigServerHTTP(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	var ae AuthDataEntity
-	err := Db.View(func(tx *nutsdb.Tx) error {
+	err := dbView(func(tx *nutsdb.Tx) error {
 		e, err := tx.Get(bucket, []byte(params["id"]))
 		if nil != err {
 			return err
@@ -396,18 +660,17 @@ func GetAuthConfigServerHTTP(w http.ResponseWriter, r *http.Request) {
 		if nil != err2 {
 			return err2
 		}
-		return nil
+		return checkTenant(r, &ae)
 	})
 	if nil != err {
-		Log.Error(err)
-		http.Error(w, "server error[GetAuthConfig-1].", 500)
+		writeChangeError(w, err, "server error[GetAuthConfig-1].")
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-	var bodyStr string
+	bodyStr := authConfigInfo(ae)
 	if ae.ProxyType == "http" ||
 		ae.ProxyType == "https" {
-		bodyStr = fmt.Sprintf(`
+		bodyStr += fmt.Sprintf(`
 		<div>[%s-%s]</div>
 		<div>type=%s</div>
 		<div>subdomain=%s</div>
@@ -422,7 +685,7 @@ func GetAuthConfigServerHTTP(w http.ResponseWriter, r *http.Request) {
 
 	} else if ae.ProxyType == "xtcp" ||
 		ae.ProxyType == "stcp" {
-		fmt.Fprint(w, fmt.Sprintf(`
+		bodyStr += fmt.Sprintf(`
 		<div>[%s]</div>
 		<div>type=%s</div>
 		<div>sk=changeme!</div>
@@ -437,9 +700,9 @@ func GetAuthConfigServerHTTP(w http.ResponseWriter, r *http.Request) {
 		<div>#server_name=changeme!</div>
 		<div>#use_encryption=false</div>
 		<div>#use_compression=false</div>
-		`, ae.ProxyName, ae.ProxyType, strconv.FormatInt(ae.ValidTo, 10), ae.AuthKey))
+		`, ae.ProxyName, ae.ProxyType, strconv.FormatInt(ae.ValidTo, 10), ae.AuthKey)
 	} else {
-		fmt.Fprint(w, fmt.Sprintf(`
+		bodyStr += fmt.Sprintf(`
 		<div>[%s]</div>
 		<div>type=%s</div>
 		<div>remote_port=%d</div>
@@ -449,7 +712,7 @@ func GetAuthConfigServerHTTP(w http.ResponseWriter, r *http.Request) {
 		<div>#local_port=</div>
 		<div>#use_compression=false</div>
 		<div>#use_compression = true</div>
-		`, ae.ProxyName, ae.ProxyType, ae.RemotePort, strconv.FormatInt(ae.ValidTo, 10), ae.AuthKey))
+		`, ae.ProxyName, ae.ProxyType, ae.RemotePort, strconv.FormatInt(ae.ValidTo, 10), ae.AuthKey)
 	}
 
 	fmt.Fprint(w, fmt.Sprintf(`<html>
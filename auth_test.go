@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUpdateAuthBadBody(t *testing.T) {
+	for _, body := range []string{"", "{", `{"id":1}`} {
+		if rec := serve(UpdateAuthServeHTTP, "POST", "/update-auth", nil, body, RoleOperator); rec.Code != 400 {
+			t.Errorf("%q: got %d %q", body, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestUpdateAuthKeepsEmail(t *testing.T) {
+	resetBuckets(t, bucket)
+	ae := signedEntry("mail", "tcp", 6800, "k", time.Hour)
+	ae.Email = "ops@example.com"
+	putEntries(t, ae)
+	cases := []struct {
+		extra string
+		email string
+	}{
+		// a client that does not know the field leaves it alone.
+		{"", "ops@example.com"},
+		{`,"email":"dev@example.com"`, "dev@example.com"},
+		{`,"email":""`, ""},
+	}
+	for _, c := range cases {
+		body := fmt.Sprintf(`{"id":%q,"auth_valid_to":%d%s}`, ae.Id, ae.ValidTo, c.extra)
+		if rec := serve(UpdateAuthServeHTTP, "POST", "/update-auth", nil, body, RoleOperator); rec.Code != 200 {
+			t.Fatalf("%s: %d %q", c.extra, rec.Code, rec.Body)
+		}
+		if got, _ := getEntry(t, ae.Id); got.Email != c.email {
+			t.Errorf("%s: got %q, want %q", c.extra, got.Email, c.email)
+		}
+	}
+}
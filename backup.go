@@ -0,0 +1,449 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	backupMagic  = []byte("FRPSAUTHENC1\n")
+	backupPrefix = "frps-auth-backup-"
+)
+
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// encryptBackup seals the archive with AES-256-GCM under a key derived from
+// the passphrase with scrypt; the salt and nonce go in front.
+func encryptBackup(plain []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, backupMagic...), salt...), nonce...)
+	return gcm.Seal(out, nonce, plain, backupMagic), nil
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(data, backupMagic) {
+		return data, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("the backup is encrypted, a passphrase is needed")
+	}
+	data = data[len(backupMagic):]
+	if len(data) < 16 {
+		return nil, errors.New("truncated backup")
+	}
+	key, err := backupKey(passphrase, data[:16])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	data = data[16:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("truncated backup")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], backupMagic)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged backup")
+	}
+	return plain, nil
+}
+
+// createBackup is a tar.gz of the database as of one point in time: nutsdb
+// holds writers off while it is read. With a passphrase it is encrypted.
+func createBackup(passphrase string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Db.BackupTarGZ(&buf); err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return buf.Bytes(), nil
+	}
+	return encryptBackup(buf.Bytes(), passphrase)
+}
+
+func backupFileName(t time.Time, encrypted bool) string {
+	name := backupPrefix + t.Format("20060102-150405") + ".tar.gz"
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// extractBackup unpacks the archive into dir, dropping the database
+// directory name it was taken with.
+func extractBackup(archive []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return fmt.Errorf("not a backup: %s", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	files := 0
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(h.Name)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+		if name == "" || h.Typeflag == tar.TypeDir {
+			continue
+		}
+		if h.Typeflag != tar.TypeReg || strings.Contains(name, "..") {
+			return fmt.Errorf("unexpected entry %s in backup", h.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		files++
+	}
+	if files == 0 {
+		return errors.New("the backup has no database files")
+	}
+	return nil
+}
+
+type BackupRequest struct {
+	Passphrase string `json:"passphrase"`
+}
+
+// BackupServeHTTP downloads a snapshot of the database. The passphrase comes
+// in the body so that it stays out of URLs and logs; without one the
+// backup_passphrase of the config is used.
+func BackupServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var br BackupRequest
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&br); err != nil && err != io.EOF {
+			http.Error(w, "Please send a valid request body.", 400)
+			return
+		}
+	}
+	if br.Passphrase == "" {
+		br.Passphrase = Config.BackupPassphrase
+	}
+	Log.Info("backup by", RequestUser(r))
+	data, err := createBackup(br.Passphrase)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[Backup-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, backupFileName(time.Now(), br.Passphrase != "")))
+	w.Write(data)
+}
+
+// scheduledBackup writes a backup to backup_dir and keeps the newest
+// backup_keep of them.
+func scheduledBackup(now time.Time) error {
+	data, err := createBackup(Config.BackupPassphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(Config.BackupDir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(Config.BackupDir, backupFileName(now, Config.BackupPassphrase != ""))
+	if err := ioutil.WriteFile(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	Log.Info("backup written to", name)
+	files, err := filepath.Glob(filepath.Join(Config.BackupDir, backupPrefix+"*.tar.gz*"))
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, f := range files {
+		if !strings.HasSuffix(f, ".tmp") {
+			backups = append(backups, f)
+		}
+	}
+	// the timestamp in the name sorts them oldest first.
+	sort.Strings(backups)
+	for len(backups) > Config.BackupKeep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		Log.Info("removed old backup", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func RunBackupScheduler() {
+	if Config.BackupDir == "" {
+		return
+	}
+	ticker := time.NewTicker(Config.BackupInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if err := scheduledBackup(time.Now()); err != nil {
+			Log.Error(fmt.Sprintf("backup failed: %s", err))
+		}
+	}
+}
+
+func readPassphrase(file string) (string, error) {
+	if file == "" {
+		return Config.BackupPassphrase, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// adminURL is where the command line reaches the admin listener of the
+// server running on this host.
+func adminURL() string {
+	host := Config.Address
+	switch host {
+	case "", "0.0.0.0":
+		host = "127.0.0.1"
+	case "::":
+		host = "::1"
+	}
+	scheme := "http"
+	if Config.AdminTLS().Enabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, Config.Port))
+}
+
+// fetchServerBackup asks the running server for a backup through its API, as
+// the token in FRPS_AUTH_TOKEN or else the account of frps-auth.ini.
+func fetchServerBackup(passphrase string) ([]byte, error) {
+	body, err := json.Marshal(BackupRequest{Passphrase: passphrase})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", adminURL()+"/backup", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("FRPS_AUTH_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.SetBasicAuth(Config.Username, Config.Password)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	if ts := Config.AdminTLS(); ts.Enabled() {
+		tlsConfig, err := ts.pinnedClientConfig("admin")
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/backup: %s %s", adminURL(), resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// withServerSnapshot runs fn on a backup of the running server, opened from a
+// temporary directory.
+func withServerSnapshot(fn func() error) error {
+	data, err := fetchServerBackup(Config.BackupPassphrase)
+	if err != nil {
+		return err
+	}
+	archive, err := decryptBackup(data, Config.BackupPassphrase)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir("", "frps-auth-snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "db")
+	if err := extractBackup(archive, dir); err != nil {
+		return err
+	}
+	if Db, err = openDB(dir); err != nil {
+		return err
+	}
+	defer Db.Close()
+	return fn()
+}
+
+// backupCommand is `frps-auth backup [-o file] [-passphrase-file file]`. While
+// the server runs the backup is taken by it through the API, as a snapshot
+// of one point in time; otherwise the database is read directly.
+func backupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "backup file (default frps-auth-backup-<time>.tar.gz)")
+	passFile := fs.String("passphrase-file", "", "file with the passphrase to encrypt with (default backup_passphrase)")
+	fs.Parse(args)
+	passphrase, err := readPassphrase(*passFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var data []byte
+	err = withLocalDB(func() error {
+		data, err = createBackup(passphrase)
+		return err
+	})
+	if err == errDbLocked {
+		data, err = fetchServerBackup(passphrase)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	name := *out
+	if name == "" {
+		name = backupFileName(time.Now(), passphrase != "")
+	}
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(name)
+	return 0
+}
+
+// restoreCommand is `frps-auth restore [-passphrase-file file] backup`. It
+// refuses to run while the server holds the database. The current database
+// is kept next to it as frps-auth-db.before-restore-<time>.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	passFile := fs.String("passphrase-file", "", "file with the passphrase of an encrypted backup (default backup_passphrase)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: frps-auth restore [-passphrase-file file] backup")
+		return 2
+	}
+	passphrase, err := readPassphrase(*passFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	archive, err := decryptBackup(data, passphrase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	release, err := lockDB(dbLockFile())
+	if err == errDbLocked {
+		fmt.Fprintln(os.Stderr, "frps-auth is running, stop it before restoring")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer release()
+	tmp := dbDir + ".restore"
+	if err := os.RemoveAll(tmp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := extractBackup(archive, tmp); err != nil {
+		os.RemoveAll(tmp)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	restored, err := openDB(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		fmt.Fprintf(os.Stderr, "the backup does not open: %s\n", err)
+		return 1
+	}
+	restored.Close()
+	old := dbDir + ".before-restore-" + time.Now().Format("20060102-150405")
+	if err := os.Rename(dbDir, old); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := os.Rename(tmp, dbDir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("restored %s, the previous database is in %s\n", fs.Arg(0), old)
+	return 0
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptBackup(t *testing.T) {
+	plain := []byte("archive")
+	sealed, err := encryptBackup(plain, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		err        string
+	}{
+		{"right passphrase", sealed, "pass", ""},
+		{"wrong passphrase", sealed, "wrong", "wrong passphrase or damaged backup"},
+		{"no passphrase", sealed, "", "the backup is encrypted, a passphrase is needed"},
+		{"damaged", append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1), "pass", "wrong passphrase or damaged backup"},
+		{"truncated", sealed[:len(backupMagic)+20], "pass", "truncated backup"},
+		{"not encrypted", plain, "pass", ""},
+	}
+	for _, c := range cases {
+		got, err := decryptBackup(c.data, c.passphrase)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if msg != c.err || (err == nil && !bytes.Equal(got, plain)) {
+			t.Errorf("%s: got %q %q, want %q", c.name, got, msg, c.err)
+		}
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	resetBuckets(t, bucket)
+	ae := signedEntry("backup", "tcp", 6500, "k", time.Hour)
+	putEntries(t, ae)
+	sealed, err := createBackup("pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := decryptBackup(sealed, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := extractBackup(archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	opt := nutsdb.DefaultOptions
+	opt.Dir = dir
+	db, err := nutsdb.Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var got AuthDataEntity
+	if err := db.View(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(bucket, []byte(ae.Id))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(e.Value, &got)
+	}); err != nil || !reflect.DeepEqual(got, ae) {
+		t.Errorf("got %v %+v", err, got)
+	}
+	// files are never overwritten.
+	if err := extractBackup(archive, dir); err == nil {
+		t.Error("extracted over existing files")
+	}
+}
+
+func tarGz(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("x"))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestExtractBackupRejects(t *testing.T) {
+	cases := []struct {
+		name    string
+		archive []byte
+		err     string
+	}{
+		{"not gzip", []byte("plain"), "not a backup"},
+		{"empty", tarGz(t), "the backup has no database files"},
+		{"only the top directory", tarGz(t, "db"), "the backup has no database files"},
+		{"escaping path", tarGz(t, "db/../../x.dat"), "unexpected entry"},
+	}
+	for _, c := range cases {
+		err := extractBackup(c.archive, t.TempDir())
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+func TestScheduledBackupKeeps(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.BackupDir = t.TempDir()
+	Config.BackupKeep = 2
+	Config.BackupPassphrase = ""
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		if err := scheduledBackup(now.Add(time.Duration(i) * time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(Config.BackupDir, "*"))
+	want := []string{
+		filepath.Join(Config.BackupDir, "frps-auth-backup-20300102-040405.tar.gz"),
+		filepath.Join(Config.BackupDir, "frps-auth-backup-20300102-050405.tar.gz"),
+	}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", files, want)
+	}
+}
+
+func TestLockDB(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "db.lock")
+	release, err := lockDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockDB(name); err != errDbLocked {
+		t.Errorf("second lock: got %v, want errDbLocked", err)
+	}
+	release()
+	release, err = lockDB(name)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	release()
+}
+
+func TestAdminURL(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.Port = "4000"
+	cases := []struct {
+		address string
+		want    string
+	}{
+		{"", "http://127.0.0.1:4000"},
+		{"0.0.0.0", "http://127.0.0.1:4000"},
+		{"::", "http://[::1]:4000"},
+		{"10.0.0.1", "http://10.0.0.1:4000"},
+	}
+	for _, c := range cases {
+		Config.Address = c.address
+		if got := adminURL(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.address, got, c.want)
+		}
+	}
+}
+
+func TestFetchServerBackup(t *testing.T) {
+	resetBuckets(t, bucket)
+	ae := signedEntry("fetch", "tcp", 6501, "k", time.Hour)
+	putEntries(t, ae)
+	srv := httptest.NewServer(NewHttpAuthMiddleware(Config.Username, Config.Password).Middleware(http.HandlerFunc(BackupServeHTTP)))
+	defer srv.Close()
+	saved := Config
+	defer func() { Config = saved }()
+	Config.Address, Config.Port, _ = net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	data, err := fetchServerBackup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := extractBackup(data, t.TempDir()); err != nil {
+		t.Errorf("fetched backup: %v", err)
+	}
+	os.Setenv("FRPS_AUTH_TOKEN", "fat_nope_secret")
+	defer os.Unsetenv("FRPS_AUTH_TOKEN")
+	if _, err := fetchServerBackup(""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unknown token: got %v", err)
+	}
+}
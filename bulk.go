@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthFilter selects entries; empty fields match everything. ValidFrom and
+// ValidTo bound auth_valid_to, in unix millis. Tags are selectors key=value,
+// or key for any value, that all have to match.
+type AuthFilter struct {
+	Id string `json:"id"`
+
+	ProxyType string `json:"proxy_type"`
+
+	Memo string `json:"memo"`
+
+	// found in owner or contact, ignoring case
+	Owner string `json:"owner"`
+
+	Tags []string `json:"tags"`
+
+	Tenant string `json:"tenant"`
+
+	Disabled *bool `json:"disabled"`
+
+	ValidFrom int64 `json:"valid_from"`
+
+	ValidTo int64 `json:"valid_to"`
+}
+
+func (f AuthFilter) Match(ae AuthDataEntity) bool {
+	if f.Id != "" && !strings.Contains(ae.Id, f.Id) {
+		return false
+	}
+	if f.ProxyType != "" && ae.ProxyType != f.ProxyType {
+		return false
+	}
+	if f.Memo != "" && !strings.Contains(ae.Memo, f.Memo) {
+		return false
+	}
+	if f.Owner != "" && !strings.Contains(strings.ToLower(ae.Owner+" "+ae.Contact), strings.ToLower(f.Owner)) {
+		return false
+	}
+	if !matchTags(ae.Tags, f.Tags) {
+		return false
+	}
+	if f.Tenant != "" && ae.Tenant != f.Tenant {
+		return false
+	}
+	if f.Disabled != nil && ae.Disabled != *f.Disabled {
+		return false
+	}
+	if f.ValidFrom > 0 && ae.ValidTo < f.ValidFrom {
+		return false
+	}
+	if f.ValidTo > 0 && ae.ValidTo > f.ValidTo {
+		return false
+	}
+	return true
+}
+
+// authFilterFromForm reads a filter from query or form parameters, as the
+// list table sends them; tag may be repeated or comma separated.
+func authFilterFromForm(r *http.Request) (AuthFilter, error) {
+	f := AuthFilter{
+		Id:        strings.TrimSpace(r.FormValue("id")),
+		ProxyType: strings.TrimSpace(r.FormValue("proxy_type")),
+		Memo:      strings.TrimSpace(r.FormValue("memo")),
+		Owner:     strings.TrimSpace(r.FormValue("owner")),
+		Tenant:    strings.TrimSpace(r.FormValue("tenant")),
+	}
+	for _, v := range r.Form["tag"] {
+		f.Tags = append(f.Tags, splitQuery(v)...)
+	}
+	if v := r.FormValue("disabled"); v != "" {
+		d, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid disabled %q", v)
+		}
+		f.Disabled = &d
+	}
+	for name, p := range map[string]*int64{"valid_from": &f.ValidFrom, "valid_to": &f.ValidTo} {
+		if v := r.FormValue(name); v != "" {
+			ms, err := parseValidTo(v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*p = ms
+		}
+	}
+	return f, nil
+}
+
+// BulkAuthRequest applies Op to Ids, or to every entry matching Filter when
+// there are no ids.
+type BulkAuthRequest struct {
+	Op string `json:"op"`
+
+	Ids []string `json:"ids"`
+
+	Filter *AuthFilter `json:"filter"`
+
+	// for extend
+	Days int `json:"days"`
+
+	// for memo
+	Memo string `json:"memo"`
+
+	// for tags: merged into the tags of each entry, an empty value removes
+	// the tag
+	Tags map[string]string `json:"tags"`
+
+	// for owner, both are set
+	Owner string `json:"owner"`
+
+	Contact string `json:"contact"`
+}
+
+type BulkAuthResult struct {
+	Id string `json:"id"`
+
+	Ok bool `json:"ok"`
+
+	Error string `json:"error,omitempty"`
+}
+
+var bulkOps = map[string]string{
+	"delete":  RoleAdmin,
+	"disable": RoleOperator,
+	"enable":  RoleOperator,
+	"extend":  RoleOperator,
+	"memo":    RoleOperator,
+	"tags":    RoleOperator,
+	"owner":   RoleOperator,
+}
+
+func (br BulkAuthRequest) validate() error {
+	if _, ok := bulkOps[br.Op]; !ok {
+		return fmt.Errorf("unknown op %q", br.Op)
+	}
+	if len(br.Ids) == 0 && br.Filter == nil {
+		return errors.New("ids or filter is required")
+	}
+	if br.Op == "extend" && br.Days <= 0 {
+		return errors.New("days must be positive")
+	}
+	if br.Op == "tags" {
+		if len(br.Tags) == 0 {
+			return errors.New("tags is required")
+		}
+		set := make(map[string]string)
+		for k, v := range br.Tags {
+			if v != "" {
+				set[k] = v
+			} else if !tagKeyPattern.MatchString(k) {
+				return fmt.Errorf("invalid tag key %q", k)
+			}
+		}
+		return validateTags(set)
+	}
+	return nil
+}
+
+// bulkTargets resolves the ids to work on, each once.
+func bulkTargets(tx *nutsdb.Tx, br BulkAuthRequest) ([]string, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	if len(br.Ids) > 0 {
+		for _, id := range br.Ids {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+	entries, err := tx.GetAll(bucket)
+	if err == nutsdb.ErrBucketEmpty {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		var ae AuthDataEntity
+		if err := json.Unmarshal(e.Value, &ae); err != nil {
+			return nil, err
+		}
+		if br.Filter.Match(ae) {
+			ids = append(ids, ae.Id)
+		}
+	}
+	return ids, nil
+}
+
+// bulkApply applies op to one entry.
+func bulkApply(tx *nutsdb.Tx, r *http.Request, br BulkAuthRequest, id string) error {
+	e, err := tx.Get(bucket, []byte(id))
+	if err != nil {
+		return errNotFound
+	}
+	if br.Op == "delete" {
+		return trashAuth(tx, r, id)
+	}
+	var ae AuthDataEntity
+	if err := json.Unmarshal(e.Value, &ae); err != nil {
+		return err
+	}
+	before := ae
+	if err := checkTenant(r, &ae); err != nil {
+		return err
+	}
+	if err := checkManaged(r, &ae); err != nil {
+		return err
+	}
+	switch br.Op {
+	case "disable":
+		ae.Disabled = true
+	case "enable":
+		ae.Disabled = false
+	case "extend":
+		ae.ValidTo += int64(br.Days) * int64(24*time.Hour/time.Millisecond)
+		signBody := &SignBody{
+			ProxyType:  ae.ProxyType,
+			RemotePort: ae.RemotePort,
+			Subdomain:  ae.ProxyName,
+			AuthKey:    ae.AuthKey,
+			ValidTo:    strconv.FormatInt(ae.ValidTo, 10),
+		}
+		ae.Sign = signBody.Sign()
+		if err := checkQuota(tx, &ae, &before); err != nil {
+			return err
+		}
+	case "memo":
+		ae.Memo = br.Memo
+	case "tags":
+		tags := make(map[string]string)
+		for k, v := range ae.Tags {
+			tags[k] = v
+		}
+		for k, v := range br.Tags {
+			if v == "" {
+				delete(tags, k)
+			} else {
+				tags[k] = v
+			}
+		}
+		ae.Tags = tags
+		if len(tags) == 0 {
+			ae.Tags = nil
+		}
+	case "owner":
+		ae.Owner = br.Owner
+		ae.Contact = br.Contact
+	}
+	val, err := json.Marshal(ae)
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(bucket, []byte(id), val, 0); err != nil {
+		return err
+	}
+	return recordChange(tx, r, br.Op, id, &before, &ae)
+}
+
+// BulkAuthServeHTTP applies one operation to many entries in one
+// transaction: either every entry is changed or, when one fails, none is.
+// The response lists the result of each entry either way.
+func BulkAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var br BulkAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&br); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if err := br.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !RequestPrincipal(r).HasRole(bulkOps[br.Op]) {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if br.Filter != nil {
+		scopeFilter(r, br.Filter)
+	}
+	Log.Info("bulk", br.Op, "by", RequestUser(r))
+	var results []BulkAuthResult
+	failed := errors.New("bulk operation failed")
+	err := dbUpdate(func(tx *nutsdb.Tx) error {
+		results = nil
+		ids, err := bulkTargets(tx, br)
+		if err != nil {
+			return err
+		}
+		ok := true
+		for _, id := range ids {
+			res := BulkAuthResult{Id: id, Ok: true}
+			if err := bulkApply(tx, r, br, id); err != nil {
+				res = BulkAuthResult{Id: id, Error: err.Error()}
+				ok = false
+			}
+			results = append(results, res)
+		}
+		if !ok {
+			return failed
+		}
+		return nil
+	})
+	if err != nil && err != failed {
+		Log.Error(err)
+		http.Error(w, "server error[BulkAuth-1].", 500)
+		return
+	}
+	status := 0
+	if err == failed {
+		// nothing was committed.
+		status = 1
+		for i := range results {
+			if results[i].Ok {
+				results[i] = BulkAuthResult{Id: results[i].Id, Error: "rolled back"}
+			}
+		}
+	}
+	if results == nil {
+		results = []BulkAuthResult{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"count":   len(results),
+		"results": results,
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuthFilter(t *testing.T) {
+	yes, no := true, false
+	ae := AuthDataEntity{Id: "tcp-ssh-6000", ProxyType: "tcp", Memo: "office", ValidTo: 2000, Disabled: true}
+	cases := []struct {
+		f    AuthFilter
+		want bool
+	}{
+		{AuthFilter{}, true},
+		{AuthFilter{Id: "ssh"}, true},
+		{AuthFilter{Id: "www"}, false},
+		{AuthFilter{ProxyType: "udp"}, false},
+		{AuthFilter{Memo: "off"}, true},
+		{AuthFilter{Disabled: &yes}, true},
+		{AuthFilter{Disabled: &no}, false},
+		{AuthFilter{ValidFrom: 1000, ValidTo: 3000}, true},
+		{AuthFilter{ValidFrom: 2001}, false},
+		{AuthFilter{ValidTo: 1999}, false},
+	}
+	for _, c := range cases {
+		if got := c.f.Match(ae); got != c.want {
+			t.Errorf("%+v: got %v", c.f, got)
+		}
+	}
+}
+
+func TestBulkAuthValidate(t *testing.T) {
+	cases := []struct {
+		br  BulkAuthRequest
+		err string
+	}{
+		{BulkAuthRequest{Op: "disable", Ids: []string{"a"}}, ""},
+		{BulkAuthRequest{Op: "memo", Filter: &AuthFilter{}}, ""},
+		{BulkAuthRequest{Op: "drop", Ids: []string{"a"}}, `unknown op "drop"`},
+		{BulkAuthRequest{Op: "enable"}, "ids or filter is required"},
+		{BulkAuthRequest{Op: "extend", Ids: []string{"a"}}, "days must be positive"},
+	}
+	for _, c := range cases {
+		got := ""
+		if err := c.br.validate(); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%+v: got %q, want %q", c.br, got, c.err)
+		}
+	}
+}
+
+type bulkResponse struct {
+	Status  int              `json:"status"`
+	Results []BulkAuthResult `json:"results"`
+}
+
+func bulk(t *testing.T, body, role string) (int, bulkResponse) {
+	t.Helper()
+	rec := serve(BulkAuthServeHTTP, "POST", "/bulk-auth", nil, body, role)
+	var res bulkResponse
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%q", rec.Body)
+		}
+	}
+	return rec.Code, res
+}
+
+func TestBulkAuth(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket, auditBucket)
+	a := signedEntry("a", "tcp", 6400, "k", time.Hour)
+	b := signedEntry("b", "tcp", 6401, "k", time.Hour)
+	c := signedEntry("c", "udp", 6402, "k", time.Hour)
+	putEntries(t, a, b, c)
+	if code, _ := bulk(t, `{"op":"delete","ids":["`+a.Id+`"]}`, RoleOperator); code != 403 {
+		t.Errorf("delete as operator: %d", code)
+	}
+	code, res := bulk(t, `{"op":"extend","days":2,"filter":{"proxy_type":"tcp"}}`, RoleOperator)
+	if code != 200 || res.Status != 0 || len(res.Results) != 2 {
+		t.Fatalf("extend: %d %+v", code, res)
+	}
+	for _, ae := range []AuthDataEntity{a, b} {
+		got, _ := getEntry(t, ae.Id)
+		if got.ValidTo != ae.ValidTo+2*24*3600*1000 {
+			t.Errorf("%s valid to %d", ae.Id, got.ValidTo)
+		}
+		if reject, reason := callPlugin(t, "NewProxy", pluginContent(got, "k", "r1")); reject {
+			t.Errorf("%s rejected after extend: %s", ae.Id, reason)
+		}
+	}
+	// one missing id rolls back the whole operation.
+	events, _ := loadAudit(AuditFilter{})
+	code, res = bulk(t, `{"op":"disable","ids":["`+c.Id+`","nope","`+c.Id+`"]}`, RoleOperator)
+	want := []BulkAuthResult{{Id: c.Id, Error: "rolled back"}, {Id: "nope", Error: "not found"}}
+	if code != 200 || res.Status != 1 || len(res.Results) != 2 || res.Results[0] != want[0] || res.Results[1] != want[1] {
+		t.Fatalf("rollback: %d %+v", code, res)
+	}
+	if got, _ := getEntry(t, c.Id); got.Disabled {
+		t.Error("disable not rolled back")
+	}
+	if after, _ := loadAudit(AuditFilter{}); len(after) != len(events) {
+		t.Errorf("%d audit events after a rollback, want %d", len(after), len(events))
+	}
+	code, res = bulk(t, `{"op":"delete","ids":["`+a.Id+`","`+c.Id+`"]}`, RoleAdmin)
+	if code != 200 || res.Status != 0 {
+		t.Fatalf("delete: %d %+v", code, res)
+	}
+	if ids := trashIds(t); len(ids) != 2 {
+		t.Errorf("trash %v", ids)
+	}
+}
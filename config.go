@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"os"
+	"strconv"
+	"time"
+)
+
+type AuthConfig struct {
+	Address  string `ini:"address"`
+	Port     string `ini:"port"`
+	Username string `ini:"username"`
+	Password string `ini:"password"`
+	Salt     string `ini:"salt"`
+	Static   string `ini:"static"`
+
+	SessionIdleTimeout time.Duration `ini:"session_idle_timeout"`
+	SessionMaxAge      time.Duration `ini:"session_max_age"`
+
+	AdminAllowIPs  string `ini:"admin_allow_ips"`
+	PluginAddress  string `ini:"plugin_address"`
+	PluginPort     string `ini:"plugin_port"`
+	PluginUnix     string `ini:"plugin_unix"`
+	PluginAllowIPs string `ini:"plugin_allow_ips"`
+
+	PluginRequireToken bool `ini:"plugin_require_token"`
+
+	OnlineTTL time.Duration `ini:"online_ttl"`
+
+	TlsCertFile   string `ini:"tls_cert_file"`
+	TlsKeyFile    string `ini:"tls_key_file"`
+	TlsMinVersion string `ini:"tls_min_version"`
+	TlsSelfSigned bool   `ini:"tls_self_signed"`
+
+	PluginTlsCertFile   string `ini:"plugin_tls_cert_file"`
+	PluginTlsKeyFile    string `ini:"plugin_tls_key_file"`
+	PluginTlsMinVersion string `ini:"plugin_tls_min_version"`
+	PluginTlsSelfSigned bool   `ini:"plugin_tls_self_signed"`
+	PluginTlsClientCA   string `ini:"plugin_tls_client_ca"`
+
+	SmtpHost     string `ini:"smtp_host"`
+	SmtpPort     string `ini:"smtp_port"`
+	SmtpUsername string `ini:"smtp_username"`
+	SmtpPassword string `ini:"smtp_password"`
+	SmtpFrom     string `ini:"smtp_from"`
+	RemindDays   string `ini:"remind_days"`
+	RemindTpl    string `ini:"remind_template"`
+
+	OidcIssuer       string `ini:"oidc_issuer"`
+	OidcName         string `ini:"oidc_name"`
+	OidcClientId     string `ini:"oidc_client_id"`
+	OidcClientSecret string `ini:"oidc_client_secret"`
+	OidcRedirectURL  string `ini:"oidc_redirect_url"`
+	OidcScopes       string `ini:"oidc_scopes"`
+	OidcGroupsClaim  string `ini:"oidc_groups_claim"`
+	OidcRoleMap      string `ini:"oidc_role_map"`
+	OidcDefaultRole  string `ini:"oidc_default_role"`
+
+	LdapURL          string `ini:"ldap_url"`
+	LdapStartTLS     bool   `ini:"ldap_start_tls"`
+	LdapCAFile       string `ini:"ldap_ca_file"`
+	LdapBindDN       string `ini:"ldap_bind_dn"`
+	LdapBindPassword string `ini:"ldap_bind_password"`
+	LdapBaseDN       string `ini:"ldap_base_dn"`
+	LdapUserFilter   string `ini:"ldap_user_filter"`
+	LdapGroupAttr    string `ini:"ldap_group_attr"`
+	LdapGroupBaseDN  string `ini:"ldap_group_base_dn"`
+	LdapGroupFilter  string `ini:"ldap_group_filter"`
+	LdapRoleMap      string `ini:"ldap_role_map"`
+	LdapDefaultRole  string `ini:"ldap_default_role"`
+
+	LockoutThreshold   int           `ini:"lockout_threshold"`
+	LockoutDuration    time.Duration `ini:"lockout_duration"`
+	LockoutMaxDuration time.Duration `ini:"lockout_max_duration"`
+	LockoutReset       time.Duration `ini:"lockout_reset"`
+
+	PluginBanThreshold   int           `ini:"plugin_ban_threshold"`
+	PluginBanDuration    time.Duration `ini:"plugin_ban_duration"`
+	PluginBanMaxDuration time.Duration `ini:"plugin_ban_max_duration"`
+	PluginBanReset       time.Duration `ini:"plugin_ban_reset"`
+
+	AuditSigningKey         string        `ini:"audit_signing_key"`
+	AuditCheckpointInterval time.Duration `ini:"audit_checkpoint_interval"`
+
+	TrashRetention time.Duration `ini:"trash_retention"`
+
+	BackupDir        string        `ini:"backup_dir"`
+	BackupInterval   time.Duration `ini:"backup_interval"`
+	BackupKeep       int           `ini:"backup_keep"`
+	BackupPassphrase string        `ini:"backup_passphrase"`
+
+	SyncPath     string        `ini:"sync_path"`
+	SyncPrune    bool          `ini:"sync_prune"`
+	SyncInterval time.Duration `ini:"sync_interval"`
+
+	PortPool     string `ini:"port_pool"`
+	PortReserved string `ini:"port_reserved"`
+}
+
+var Config AuthConfig = AuthConfig{
+	Address:  "127.0.0.1",
+	Port:     "4000",
+	Username: "admin",
+	Password: "admin",
+	Salt:     "admin",
+	Static:   "",
+
+	SessionIdleTimeout: 30 * time.Minute,
+	SessionMaxAge:      12 * time.Hour,
+
+	OnlineTTL: 90 * time.Second,
+
+	TlsMinVersion:       "1.2",
+	PluginTlsMinVersion: "1.2",
+
+	SmtpPort:   "25",
+	RemindDays: "14,3,1,0",
+
+	OidcName:        "SSO",
+	OidcScopes:      "openid profile email",
+	OidcGroupsClaim: "groups",
+
+	LdapUserFilter:  "(uid=%s)",
+	LdapGroupAttr:   "memberOf",
+	LdapGroupFilter: "(member=%s)",
+
+	LockoutThreshold:   5,
+	LockoutDuration:    time.Minute,
+	LockoutMaxDuration: time.Hour,
+	LockoutReset:       15 * time.Minute,
+
+	PluginBanThreshold:   10,
+	PluginBanDuration:    5 * time.Minute,
+	PluginBanMaxDuration: 24 * time.Hour,
+	PluginBanReset:       time.Hour,
+
+	AuditSigningKey:         "frps-auth-audit.key",
+	AuditCheckpointInterval: time.Hour,
+
+	TrashRetention: 30 * 24 * time.Hour,
+
+	BackupInterval: 24 * time.Hour,
+	BackupKeep:     7,
+
+	SyncInterval: 10 * time.Second,
+}
+
+var configFile = "frps-auth.ini"
+
+func init() {
+	c, err := loadConfig(configFile)
+	if err != nil {
+		Log.Error(err)
+		os.Exit(-1)
+	}
+	Config = c
+}
+
+// loadConfig maps the ini file over the defaults. A missing file is not an
+// error, the defaults are used as they are.
+func loadConfig(filename string) (AuthConfig, error) {
+	c := Config
+	iniFile, err := ini.Load(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			Log.Warning(fmt.Sprintf("%s not found, using defaults.", filename))
+			return c, nil
+		}
+		return c, err
+	}
+	iniFile.BlockMode = false
+	if err := iniFile.MapTo(&c); err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+func (c AuthConfig) Validate() error {
+	if c.Salt == "" {
+		return errors.New("salt is required")
+	}
+	if _, err := strconv.ParseUint(c.Port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", c.Port)
+	}
+	if c.SessionIdleTimeout <= 0 || c.SessionMaxAge <= 0 {
+		return errors.New("session timeouts must be positive")
+	}
+	if err := c.LoginLockout().Validate(); err != nil {
+		return fmt.Errorf("invalid lockout: %s", err)
+	}
+	if err := c.PluginBan().Validate(); err != nil {
+		return fmt.Errorf("invalid plugin_ban: %s", err)
+	}
+	if c.AuditCheckpointInterval <= 0 {
+		return errors.New("audit_checkpoint_interval must be positive")
+	}
+	if c.OnlineTTL < 0 {
+		return errors.New("online_ttl must not be negative")
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash_retention must not be negative")
+	}
+	if c.BackupDir != "" && (c.BackupInterval <= 0 || c.BackupKeep < 1) {
+		return errors.New("backup_interval must be positive and backup_keep at least 1")
+	}
+	if c.SyncPath != "" && c.SyncInterval <= 0 {
+		return errors.New("sync_interval must be positive")
+	}
+	if _, err := parsePortRanges(splitQuery(c.PortPool)); err != nil {
+		return fmt.Errorf("invalid port_pool: %s", err)
+	}
+	if _, err := parsePortRanges(splitQuery(c.PortReserved)); err != nil {
+		return fmt.Errorf("invalid port_reserved: %s", err)
+	}
+	if c.PluginPort != "" {
+		if _, err := strconv.ParseUint(c.PluginPort, 10, 16); err != nil {
+			return fmt.Errorf("invalid plugin_port %q", c.PluginPort)
+		}
+	}
+	if c.PluginPort != "" && c.PluginUnix != "" {
+		return errors.New("plugin_port and plugin_unix are exclusive")
+	}
+	if _, err := parseIPNets(c.AdminAllowIPs); err != nil {
+		return fmt.Errorf("invalid admin_allow_ips: %s", err)
+	}
+	if _, err := parseIPNets(c.PluginAllowIPs); err != nil {
+		return fmt.Errorf("invalid plugin_allow_ips: %s", err)
+	}
+	if err := c.AdminTLS().Validate("admin"); err != nil {
+		return err
+	}
+	if err := c.PluginTLS().Validate("plugin"); err != nil {
+		return err
+	}
+	if c.SmtpHost != "" {
+		if c.SmtpFrom == "" {
+			return errors.New("smtp_from is required when smtp_host is set")
+		}
+		if _, err := strconv.ParseUint(c.SmtpPort, 10, 16); err != nil {
+			return fmt.Errorf("invalid smtp_port %q", c.SmtpPort)
+		}
+	}
+	if c.OidcEnabled() {
+		if c.OidcClientId == "" || c.OidcRedirectURL == "" {
+			return errors.New("oidc_client_id and oidc_redirect_url are required when oidc_issuer is set")
+		}
+		if _, err := parseRoleMap(c.OidcRoleMap); err != nil {
+			return fmt.Errorf("invalid oidc_role_map: %s", err)
+		}
+		if _, ok := roleLevels[c.OidcDefaultRole]; c.OidcDefaultRole != "" && !ok {
+			return fmt.Errorf("invalid oidc_default_role %q", c.OidcDefaultRole)
+		}
+	}
+	if c.LdapEnabled() {
+		if err := validateLdapConfig(c); err != nil {
+			return err
+		}
+	}
+	if c.RemindTpl != "" {
+		if _, err := os.Stat(c.RemindTpl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c AuthConfig) OidcEnabled() bool {
+	return c.OidcIssuer != ""
+}
+
+func (c AuthConfig) LdapEnabled() bool {
+	return c.LdapURL != ""
+}
+
+func (c AuthConfig) LoginLockout() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:   c.LockoutThreshold,
+		Duration:    c.LockoutDuration,
+		MaxDuration: c.LockoutMaxDuration,
+		Reset:       c.LockoutReset,
+	}
+}
+
+func (c AuthConfig) PluginBan() LockoutPolicy {
+	return LockoutPolicy{
+		Threshold:   c.PluginBanThreshold,
+		Duration:    c.PluginBanDuration,
+		MaxDuration: c.PluginBanMaxDuration,
+		Reset:       c.PluginBanReset,
+	}
+}
+
+// SeparatePlugin reports whether the frps plugin endpoint has a listener of its
+// own instead of sharing the admin one.
+func (c AuthConfig) SeparatePlugin() bool {
+	return c.PluginPort != "" || c.PluginUnix != ""
+}
+
+// AdminTLS is the TLS of the admin listener. When the plugin endpoint shares it,
+// the plugin client CA applies to it as well.
+func (c AuthConfig) AdminTLS() TLSSettings {
+	ts := TLSSettings{
+		CertFile:   c.TlsCertFile,
+		KeyFile:    c.TlsKeyFile,
+		MinVersion: c.TlsMinVersion,
+		SelfSigned: c.TlsSelfSigned,
+	}
+	if !c.SeparatePlugin() {
+		ts.ClientCA = c.PluginTlsClientCA
+	}
+	return ts
+}
+
+func (c AuthConfig) PluginTLS() TLSSettings {
+	if !c.SeparatePlugin() {
+		return c.AdminTLS()
+	}
+	return TLSSettings{
+		CertFile:   c.PluginTlsCertFile,
+		KeyFile:    c.PluginTlsKeyFile,
+		MinVersion: c.PluginTlsMinVersion,
+		SelfSigned: c.PluginTlsSelfSigned,
+		ClientCA:   c.PluginTlsClientCA,
+	}
+}
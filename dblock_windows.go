@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which syscall lacks.
+const errorSharingViolation syscall.Errno = 32
+
+// lockDB takes the lock file of the database, which the server holds for as
+// long as it runs. Windows has no flock; a file opened without sharing does
+// the same and is let go when the process ends.
+func lockDB(name string) (func(), error) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, errDbLocked
+		}
+		return nil, err
+	}
+	return func() {
+		syscall.CloseHandle(h)
+	}, nil
+}
@@ -4,13 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/gorilla/mux"
 	"github.com/op/go-logging"
 	"github.com/xujiajun/nutsdb"
-	"gopkg.in/ini.v1"
-	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -42,49 +40,84 @@ var format = logging.MustStringFormatter(
 	`%{color}%{time:15:04:05.000} %{shortfunc} > %{level:.4s} %{id:03x}%{color:reset} %{message}`,
 )
 
-func createDB() *nutsdb.DB {
+var dbDir = "frps-auth-db"
+
+// Db is opened by main for the server; subcommands open it themselves, and
+// only while no server holds the lock file.
+var Db *nutsdb.DB
+
+var errDbLocked = errors.New("the database is in use by a running frps-auth")
+
+func dbLockFile() string {
+	return dbDir + ".lock"
+}
+
+func openDB(dir string) (*nutsdb.DB, error) {
 	opt := nutsdb.DefaultOptions
-	opt.Dir = "frps-auth-db"
-	db, err := nutsdb.Open(opt)
+	opt.Dir = dir
+	return nutsdb.Open(opt)
+}
+
+// withLocalDB runs fn on the database of this directory, which nothing else
+// may have open; errDbLocked while the server runs.
+func withLocalDB(fn func() error) error {
+	release, err := lockDB(dbLockFile())
 	if err != nil {
-		Log.Error("open db failed.")
+		return err
+	}
+	defer release()
+	if Db, err = openDB(dbDir); err != nil {
+		return err
 	}
-	return db
+	defer Db.Close()
+	return fn()
 }
 
-var Db = createDB()
+func dbView(fn func(tx *nutsdb.Tx) error) error {
+	defer observeDbTx("view", time.Now())
+	return Db.View(func(tx *nutsdb.Tx) error {
+		defer txLocals.forget(tx)
+		return fn(tx)
+	})
+}
 
-type AuthConfig struct {
-	Address  string `ini:"address"`
-	Port     string `ini:"port"`
-	Username string `ini:"username"`
-	Password string `ini:"password"`
-	Salt     string `ini:"salt"`
-	Static   string `ini:"static"`
+func dbUpdate(fn func(tx *nutsdb.Tx) error) error {
+	defer observeDbTx("update", time.Now())
+	return Db.Update(func(tx *nutsdb.Tx) error {
+		defer txLocals.forget(tx)
+		return fn(tx)
+	})
 }
 
-var Config AuthConfig = AuthConfig{
-	Address:  "127.0.0.1",
-	Port:     "4000",
-	Username: "admin",
-	Password: "admin",
-	Salt:     "admin",
-	Static:   "",
+// txLocals holds values written in a transaction that later reads in the same
+// transaction must see; nutsdb only reads committed data.
+var txLocals = &txLocalStore{m: make(map[*nutsdb.Tx]map[string]interface{})}
+
+type txLocalStore struct {
+	mu sync.Mutex
+	m  map[*nutsdb.Tx]map[string]interface{}
 }
 
-func init() {
-	iniFile, err := ini.Load("frps-auth.ini")
-	if err != nil {
-		Log.Error(err)
-		return
-	}
-	iniFile.BlockMode = false
-	err = iniFile.MapTo(&Config)
-	if err != nil {
-		Log.Error(err)
-		os.Exit(-1)
+func (s *txLocalStore) get(tx *nutsdb.Tx, key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.m[tx][key]
+	return v, ok
+}
+
+func (s *txLocalStore) set(tx *nutsdb.Tx, key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m[tx] == nil {
+		s.m[tx] = make(map[string]interface{})
 	}
+	s.m[tx][key] = v
+}
 
+func (s *txLocalStore) forget(tx *nutsdb.Tx) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, tx)
 }
 
 type applyPortRequest struct {
@@ -127,6 +160,7 @@ type applyPortContentUser struct {
 }
 
 func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Body == nil {
 		http.Error(w, "Please send a request body.", 400)
 		return
@@ -134,14 +168,24 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var apr applyPortRequest
 	err := json.NewDecoder(r.Body).Decode(&apr)
 	if err != nil {
+		pluginDecisions.WithLabelValues("", "error", "bad_request").Inc()
 		http.Error(w, "Please send a valid request body.", 500)
 		return
 	}
+	op := pluginOpLabel(apr.OpType)
+	defer observePluginRequest(op, start)
 
 	w.Header().Set("Content-Type", "application/json")
 	Log.Info(apr)
 	if apr.OpType != "NewProxy" &&
 		apr.OpType != "Heartbeat" {
+		switch apr.OpType {
+		case "CloseProxy":
+			Online.Remove(apr.Content.User.RunId, apr.Content.ProxyName)
+		case "Ping":
+			Online.Touch(apr.Content.User.RunId)
+		}
+		pluginDecisions.WithLabelValues(op, "pass", "unhandled_op").Inc()
 		fmt.Fprint(w, `{
 			"reject": false,
 			"unchange": true
@@ -162,10 +206,16 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			AuthKey:    apr.Content.Metas.SignKey,
 		}
 		sign := signBody.Sign()
-		err := Db.View(func(tx *nutsdb.Tx) error {
+		banKeys := pluginBanKeys(r, apr, key)
+		reason, signed := "error", false
+		err := dbView(func(tx *nutsdb.Tx) error {
 			var ae AuthDataEntity
 			e, err := tx.Get(bucket, []byte(key))
 			if nil != err {
+				reason = "not_found"
+				if _, err := getTrash(tx, key); err == nil {
+					reason = "trashed"
+				}
 				return err
 			}
 			err2 := json.Unmarshal(e.Value, &ae)
@@ -173,24 +223,47 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return err2
 			}
 			if ae.Sign != sign {
+				reason = "bad_sign"
 				return errors.New(sign)
 			}
+			signed = true
 			if ae.Disabled {
+				reason = "disabled"
 				return errors.New("disabled")
 			}
 			if (time.Now().UnixNano() / int64(1e6)) > ae.ValidTo {
+				reason = "expired"
 				return errors.New(time.Now().Format("yyyy-MM-dd"))
 			}
 			return nil
 		})
+		// a signature matching the stored entry is never banned, so bad
+		// signatures sent by others cannot lock out the holder of the key.
+		if d := PluginBans.Locked(banKeys...); d > 0 && !signed {
+			Log.Warning(fmt.Sprintf("%s %s banned for %s.", apr.Content.User.RunId, key, d))
+			pluginDecisions.WithLabelValues(op, "reject", "banned").Inc()
+			Online.Remove(apr.Content.User.RunId, apr.Content.ProxyName)
+			fmt.Fprint(w, `{
+			 "reject": true,
+			 "reject_reason": "banned"
+			}`)
+			return
+		}
 		if nil != err {
 			Log.Info(err)
+			if reason == "bad_sign" {
+				PluginBans.Fail(banKeys...)
+			}
+			pluginDecisions.WithLabelValues(op, "reject", reason).Inc()
+			Online.Remove(apr.Content.User.RunId, apr.Content.ProxyName)
 			fmt.Fprint(w, fmt.Sprintf(`{
 			 "reject": true,
 			 "reject_reason": "invalid[%s]"
 			}`, err.Error()))
 			return
 		}
+		pluginDecisions.WithLabelValues(op, "accept", "ok").Inc()
+		Online.Put(apr.Content.User.RunId, apr.Content.ProxyName, key)
 		fmt.Fprint(w, `{
 			"reject": false,
 			"unchange": true
@@ -199,38 +272,44 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-audit":
+			os.Exit(verifyAuditCommand(os.Args[2:]))
+		case "backup":
+			os.Exit(backupCommand(os.Args[2:]))
+		case "restore":
+			os.Exit(restoreCommand(os.Args[2:]))
+		}
+	}
 	Log.Info("start frps-auth.")
-	router := mux.NewRouter()
-	router.Use(NewHttpAuthMiddleware(Config.Username, Config.Password, "/auth").Middleware)
-	router.HandleFunc("/auth", ServeHTTP).Methods("POST")
-	router.HandleFunc("/add-auth", AddAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/update-auth", UpdateAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/delete-auth/{id}", DeleteAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/disable-auth/{id}", DisableAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/enable-auth/{id}", EnableAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/list-auth", ListAuthServeHTTP).Methods("POST")
-	router.HandleFunc("/get-auth/{id}", GetAuthServeHTTP).Methods("GET")
-	router.HandleFunc("/get-auth-config/{id}", GetAuthConfigServerHTTP).Methods("GET")
-	router.PathPrefix("/").Handler(MakeHttpGzipHandler(http.StripPrefix("/", http.FileServer(getStaticFS(Config.Static))))).Methods("GET")
-	addr := Config.Address
-	port := Config.Port
-
-	address := fmt.Sprintf("%s:%s", addr, port)
-	Log.Info(fmt.Sprintf("bind %s", address))
-	server := &http.Server{
-		Addr:         address,
-		Handler:      router,
-		ReadTimeout:  httpServerReadTimeout,
-		WriteTimeout: httpServerWriteTimeout,
+	release, err := lockDB(dbLockFile())
+	if err != nil {
+		Log.Critical(fmt.Sprintf("lock db failed: %s", err))
+		os.Exit(-1)
 	}
-	if address == "" {
-		address = ":http"
+	defer release()
+	if Db, err = openDB(dbDir); err != nil {
+		Log.Critical(fmt.Sprintf("open db failed: %s", err))
+		os.Exit(-1)
 	}
-	ln, err := net.Listen("tcp", address)
+	servers, err := createServers()
 	if err != nil {
+		Log.Critical(err)
 		os.Exit(-1)
 	}
+	go RunRemindScheduler()
+	go RunAuditCheckpoints()
+	go RunTrashPurge()
+	go RunBackupScheduler()
+	go RunSync()
 	defer Db.Close()
 	defer logFile.Close()
-	server.Serve(ln)
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *listenServer) {
+			errc <- s.Serve()
+		}(s)
+	}
+	Log.Error(<-errc)
 }
@@ -3,9 +3,14 @@ module github.com/dev-lluo/frps-auth
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/go-ldap/ldap/v3 v3.4.4
 	github.com/gorilla/mux v1.8.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/prometheus/client_golang v1.12.2
 	github.com/satori/go.uuid v1.2.0
 	github.com/xujiajun/nutsdb v0.9.0
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
 	gopkg.in/ini.v1 v1.66.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// readyCacheTTL is how long a readiness result is reused, so probes every
+// second do not each open a transaction and parse the config file.
+var readyCacheTTL = 5 * time.Second
+
+var readyCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	checks  map[string]error
+}
+
+type healthResp struct {
+	Status string `json:"status"`
+
+	Checks map[string]string `json:"checks"`
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	resp := healthResp{Status: "ok", Checks: make(map[string]string)}
+	code := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			Log.Warning(name, err)
+			resp.Checks[name] = err.Error()
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+		} else {
+			resp.Checks[name] = "ok"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HealthzServeHTTP is the liveness probe: the process serves and the DB is open.
+func HealthzServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]error{
+		"db": checkDbOpen(),
+	})
+}
+
+// ReadyzServeHTTP is the readiness probe: the DB accepts writes and the config
+// file on disk still loads, so a broken edit shows up before the next restart.
+func ReadyzServeHTTP(w http.ResponseWriter, r *http.Request) {
+	readyCache.mu.Lock()
+	if time.Since(readyCache.checked) > readyCacheTTL {
+		_, configErr := loadConfig(configFile)
+		readyCache.checks = map[string]error{
+			"db":     checkDbWritable(),
+			"config": configErr,
+		}
+		readyCache.checked = time.Now()
+	}
+	checks := readyCache.checks
+	readyCache.mu.Unlock()
+	writeHealth(w, checks)
+}
+
+func checkDbOpen() error {
+	return dbView(func(tx *nutsdb.Tx) error {
+		return nil
+	})
+}
+
+// checkDbWritable takes the write transaction without writing, as nutsdb
+// appends every put to its log for good, and checks that the data directory
+// takes files.
+func checkDbWritable() error {
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		return nil
+	}); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dbDir, ".probe")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, h http.HandlerFunc) (int, healthResp) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+	var resp healthResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%d %q", rec.Code, rec.Body)
+	}
+	return rec.Code, resp
+}
+
+// useConfigFile points configFile at a file with content for the test.
+func useConfigFile(t *testing.T, content string) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "frps-auth.ini")
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := configFile
+	configFile = name
+	t.Cleanup(func() { configFile = saved })
+}
+
+func TestHealthz(t *testing.T) {
+	if code, resp := probe(t, HealthzServeHTTP); code != 200 || resp.Status != "ok" || resp.Checks["db"] != "ok" {
+		t.Errorf("got %d %+v", code, resp)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	cases := []struct {
+		ini    string
+		code   int
+		config string
+	}{
+		{"port = 4000\nsalt = s\n", 200, "ok"},
+		{"port = 99999\n", 503, `invalid port "99999"`},
+		{"smtp_host = mail.example.com\nsmtp_from = a@example.com\nsmtp_port = x\n", 503, `invalid smtp_port "x"`},
+		{"smtp_host = mail.example.com\n", 503, "smtp_from is required when smtp_host is set"},
+	}
+	for _, c := range cases {
+		useConfigFile(t, c.ini)
+		readyCache.checked = time.Time{}
+		code, resp := probe(t, ReadyzServeHTTP)
+		if code != c.code || resp.Checks["config"] != c.config || resp.Checks["db"] != "ok" {
+			t.Errorf("%q: got %d %+v", c.ini, code, resp)
+		}
+	}
+}
+
+func TestReadyzCache(t *testing.T) {
+	useConfigFile(t, "port = 4000\n")
+	readyCache.checked = time.Time{}
+	if code, _ := probe(t, ReadyzServeHTTP); code != 200 {
+		t.Fatalf("got %d", code)
+	}
+	// a broken config shows once the cached result is stale.
+	ioutil.WriteFile(configFile, []byte("port = 99999\n"), 0600)
+	if code, _ := probe(t, ReadyzServeHTTP); code != 200 {
+		t.Errorf("cached: got %d", code)
+	}
+	readyCache.checked = time.Now().Add(-readyCacheTTL - time.Second)
+	if code, _ := probe(t, ReadyzServeHTTP); code != 503 {
+		t.Errorf("stale: got %d", code)
+	}
+	readyCache.checked = time.Time{}
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := loadConfig(filepath.Join(t.TempDir(), "missing.ini"))
+	if err != nil || c.Port != Config.Port {
+		t.Errorf("missing file: %v %+v", err, c)
+	}
+	useConfigFile(t, "address = 0.0.0.0\nport = 4100\n")
+	c, err = loadConfig(configFile)
+	if err != nil || c.Address != "0.0.0.0" || c.Port != "4100" || c.Salt != Config.Salt {
+		t.Errorf("got %v %+v", err, c)
+	}
+	if err := os.Chmod(configFile, 0); err == nil && os.Geteuid() != 0 {
+		if _, err := loadConfig(configFile); err == nil {
+			t.Error("unreadable file accepted")
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	historyBucket    = "history"
+	historyRevBucket = "history-rev"
+)
+
+// AuthRevision is an entry as it was after an action. Entity is nil for the
+// revision that deleted it.
+type AuthRevision struct {
+	Id string `json:"id"`
+
+	Rev int `json:"rev"`
+
+	Author string `json:"author"`
+
+	// unix millis
+	Time int64 `json:"time"`
+
+	Action string `json:"action"`
+
+	Entity *AuthDataEntity `json:"entity"`
+}
+
+func historyKey(id string, rev int) []byte {
+	return []byte(fmt.Sprintf("%s\x00%010d", id, rev))
+}
+
+func lastRevision(tx *nutsdb.Tx, id string) (int, error) {
+	if v, ok := txLocals.get(tx, "history-rev/"+id); ok {
+		return v.(int), nil
+	}
+	e, err := tx.Get(historyRevBucket, []byte(id))
+	if err != nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(e.Value))
+}
+
+func putRevision(tx *nutsdb.Tx, rv AuthRevision) error {
+	val, err := json.Marshal(rv)
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(historyBucket, historyKey(rv.Id, rv.Rev), val, 0); err != nil {
+		return err
+	}
+	txLocals.set(tx, "history-rev/"+rv.Id, rv.Rev)
+	return tx.Put(historyRevBucket, []byte(rv.Id), []byte(strconv.Itoa(rv.Rev)), 0)
+}
+
+// recordRevision adds the entry as it is after action. Entries older than the
+// history get the state before their first recorded change as revision 1.
+func recordRevision(tx *nutsdb.Tx, r *http.Request, action, id string, before, after *AuthDataEntity) error {
+	rev, err := lastRevision(tx, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if rev == 0 && before != nil {
+		rev++
+		if err := putRevision(tx, AuthRevision{Id: id, Rev: rev, Time: now, Action: "initial", Entity: before}); err != nil {
+			return err
+		}
+	}
+	rev++
+	author, _ := auditActor(r)
+	return putRevision(tx, AuthRevision{
+		Id:     id,
+		Rev:    rev,
+		Author: author,
+		Time:   now,
+		Action: action,
+		Entity: after,
+	})
+}
+
+// recordChange keeps the audit log and the revision history of an entry
+// change, in the transaction that makes it.
+func recordChange(tx *nutsdb.Tx, r *http.Request, action, id string, before, after *AuthDataEntity) error {
+	if err := audit(tx, r, action, id, before, after); err != nil {
+		return err
+	}
+	return recordRevision(tx, r, action, id, before, after)
+}
+
+func loadRevisions(tx *nutsdb.Tx, id string) ([]AuthRevision, error) {
+	entries, _, err := tx.PrefixScan(historyBucket, []byte(id+"\x00"), 0, 1<<30)
+	if err == nutsdb.ErrPrefixScan {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revs []AuthRevision
+	for _, e := range entries {
+		var rv AuthRevision
+		if err := json.Unmarshal(e.Value, &rv); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rv)
+	}
+	return revs, nil
+}
+
+func getRevision(tx *nutsdb.Tx, id string, rev int) (AuthRevision, error) {
+	var rv AuthRevision
+	e, err := tx.Get(historyBucket, historyKey(id, rev))
+	if err != nil {
+		return rv, err
+	}
+	err = json.Unmarshal(e.Value, &rv)
+	return rv, err
+}
+
+// redacted hides the key of old revisions; a rotated out key stays secret.
+func (rv AuthRevision) redacted() AuthRevision {
+	if rv.Entity != nil {
+		ae := *rv.Entity
+		ae.AuthKey = redactSecret(ae.AuthKey).(string)
+		ae.Sign = ""
+		rv.Entity = &ae
+	}
+	return rv
+}
+
+// checkHistoryTenant hides the history of an entry from users of a tenant
+// unless every revision of it is of their tenant.
+func checkHistoryTenant(tx *nutsdb.Tx, r *http.Request, id string) error {
+	if RequestPrincipal(r).Tenant == "" {
+		return nil
+	}
+	revs, err := loadRevisions(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, rv := range revs {
+		if rv.Entity != nil {
+			if err := checkTenant(r, rv.Entity); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func AuthHistoryServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	var revs []AuthRevision
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		var err error
+		if err = checkHistoryTenant(tx, r, params["id"]); err != nil {
+			return err
+		}
+		revs, err = loadRevisions(tx, params["id"])
+		return err
+	}); err != nil {
+		writeChangeError(w, err, "server error[AuthHistory-1].")
+		return
+	}
+	sort.Slice(revs, func(i, j int) bool {
+		return revs[i].Rev > revs[j].Rev
+	})
+	out := make([]AuthRevision, 0, len(revs))
+	for _, rv := range revs {
+		out = append(out, rv.redacted())
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AuthHistory-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(out), data))
+}
+
+// AuthDiffServeHTTP compares revisions from and to; to defaults to the latest
+// and from to the one before to.
+func AuthDiffServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	q := r.URL.Query()
+	var from, to AuthRevision
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		if err := checkHistoryTenant(tx, r, params["id"]); err != nil {
+			return err
+		}
+		toRev, err := strconv.Atoi(q.Get("to"))
+		if err != nil {
+			if toRev, err = lastRevision(tx, params["id"]); err != nil {
+				return err
+			}
+		}
+		fromRev, err := strconv.Atoi(q.Get("from"))
+		if err != nil {
+			fromRev = toRev - 1
+		}
+		if to, err = getRevision(tx, params["id"], toRev); err != nil {
+			return err
+		}
+		if fromRev > 0 {
+			from, err = getRevision(tx, params["id"], fromRev)
+		}
+		return err
+	}); err != nil {
+		http.Error(w, "no such revision", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":    0,
+		"from":    from.Rev,
+		"to":      to.Rev,
+		"changes": auditChanges(from.Entity, to.Entity),
+	})
+}
+
+// RestoreAuthServeHTTP puts back an earlier revision and signs it again. An
+// existing entry keeps its current key, so a restore never brings back a
+// rotated out one; a deleted entry comes back with the key frpc still has,
+// which takes an admin.
+func RestoreAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	rev, err := strconv.Atoi(params["rev"])
+	if err != nil {
+		http.Error(w, "invalid revision", 400)
+		return
+	}
+	Log.Info("restore", params["id"], rev, "by", RequestUser(r))
+	status := 0
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		if err := checkHistoryTenant(tx, r, params["id"]); err != nil {
+			status = 404
+			return err
+		}
+		rv, err := getRevision(tx, params["id"], rev)
+		if err != nil {
+			status = 404
+			return err
+		}
+		if rv.Entity == nil {
+			status = 400
+			return errors.New("revision deleted the entry")
+		}
+		restored := *rv.Entity
+		restored.Managed = ""
+		var before *AuthDataEntity
+		if e, err := tx.Get(bucket, []byte(params["id"])); err == nil {
+			before = &AuthDataEntity{}
+			if err := json.Unmarshal(e.Value, before); err != nil {
+				return err
+			}
+			if err := checkManaged(r, before); err != nil {
+				status = 409
+				return err
+			}
+			restored.AuthKey = before.AuthKey
+		} else if !RequestPrincipal(r).HasRole(RoleAdmin) {
+			status = 403
+			return errors.New("restoring a deleted entry needs the admin role")
+		}
+		if err := checkQuota(tx, &restored, before); err != nil {
+			status = 403
+			return err
+		}
+		if err := checkPortChange(tx, &restored, before); err != nil {
+			status = 409
+			return err
+		}
+		signBody := &SignBody{
+			ProxyType:  restored.ProxyType,
+			RemotePort: restored.RemotePort,
+			Subdomain:  restored.ProxyName,
+			AuthKey:    restored.AuthKey,
+			ValidTo:    strconv.FormatInt(restored.ValidTo, 10),
+		}
+		restored.Sign = signBody.Sign()
+		val, err := json.Marshal(restored)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(bucket, []byte(params["id"]), val, 0); err != nil {
+			return err
+		}
+		if before == nil {
+			if _, err := getTrash(tx, params["id"]); err == nil {
+				if err := tx.Delete(trashBucket, []byte(params["id"])); err != nil {
+					return err
+				}
+			}
+		}
+		return recordChange(tx, r, "restore", params["id"], before, &restored)
+	}); err != nil {
+		switch status {
+		case 400, 403, 404, 409:
+			http.Error(w, err.Error(), status)
+		default:
+			Log.Error(err)
+			http.Error(w, "server error[RestoreAuth-1].", 500)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
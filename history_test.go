@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func history(t *testing.T, id string) []AuthRevision {
+	t.Helper()
+	rec := serve(AuthHistoryServeHTTP, "GET", "/auth-history/"+id, map[string]string{"id": id}, "", RoleViewer)
+	var res struct {
+		Data []AuthRevision `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %q", rec.Code, rec.Body)
+	}
+	return res.Data
+}
+
+func TestAuthHistory(t *testing.T) {
+	resetBuckets(t, bucket, historyBucket, historyRevBucket)
+	ae := signedEntry("hist", "tcp", 6200, "k1", time.Hour)
+	putEntries(t, ae)
+	vars := map[string]string{"id": ae.Id}
+	serve(DisableAuthServeHTTP, "POST", "/disable-auth/"+ae.Id, vars, "", RoleOperator)
+	serve(RotateAuthKeyServeHTTP, "POST", "/rotate-auth-key/"+ae.Id, vars, "", RoleAdmin)
+	var actions []string
+	for _, rv := range history(t, ae.Id) {
+		actions = append(actions, rv.Action)
+		if rv.Entity.AuthKey != "***" || rv.Entity.Sign != "" {
+			t.Errorf("rev %d not redacted: %+v", rv.Rev, rv.Entity)
+		}
+	}
+	if want := []string{"rotate", "disable", "initial"}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("got %v, want %v", actions, want)
+	}
+	rec := serve(AuthDiffServeHTTP, "GET", "/auth-diff/"+ae.Id, vars, "", RoleViewer)
+	var diff struct {
+		From    int                    `json:"from"`
+		To      int                    `json:"to"`
+		Changes map[string]AuditChange `json:"changes"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &diff)
+	if diff.From != 2 || diff.To != 3 || diff.Changes["auth_key"].To != "***" || len(diff.Changes) != 2 {
+		t.Errorf("diff %+v", diff)
+	}
+}
+
+func TestRestoreAuth(t *testing.T) {
+	resetBuckets(t, bucket, historyBucket, historyRevBucket)
+	ae := signedEntry("rest", "tcp", 6201, "k1", time.Hour)
+	putEntries(t, ae)
+	vars := map[string]string{"id": ae.Id}
+	serve(RotateAuthKeyServeHTTP, "POST", "/rotate-auth-key/"+ae.Id, vars, "", RoleAdmin)
+	rotated, _ := getEntry(t, ae.Id)
+	serve(DisableAuthServeHTTP, "POST", "/disable-auth/"+ae.Id, vars, "", RoleOperator)
+	serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin)
+	restore := func(rev, role string) int {
+		return serve(RestoreAuthServeHTTP, "POST", "/restore-auth/"+ae.Id+"/"+rev, map[string]string{"id": ae.Id, "rev": rev}, "", role).Code
+	}
+	cases := []struct {
+		name string
+		rev  string
+		role string
+		code int
+		key  string
+	}{
+		{"deleting revision", "4", RoleAdmin, 400, ""},
+		{"no such revision", "9", RoleAdmin, 404, ""},
+		{"bad revision", "x", RoleAdmin, 400, ""},
+		{"deleted entry as operator", "2", RoleOperator, 403, ""},
+		// a deleted entry comes back with the key of the revision.
+		{"deleted entry as admin", "2", RoleAdmin, 200, rotated.AuthKey},
+		// an existing entry keeps its key, the first one was rotated out.
+		{"existing entry", "1", RoleOperator, 200, rotated.AuthKey},
+	}
+	for _, c := range cases {
+		if code := restore(c.rev, c.role); code != c.code {
+			t.Errorf("%s: got %d, want %d", c.name, code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		got, ok := getEntry(t, ae.Id)
+		if !ok || got.AuthKey != c.key || got.Disabled {
+			t.Errorf("%s: got %v %+v", c.name, ok, got)
+		}
+		if reject, reason := callPlugin(t, "NewProxy", pluginContent(got, got.AuthKey, "r1")); reject {
+			t.Errorf("%s: restored entry rejected: %s", c.name, reason)
+		}
+	}
+	if n := len(history(t, ae.Id)); n != 6 {
+		t.Errorf("%d revisions, want 6", n)
+	}
+}
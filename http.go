@@ -18,6 +18,7 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -39,7 +40,7 @@ func NewHttpBasicAuthWrapper(h http.Handler, user, passwd string) http.Handler {
 
 func (aw *HttpAuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	user, passwd, hasAuth := r.BasicAuth()
-	if (aw.user == "" && aw.passwd == "") || (hasAuth && user == aw.user && passwd == aw.passwd) {
+	if (aw.user == "" && aw.passwd == "") || (hasAuth && constantTimeEqual(user, aw.user) && constantTimeEqual(passwd, aw.passwd)) {
 		aw.h.ServeHTTP(w, r)
 	} else {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -50,10 +51,10 @@ func (aw *HttpAuthWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 type HttpAuthMiddleware struct {
 	user   string
 	passwd string
-	skip   string
+	skip   []string
 }
 
-func NewHttpAuthMiddleware(user, passwd, skip string) *HttpAuthMiddleware {
+func NewHttpAuthMiddleware(user, passwd string, skip ...string) *HttpAuthMiddleware {
 	return &HttpAuthMiddleware{
 		user:   user,
 		passwd: passwd,
@@ -61,27 +62,90 @@ func NewHttpAuthMiddleware(user, passwd, skip string) *HttpAuthMiddleware {
 	}
 }
 
+// Middleware accepts a session cookie (with a CSRF token on unsafe methods), or
+// a bearer API token or basic auth for scripted use. Browsers navigating to a page are sent to the
+// login page, UI scripts (X-Requested-With) get a bare 401 so that they do not
+// trigger the basic auth prompt.
 func (authMid *HttpAuthMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		//Log.Info(r.RequestURI)
-		reqUser, reqPasswd, hasAuth := r.BasicAuth()
-		if (authMid.user == "" && authMid.passwd == "") ||
-			(hasAuth && reqUser == authMid.user && reqPasswd == authMid.passwd) ||
-			r.URL.Path == authMid.skip {
+		if authMid.isSkipped(r.URL.Path) {
 			next.ServeHTTP(w, r)
-		} else {
-			Log.Warning(fmt.Sprintf("%s %s At %s failed.", reqUser, r.RequestURI, time.Now()))
+			return
+		}
+		if authMid.user == "" && authMid.passwd == "" {
+			next.ServeHTTP(w, withPrincipal(r, Principal{Role: RoleAdmin}))
+			return
+		}
+		if ss, csrfOk := sessionFromRequest(r); ss != nil {
+			if !csrfOk {
+				Log.Warning(fmt.Sprintf("%s %s bad csrf token.", ss.User, r.RequestURI))
+				http.Error(w, "bad csrf token", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, Principal{User: ss.User, Role: ss.Role, Provider: ss.Provider, Tenant: ss.Tenant}))
+			return
+		}
+		if raw := bearerToken(r); raw != "" {
+			if lockedOut(w, r, ipLockoutKey(r)) {
+				return
+			}
+			t, err := authenticateToken(raw, r)
+			if err != nil {
+				Lockouts.Fail(ipLockoutKey(r))
+				Log.Warning(fmt.Sprintf("%s %s: %s.", r.RemoteAddr, r.RequestURI, err))
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, withPrincipal(r, tokenPrincipal(t)))
+			return
+		}
+		reqUser, reqPasswd, hasAuth := r.BasicAuth()
+		if hasAuth {
+			keys := loginLockoutKeys(r, reqUser)
+			if lockedOut(w, r, keys...) {
+				return
+			}
+			p, err := authenticateBasic(reqUser, reqPasswd)
+			if err == nil {
+				// only the username; one good account must not reset a guessing IP.
+				Lockouts.Clear("user:" + reqUser)
+				next.ServeHTTP(w, withPrincipal(r, p))
+				return
+			}
+			if err == errTotpBasic {
+				Log.Warning(fmt.Sprintf("%s %s: %s.", reqUser, r.RequestURI, err))
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			Lockouts.Fail(keys...)
+		}
+		Log.Warning(fmt.Sprintf("%s %s At %s failed.", reqUser, r.RequestURI, time.Now()))
+		if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login.html", http.StatusFound)
+			return
+		}
+		if r.Header.Get("X-Requested-With") == "" {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 	})
 }
 
+func (authMid *HttpAuthMiddleware) isSkipped(path string) bool {
+	for _, p := range authMid.skip {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
 func HttpBasicAuth(h http.HandlerFunc, user, passwd string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		reqUser, reqPasswd, hasAuth := r.BasicAuth()
 		if (user == "" && passwd == "") ||
-			(hasAuth && reqUser == user && reqPasswd == passwd) {
+			(hasAuth && constantTimeEqual(reqUser, user) && constantTimeEqual(reqPasswd, passwd)) {
 			h.ServeHTTP(w, r)
 		} else {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
@@ -90,6 +154,67 @@ func HttpBasicAuth(h http.HandlerFunc, user, passwd string) http.HandlerFunc {
 	}
 }
 
+type IPAllowMiddleware struct {
+	nets []*net.IPNet
+}
+
+// NewIPAllowMiddleware only lets through clients whose address is in one of the
+// comma separated IPs/CIDRs. An empty list allows everyone, and so do unix
+// socket peers, which have no IP. The list is checked by AuthConfig.Validate.
+func NewIPAllowMiddleware(allow string) *IPAllowMiddleware {
+	nets, _ := parseIPNets(allow)
+	return &IPAllowMiddleware{
+		nets: nets,
+	}
+}
+
+func (ipMid *IPAllowMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(ipMid.nets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			// unix socket
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := net.ParseIP(host)
+		for _, n := range ipMid.nets {
+			if ip != nil && n.Contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		Log.Warning(fmt.Sprintf("%s %s denied by allow list.", r.RemoteAddr, r.RequestURI))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	})
+}
+
+func parseIPNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 type HttpGzipWrapper struct {
 	h http.Handler
 }
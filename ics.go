@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const icsDateFormat = "20060102"
+
+// AuthCalendarServeHTTP publishes one all-day event per auth entry on the day it
+// expires. Query parameters:
+//
+//	type   only entries of these proxy types (comma separated)
+//	tag    only entries with these tags, key=value or key (comma separated)
+//	alarm  days before expiry to raise an alarm (comma separated, e.g. 7,1)
+func AuthCalendarServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entries, err := loadAllAuth()
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AuthCalendar-1].", 500)
+		return
+	}
+	types := splitQuery(r.URL.Query().Get("type"))
+	tags := splitQuery(r.URL.Query().Get("tag"))
+	var alarms []int
+	for _, s := range splitQuery(r.URL.Query().Get("alarm")) {
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 0 {
+			http.Error(w, "invalid alarm.", 400)
+			return
+		}
+		alarms = append(alarms, d)
+	}
+
+	now := time.Now().UTC().Format("20060102T150405Z")
+	var buf bytes.Buffer
+	writeIcsLine(&buf, "BEGIN:VCALENDAR")
+	writeIcsLine(&buf, "VERSION:2.0")
+	writeIcsLine(&buf, "PRODID:-//frps-auth//auth expirations//EN")
+	writeIcsLine(&buf, "CALSCALE:GREGORIAN")
+	writeIcsLine(&buf, "X-WR-CALNAME:frps-auth")
+	for _, ae := range entries {
+		if len(types) > 0 && !containsString(types, ae.ProxyType) {
+			continue
+		}
+		if !matchTags(ae.Tags, tags) || checkTenant(r, &ae) != nil {
+			continue
+		}
+		day := time.Unix(0, ae.ValidTo*int64(time.Millisecond))
+		writeIcsLine(&buf, "BEGIN:VEVENT")
+		writeIcsLine(&buf, "UID:"+icsEscape(ae.Id)+"@frps-auth")
+		writeIcsLine(&buf, "DTSTAMP:"+now)
+		writeIcsLine(&buf, "DTSTART;VALUE=DATE:"+day.Format(icsDateFormat))
+		writeIcsLine(&buf, "DTEND;VALUE=DATE:"+day.AddDate(0, 0, 1).Format(icsDateFormat))
+		writeIcsLine(&buf, "SUMMARY:"+icsEscape(fmt.Sprintf("%s expires", ae.ProxyName)))
+		writeIcsLine(&buf, "DESCRIPTION:"+icsEscape(icsDescription(ae)))
+		if ae.Disabled {
+			writeIcsLine(&buf, "STATUS:CANCELLED")
+		}
+		for _, d := range alarms {
+			writeIcsLine(&buf, "BEGIN:VALARM")
+			writeIcsLine(&buf, "ACTION:DISPLAY")
+			writeIcsLine(&buf, "DESCRIPTION:"+icsEscape(fmt.Sprintf("%s expires in %d day(s)", ae.ProxyName, d)))
+			writeIcsLine(&buf, fmt.Sprintf("TRIGGER:-P%dD", d))
+			writeIcsLine(&buf, "END:VALARM")
+		}
+		writeIcsLine(&buf, "END:VEVENT")
+	}
+	writeIcsLine(&buf, "END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=UTF-8")
+	w.Write(buf.Bytes())
+}
+
+func icsDescription(ae AuthDataEntity) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id: %s\n", ae.Id)
+	fmt.Fprintf(&sb, "type: %s\n", ae.ProxyType)
+	if ae.ProxyType == "http" ||
+		ae.ProxyType == "https" {
+		fmt.Fprintf(&sb, "subdomain: %s\n", ae.ProxyName)
+	} else {
+		fmt.Fprintf(&sb, "remote port: %d\n", ae.RemotePort)
+	}
+	if ae.Disabled {
+		sb.WriteString("disabled\n")
+	}
+	if ae.Owner != "" {
+		fmt.Fprintf(&sb, "owner: %s\n", ae.Owner)
+	}
+	if len(ae.Tags) > 0 {
+		fmt.Fprintf(&sb, "tags: %s\n", formatTags(ae.Tags))
+	}
+	fmt.Fprintf(&sb, "memo: %s", ae.Memo)
+	return sb.String()
+}
+
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// writeIcsLine folds content lines longer than 75 octets (RFC 5545 3.1)
+// without splitting a UTF-8 sequence.
+func writeIcsLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		i := limit
+		for i > 0 && line[i]&0xC0 == 0x80 {
+			i--
+		}
+		buf.WriteString(line[:i])
+		buf.WriteString("\r\n ")
+		line = line[i:]
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+func splitQuery(v string) []string {
+	var items []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			items = append(items, s)
+		}
+	}
+	return items
+}
+
+func containsString(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestWriteIcsLineFolds(t *testing.T) {
+	cases := []string{
+		"SUMMARY:short",
+		"DESCRIPTION:" + strings.Repeat("a", 63),
+		"DESCRIPTION:" + strings.Repeat("a", 64),
+		"DESCRIPTION:" + strings.Repeat("abcdefghij", 30),
+		"DESCRIPTION:" + strings.Repeat("代理", 60),
+	}
+	for _, line := range cases {
+		var buf bytes.Buffer
+		writeIcsLine(&buf, line)
+		out := buf.String()
+		if !strings.HasSuffix(out, "\r\n") {
+			t.Fatalf("%q: no CRLF", out)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+			if len(l) > 75 {
+				t.Errorf("line of %d octets", len(l))
+			}
+			if !utf8.ValidString(l) {
+				t.Errorf("UTF-8 sequence split: %q", l)
+			}
+		}
+		if unfolded := strings.Replace(strings.TrimSuffix(out, "\r\n"), "\r\n ", "", -1); unfolded != line {
+			t.Errorf("unfolds to %q, want %q", unfolded, line)
+		}
+	}
+}
+
+func TestIcsEscape(t *testing.T) {
+	if got := icsEscape("a,b;c\\d\ne\r\nf"); got != `a\,b\;c\\d\ne\nf` {
+		t.Errorf("got %q", got)
+	}
+}
+
+func calendar(t *testing.T, query string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	AuthCalendarServeHTTP(rec, httptest.NewRequest("GET", "/auth/calendar.ics?"+query, nil))
+	return rec.Code, strings.Replace(rec.Body.String(), "\r\n ", "", -1)
+}
+
+func TestAuthCalendar(t *testing.T) {
+	resetBuckets(t, bucket)
+	// 2030-01-02 12:00 UTC
+	putEntries(t,
+		AuthDataEntity{Id: "tcp-ssh-6000", ProxyName: "ssh", ProxyType: "tcp", RemotePort: 6000, ValidTo: 1893585600000, Memo: "office, 2nd floor"},
+		AuthDataEntity{Id: "http-www", ProxyName: "www", ProxyType: "http", ValidTo: 1893585600000, Disabled: true},
+	)
+	cases := []struct {
+		query   string
+		want    []string
+		notWant []string
+	}{
+		{"", []string{"UID:tcp-ssh-6000@frps-auth", "UID:http-www@frps-auth", "DTSTART;VALUE=DATE:2030010", `memo: office\, 2nd floor`, "subdomain: www", "STATUS:CANCELLED"}, []string{"VALARM"}},
+		{"type=http,https", []string{"UID:http-www@frps-auth"}, []string{"tcp-ssh-6000"}},
+		{"type=tcp&alarm=7,1", []string{"TRIGGER:-P7D", "TRIGGER:-P1D", "ssh expires in 7 day(s)"}, []string{"http-www"}},
+	}
+	for _, c := range cases {
+		code, body := calendar(t, c.query)
+		if code != 200 || !strings.HasPrefix(body, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(body, "END:VCALENDAR\r\n") {
+			t.Errorf("%q: %d %q", c.query, code, body)
+			continue
+		}
+		for _, s := range c.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("%q: no %q in %q", c.query, s, body)
+			}
+		}
+		for _, s := range c.notWant {
+			if strings.Contains(body, s) {
+				t.Errorf("%q: %q in %q", c.query, s, body)
+			}
+		}
+	}
+	for _, bad := range []string{"alarm=x", "alarm=-1"} {
+		if code, _ := calendar(t, bad); code != 400 {
+			t.Errorf("%s: got %d", bad, code)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const ProviderLdap = "ldap"
+
+var ldapTimeout = 10 * time.Second
+
+var errLdapNoUser = errors.New("no such ldap user")
+
+func ldapTLSConfig() (*tls.Config, error) {
+	u, err := url.Parse(Config.LdapURL)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		ServerName: u.Hostname(),
+		MinVersion: tls.VersionTLS12,
+	}
+	if Config.LdapCAFile != "" {
+		caPem, err := ioutil.ReadFile(Config.LdapCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate in %s", Config.LdapCAFile)
+		}
+	}
+	return cfg, nil
+}
+
+func ldapDial() (*ldap.Conn, error) {
+	tlsConfig, err := ldapTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ldap.DialURL(Config.LdapURL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if Config.LdapStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapAuthenticate finds the user with the service account, binds as the user
+// to check the password and maps its groups to a role.
+func ldapAuthenticate(user, passwd string) (Principal, error) {
+	// an empty password would be an unauthenticated bind, which succeeds.
+	if user == "" || passwd == "" {
+		return Principal{}, errors.New("empty ldap credentials")
+	}
+	conn, err := ldapDial()
+	if err != nil {
+		return Principal{}, err
+	}
+	defer conn.Close()
+	if Config.LdapBindDN != "" {
+		if err := conn.Bind(Config.LdapBindDN, Config.LdapBindPassword); err != nil {
+			return Principal{}, fmt.Errorf("ldap service bind: %s", err)
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		Config.LdapBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		fmt.Sprintf(Config.LdapUserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", Config.LdapGroupAttr}, nil,
+	))
+	if err != nil {
+		return Principal{}, err
+	}
+	if len(res.Entries) != 1 {
+		return Principal{}, errLdapNoUser
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, passwd); err != nil {
+		return Principal{}, err
+	}
+	groups := entry.GetAttributeValues(Config.LdapGroupAttr)
+	if Config.LdapGroupBaseDN != "" {
+		// the user may not read the groups; search them as the service account.
+		if Config.LdapBindDN != "" {
+			if err := conn.Bind(Config.LdapBindDN, Config.LdapBindPassword); err != nil {
+				return Principal{}, fmt.Errorf("ldap service bind: %s", err)
+			}
+		}
+		gres, err := conn.Search(ldap.NewSearchRequest(
+			Config.LdapGroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second), false,
+			fmt.Sprintf(Config.LdapGroupFilter, ldap.EscapeFilter(entry.DN)),
+			[]string{"dn"}, nil,
+		))
+		if err != nil {
+			return Principal{}, err
+		}
+		for _, g := range gres.Entries {
+			groups = append(groups, g.DN)
+		}
+	}
+	role := groupsRole(ldapGroupNames(groups), Config.LdapRoleMap, Config.LdapDefaultRole)
+	if role == "" {
+		return Principal{}, fmt.Errorf("ldap user %s has no role", user)
+	}
+	return Principal{User: user, Role: role, Provider: ProviderLdap}, nil
+}
+
+// ldapGroupNames reduces group DNs to their first RDN value, so that
+// cn=frps-admins,ou=groups,dc=example,dc=com maps as frps-admins.
+func ldapGroupNames(dns []string) []string {
+	var names []string
+	for _, dn := range dns {
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+			names = append(names, dn)
+			continue
+		}
+		names = append(names, parsed.RDNs[0].Attributes[0].Value)
+	}
+	return names
+}
+
+func validateLdapConfig(c AuthConfig) error {
+	u, err := url.Parse(c.LdapURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		return fmt.Errorf("invalid ldap_url %q", c.LdapURL)
+	}
+	if c.LdapStartTLS && u.Scheme == "ldaps" {
+		return errors.New("ldap_start_tls needs an ldap:// url")
+	}
+	if c.LdapBaseDN == "" {
+		return errors.New("ldap_base_dn is required when ldap_url is set")
+	}
+	if strings.Count(c.LdapUserFilter, "%s") != 1 {
+		return errors.New("ldap_user_filter needs exactly one %s")
+	}
+	if c.LdapGroupBaseDN != "" && strings.Count(c.LdapGroupFilter, "%s") != 1 {
+		return errors.New("ldap_group_filter needs exactly one %s")
+	}
+	if _, err := parseRoleMap(c.LdapRoleMap); err != nil {
+		return fmt.Errorf("invalid ldap_role_map: %s", err)
+	}
+	if _, ok := roleLevels[c.LdapDefaultRole]; c.LdapDefaultRole != "" && !ok {
+		return fmt.Errorf("invalid ldap_default_role %q", c.LdapDefaultRole)
+	}
+	if c.LdapCAFile != "" {
+		if _, err := ioutil.ReadFile(c.LdapCAFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lockout is the failure record of a key, e.g. a client IP ("ip:<addr>") or a
+// username ("user:<name>").
+type Lockout struct {
+	Key string `json:"key"`
+
+	Failures int `json:"failures"`
+
+	LastFailure time.Time `json:"last_failure"`
+
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// LockoutPolicy locks a key out for Duration from Threshold failures on,
+// doubling with every further failure up to MaxDuration. Keys are forgotten
+// Reset after their last failure or lock. A Threshold of 0 locks nothing.
+type LockoutPolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+	Reset       time.Duration
+}
+
+// LockoutTracker counts failures by key. The policy is read on use, the
+// configuration is loaded after the trackers are created.
+type LockoutTracker struct {
+	mu       sync.Mutex
+	policy   func() LockoutPolicy
+	lockouts map[string]*Lockout
+}
+
+func NewLockoutTracker(policy func() LockoutPolicy) *LockoutTracker {
+	return &LockoutTracker{policy: policy, lockouts: make(map[string]*Lockout)}
+}
+
+// Lockouts counts failed admin logins.
+var Lockouts = NewLockoutTracker(func() LockoutPolicy {
+	return Config.LoginLockout()
+})
+
+func (l *LockoutTracker) stale(lo *Lockout, now time.Time) bool {
+	last := lo.LastFailure
+	if lo.LockedUntil.After(last) {
+		last = lo.LockedUntil
+	}
+	return now.Sub(last) > l.policy().Reset
+}
+
+func (p LockoutPolicy) Validate() error {
+	if p.Threshold > 0 && (p.Duration <= 0 || p.MaxDuration < p.Duration || p.Reset <= 0) {
+		return errors.New("durations must be positive and the max duration at least the duration")
+	}
+	return nil
+}
+
+// Locked returns how long the longest lock of keys still lasts.
+func (l *LockoutTracker) Locked(keys ...string) time.Duration {
+	if l.policy().Threshold <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var d time.Duration
+	for _, k := range keys {
+		if lo, ok := l.lockouts[k]; ok && lo.LockedUntil.Sub(now) > d {
+			d = lo.LockedUntil.Sub(now)
+		}
+	}
+	return d
+}
+
+func (l *LockoutTracker) Fail(keys ...string) {
+	policy := l.policy()
+	if policy.Threshold <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for id, lo := range l.lockouts {
+		if l.stale(lo, now) {
+			delete(l.lockouts, id)
+		}
+	}
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+		lo, ok := l.lockouts[k]
+		if !ok {
+			lo = &Lockout{Key: k}
+			l.lockouts[k] = lo
+		}
+		lo.Failures++
+		lo.LastFailure = now
+		if lo.Failures < policy.Threshold {
+			continue
+		}
+		d := policy.Duration
+		for i := policy.Threshold; i < lo.Failures && d < policy.MaxDuration; i++ {
+			d *= 2
+		}
+		if d > policy.MaxDuration {
+			d = policy.MaxDuration
+		}
+		lo.LockedUntil = now.Add(d)
+		Log.Warning(fmt.Sprintf("%s locked out for %s after %d failures.", k, d, lo.Failures))
+	}
+}
+
+func (l *LockoutTracker) Clear(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.lockouts, k)
+	}
+}
+
+func (l *LockoutTracker) List() []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	list := make([]Lockout, 0, len(l.lockouts))
+	for _, lo := range l.lockouts {
+		if !l.stale(lo, now) {
+			list = append(list, *lo)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastFailure.After(list[j].LastFailure)
+	})
+	return list
+}
+
+func ipLockoutKey(r *http.Request) string {
+	return "ip:" + requestIP(r)
+}
+
+// loginLockoutKeys are the keys a login attempt of user counts against.
+func loginLockoutKeys(r *http.Request, user string) []string {
+	keys := []string{ipLockoutKey(r)}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// lockedOut answers a locked out client and reports whether it did.
+func lockedOut(w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	d := Lockouts.Locked(keys...)
+	if d <= 0 {
+		return false
+	}
+	Log.Warning(fmt.Sprintf("%s %s locked out.", r.RemoteAddr, r.RequestURI))
+	w.Header().Set("Retry-After", fmt.Sprint(int(d.Seconds())+1))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return true
+}
+
+type ClearLockoutRequest struct {
+	Keys []string `json:"keys"`
+}
+
+func ListLockoutServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := Lockouts.List()
+	data, err := json.Marshal(list)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListLockout-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(list), data))
+}
+
+func ClearLockoutServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var cr ClearLockoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	Log.Info("clear lockout", cr.Keys, "by", RequestUser(r))
+	Lockouts.Clear(cr.Keys...)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLockouts gives the test a fresh tracker with short, round durations.
+func useLockouts(t *testing.T) {
+	saved, savedLockouts := Config, Lockouts
+	Config.LockoutThreshold = 3
+	Config.LockoutDuration = time.Minute
+	Config.LockoutMaxDuration = 4 * time.Minute
+	Config.LockoutReset = time.Hour
+	Lockouts = NewLockoutTracker(func() LockoutPolicy {
+		return Config.LoginLockout()
+	})
+	t.Cleanup(func() { Config, Lockouts = saved, savedLockouts })
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	useLockouts(t)
+	cases := []struct {
+		failures int
+		locked   time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 4 * time.Minute},
+	}
+	for _, c := range cases {
+		Lockouts.Fail("user:a")
+		d := Lockouts.Locked("ip:x", "user:a")
+		if d > c.locked || d < c.locked-time.Second {
+			t.Errorf("%d failures: locked %s, want %s", c.failures, d, c.locked)
+		}
+	}
+	Lockouts.Clear("user:a")
+	if d := Lockouts.Locked("user:a"); d != 0 {
+		t.Errorf("locked %s after clear", d)
+	}
+}
+
+func TestLockoutForgetsStaleKeys(t *testing.T) {
+	useLockouts(t)
+	Lockouts.Fail("user:old")
+	Lockouts.lockouts["user:old"].LastFailure = time.Now().Add(-2 * time.Hour)
+	if list := Lockouts.List(); len(list) != 0 {
+		t.Errorf("stale key listed: %+v", list)
+	}
+	Lockouts.Fail("user:new")
+	if _, ok := Lockouts.lockouts["user:old"]; ok {
+		t.Error("stale key kept")
+	}
+	Config.LockoutThreshold = 0
+	for i := 0; i < 5; i++ {
+		Lockouts.Fail("user:off")
+	}
+	if d := Lockouts.Locked("user:off"); d != 0 {
+		t.Errorf("locked %s with lockout off", d)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	useLockouts(t)
+	try := func(user, passwd, remote string) int {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"`+user+`","password":"`+passwd+`"}`))
+		r.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		LoginServeHTTP(rec, r)
+		return rec.Code
+	}
+	steps := []struct {
+		name   string
+		user   string
+		passwd string
+		remote string
+		code   int
+	}{
+		{"first failure", Config.Username, "wrong", "192.0.2.1:1000", 401},
+		{"second failure", Config.Username, "wrong", "192.0.2.1:1000", 401},
+		{"third failure", Config.Username, "wrong", "192.0.2.1:1000", 401},
+		{"right password while locked", Config.Username, Config.Password, "192.0.2.1:1000", 429},
+		// the user key is locked too, whatever the address.
+		{"other address", Config.Username, Config.Password, "192.0.2.2:1000", 429},
+		{"other user, same address", "bob", "wrong", "192.0.2.1:1000", 429},
+		{"other user and address", "bob", "wrong", "192.0.2.3:1000", 401},
+	}
+	for _, s := range steps {
+		if code := try(s.user, s.passwd, s.remote); code != s.code {
+			t.Errorf("%s: got %d, want %d", s.name, code, s.code)
+		}
+	}
+	Lockouts.Clear("ip:192.0.2.1", "user:"+Config.Username)
+	if code := try(Config.Username, Config.Password, "192.0.2.1:1000"); code != 200 {
+		t.Errorf("after clear: got %d", code)
+	}
+}
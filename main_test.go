@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tests against a database in a temporary directory.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "frps-auth-test")
+	if err != nil {
+		panic(err)
+	}
+	dbDir = dir
+	if Db, err = openDB(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	Db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetBuckets deletes everything in the buckets, so a test starts empty.
+func resetBuckets(t *testing.T, buckets ...string) {
+	t.Helper()
+	err := dbUpdate(func(tx *nutsdb.Tx) error {
+		for _, b := range buckets {
+			entries, err := tx.GetAll(b)
+			if err == nutsdb.ErrBucketEmpty {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if err := tx.Delete(b, e.Key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustUpdate(t *testing.T, fn func(tx *nutsdb.Tx) error) {
+	t.Helper()
+	if err := dbUpdate(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func putEntries(t *testing.T, entries ...AuthDataEntity) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		for _, ae := range entries {
+			val, err := json.Marshal(ae)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(bucket, []byte(ae.Id), val, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func getEntry(t *testing.T, id string) (AuthDataEntity, bool) {
+	t.Helper()
+	var ae AuthDataEntity
+	err := dbView(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(bucket, []byte(id))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(e.Value, &ae)
+	})
+	return ae, err == nil
+}
+
+// serve calls h as role with the route variables vars.
+func serve(h http.HandlerFunc, method, path string, vars map[string]string, body string, role string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = withPrincipal(mux.SetURLVars(r, vars), Principal{User: role + "-user", Role: role})
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	return rec
+}
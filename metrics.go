@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var expiringWindow = 7 * 24 * time.Hour
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	pluginDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "frps_auth",
+		Name:      "plugin_decisions_total",
+		Help:      "Decisions of the frps plugin endpoint by op, result and reason.",
+	}, []string{"op", "result", "reason"})
+
+	pluginDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frps_auth",
+		Name:      "plugin_request_duration_seconds",
+		Help:      "Latency of frps plugin requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+
+	adminDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frps_auth",
+		Name:      "admin_request_duration_seconds",
+		Help:      "Latency of admin UI/API requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	dbTxDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "frps_auth",
+		Name:      "db_transaction_duration_seconds",
+		Help:      "Duration of database transactions.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"kind"})
+
+	syncDrift = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "frps_auth",
+		Name:      "sync_drift_entries",
+		Help:      "Entries that differ from the sync files.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		pluginDecisions,
+		pluginDuration,
+		adminDuration,
+		dbTxDuration,
+		syncDrift,
+		&entriesCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// pluginOps are the ops used as metric labels; anything else a caller of the
+// plugin endpoint sends is counted as other, so it cannot add series.
+var pluginOps = []string{"Login", "NewProxy", "CloseProxy", "Heartbeat", "Ping", "NewWorkConn", "NewUserConn"}
+
+func pluginOpLabel(op string) string {
+	if containsString(pluginOps, op) {
+		return op
+	}
+	return "other"
+}
+
+func observePluginRequest(op string, start time.Time) {
+	pluginDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func observeDbTx(kind string, start time.Time) {
+	dbTxDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// AdminMetricsMiddleware observes the latency of every route except the plugin
+// endpoint, which is measured by ServeHTTP itself.
+func AdminMetricsMiddleware(skip string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == skip {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+			route := "other"
+			if cr := mux.CurrentRoute(r); cr != nil {
+				if tpl, err := cr.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+			adminDuration.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// entriesCollector reads the store on every scrape, so the gauges never drift
+// from what the plugin endpoint sees.
+type entriesCollector struct{}
+
+var (
+	entriesDesc = prometheus.NewDesc("frps_auth_entries",
+		"Auth entries by proxy type and state (active, disabled, expired).",
+		[]string{"type", "state"}, nil)
+	expiringDesc = prometheus.NewDesc("frps_auth_entries_expiring",
+		"Active auth entries expiring within 7 days, by proxy type.",
+		[]string{"type"}, nil)
+	onlineDesc = prometheus.NewDesc("frps_auth_online_proxies",
+		"Proxies accepted by the plugin and not closed since.",
+		nil, nil)
+)
+
+func (c *entriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- entriesDesc
+	ch <- expiringDesc
+	ch <- onlineDesc
+}
+
+func (c *entriesCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(onlineDesc, prometheus.GaugeValue, float64(Online.Len()))
+	entries, err := loadAllAuth()
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	soon := now + expiringWindow.Milliseconds()
+	states := make(map[[2]string]int)
+	expiring := make(map[string]int)
+	for _, ae := range entries {
+		state := "active"
+		if ae.Disabled {
+			state = "disabled"
+		} else if now > ae.ValidTo {
+			state = "expired"
+		} else if soon > ae.ValidTo {
+			expiring[ae.ProxyType]++
+		}
+		states[[2]string{ae.ProxyType, state}]++
+	}
+	for k, v := range states {
+		ch <- prometheus.MustNewConstMetric(entriesDesc, prometheus.GaugeValue, float64(v), k[0], k[1])
+	}
+	for t, v := range expiring {
+		ch <- prometheus.MustNewConstMetric(expiringDesc, prometheus.GaugeValue, float64(v), t)
+	}
+}
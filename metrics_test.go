@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedEntry is an entry whose sign matches authKey, valid for d.
+func signedEntry(name, proxyType string, port uint16, authKey string, d time.Duration) AuthDataEntity {
+	ae := AuthDataEntity{
+		ProxyName:  name,
+		ProxyType:  proxyType,
+		RemotePort: port,
+		ValidTo:    time.Now().Add(d).UnixNano() / int64(time.Millisecond),
+		AuthKey:    authKey,
+	}
+	ae.Id = KeyBuilder{ProxyName: name, ProxyType: proxyType, RemotePort: port, Subdomain: name}.Key()
+	ae.Sign = SignBody{ProxyType: proxyType, RemotePort: port, Subdomain: name, AuthKey: authKey, ValidTo: strconv.FormatInt(ae.ValidTo, 10)}.Sign()
+	return ae
+}
+
+// pluginContent is what frpc sends for ae with authKey.
+func pluginContent(ae AuthDataEntity, authKey, runId string) applyPortContent {
+	return applyPortContent{
+		ProxyName:  ae.ProxyName,
+		ProxyType:  ae.ProxyType,
+		RemotePort: ae.RemotePort,
+		Subdomain:  ae.ProxyName,
+		Metas:      applyPortContentAuthMeta{SignKey: authKey, ValidTo: strconv.FormatInt(ae.ValidTo, 10)},
+		User:       applyPortContentUser{RunId: runId},
+	}
+}
+
+// callPlugin posts op to the plugin endpoint and returns whether it was
+// rejected and why.
+func callPlugin(t *testing.T, op string, content applyPortContent) (bool, string) {
+	t.Helper()
+	body, _ := json.Marshal(applyPortRequest{Version: "0.1.0", OpType: op, Content: content})
+	r := httptest.NewRequest("POST", "/auth", strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	ServeHTTP(rec, r)
+	var res struct {
+		Reject       bool   `json:"reject"`
+		RejectReason string `json:"reject_reason"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: %d %q", op, rec.Code, rec.Body)
+	}
+	return res.Reject, res.RejectReason
+}
+
+func TestPluginDecisions(t *testing.T) {
+	resetBuckets(t, bucket)
+	ok := signedEntry("ok", "tcp", 6000, "k1", time.Hour)
+	disabled := signedEntry("off", "tcp", 6001, "k2", time.Hour)
+	disabled.Disabled = true
+	expired := signedEntry("old", "udp", 6002, "k3", -time.Hour)
+	web := signedEntry("www", "http", 0, "k4", time.Hour)
+	putEntries(t, ok, disabled, expired, web)
+	missing := signedEntry("nope", "tcp", 6003, "k5", time.Hour)
+	cases := []struct {
+		op      string
+		content applyPortContent
+		result  string
+		reason  string
+	}{
+		{"NewProxy", pluginContent(ok, "k1", "r1"), "accept", "ok"},
+		{"Heartbeat", pluginContent(ok, "k1", "r1"), "accept", "ok"},
+		{"NewProxy", pluginContent(web, "k4", "r1"), "accept", "ok"},
+		{"NewProxy", pluginContent(ok, "wrong", "r1"), "reject", "bad_sign"},
+		{"NewProxy", pluginContent(disabled, "k2", "r1"), "reject", "disabled"},
+		{"NewProxy", pluginContent(expired, "k3", "r1"), "reject", "expired"},
+		{"NewProxy", pluginContent(missing, "k5", "r1"), "reject", "not_found"},
+		{"Login", applyPortContent{}, "pass", "unhandled_op"},
+		{"Bogus", applyPortContent{}, "pass", "unhandled_op"},
+	}
+	for _, c := range cases {
+		counter := pluginDecisions.WithLabelValues(pluginOpLabel(c.op), c.result, c.reason)
+		before := testutil.ToFloat64(counter)
+		reject, _ := callPlugin(t, c.op, c.content)
+		if reject != (c.result == "reject") {
+			t.Errorf("%s %s: reject %v, want %s", c.op, c.content.ProxyName, reject, c.result)
+		}
+		if got := testutil.ToFloat64(counter) - before; got != 1 {
+			t.Errorf("%s %s: %s/%s counted %v times", c.op, c.content.ProxyName, c.result, c.reason, got)
+		}
+	}
+}
+
+func TestPluginOpLabel(t *testing.T) {
+	cases := map[string]string{
+		"NewProxy":  "NewProxy",
+		"Heartbeat": "Heartbeat",
+		"":          "other",
+		"newproxy":  "other",
+		"x\ny":      "other",
+	}
+	for op, want := range cases {
+		if got := pluginOpLabel(op); got != want {
+			t.Errorf("%q: got %q, want %q", op, got, want)
+		}
+	}
+}
+
+func TestOnlineProxies(t *testing.T) {
+	resetBuckets(t, bucket)
+	Online = &OnlineProxies{proxies: make(map[string]*OnlineProxy)}
+	a := signedEntry("a", "tcp", 6000, "ka", time.Hour)
+	b := signedEntry("b", "tcp", 6001, "kb", time.Hour)
+	putEntries(t, a, b)
+	callPlugin(t, "NewProxy", pluginContent(a, "ka", "r1"))
+	callPlugin(t, "NewProxy", pluginContent(b, "kb", "r2"))
+	if n := Online.Len(); n != 2 {
+		t.Fatalf("online %d, want 2", n)
+	}
+	// a rejected heartbeat takes the proxy offline.
+	callPlugin(t, "Heartbeat", pluginContent(b, "bad", "r2"))
+	callPlugin(t, "CloseProxy", applyPortContent{ProxyName: "nope", User: applyPortContentUser{RunId: "r1"}})
+	list := Online.List()
+	if len(list) != 1 || list[0].Key != a.Id || list[0].RunId != "r1" {
+		t.Fatalf("got %+v", list)
+	}
+	callPlugin(t, "CloseProxy", applyPortContent{ProxyName: "a", User: applyPortContentUser{RunId: "r1"}})
+	if n := Online.Len(); n != 0 {
+		t.Errorf("online %d after CloseProxy", n)
+	}
+}
+
+func TestOnlineProxiesExpire(t *testing.T) {
+	resetBuckets(t, bucket)
+	saved := Config
+	defer func() { Config = saved }()
+	Config.OnlineTTL = time.Minute
+	Online = &OnlineProxies{proxies: make(map[string]*OnlineProxy)}
+	a := signedEntry("a", "tcp", 6000, "ka", time.Hour)
+	b := signedEntry("b", "tcp", 6001, "kb", time.Hour)
+	putEntries(t, a, b)
+	callPlugin(t, "NewProxy", pluginContent(a, "ka", "r1"))
+	callPlugin(t, "NewProxy", pluginContent(b, "kb", "r2"))
+	// frps went away without closing a.
+	Online.mu.Lock()
+	for _, p := range Online.proxies {
+		if p.RunId == "r1" {
+			p.LastSeen = time.Now().Add(-2 * time.Minute)
+		}
+	}
+	Online.mu.Unlock()
+	if list := Online.List(); len(list) != 1 || list[0].Key != b.Id {
+		t.Errorf("got %+v", list)
+	}
+	Config.OnlineTTL = 0
+	callPlugin(t, "NewProxy", pluginContent(a, "ka", "r1"))
+	Online.mu.Lock()
+	for _, p := range Online.proxies {
+		p.LastSeen = time.Now().Add(-time.Hour)
+	}
+	Online.mu.Unlock()
+	if n := Online.Len(); n != 2 {
+		t.Errorf("online %d with online_ttl 0", n)
+	}
+}
+
+func TestEntriesCollector(t *testing.T) {
+	resetBuckets(t, bucket)
+	Online = &OnlineProxies{proxies: make(map[string]*OnlineProxy)}
+	off := signedEntry("off", "udp", 6003, "k", time.Hour)
+	off.Disabled = true
+	putEntries(t,
+		signedEntry("a", "tcp", 6000, "k", 30*24*time.Hour),
+		signedEntry("b", "tcp", 6001, "k", 24*time.Hour),
+		signedEntry("c", "tcp", 6002, "k", -time.Hour),
+		off,
+	)
+	want := `
+# HELP frps_auth_entries Auth entries by proxy type and state (active, disabled, expired).
+# TYPE frps_auth_entries gauge
+frps_auth_entries{state="active",type="tcp"} 2
+frps_auth_entries{state="disabled",type="udp"} 1
+frps_auth_entries{state="expired",type="tcp"} 1
+# HELP frps_auth_entries_expiring Active auth entries expiring within 7 days, by proxy type.
+# TYPE frps_auth_entries_expiring gauge
+frps_auth_entries_expiring{type="tcp"} 1
+# HELP frps_auth_online_proxies Proxies accepted by the plugin and not closed since.
+# TYPE frps_auth_online_proxies gauge
+frps_auth_online_proxies 0
+`
+	if err := testutil.CollectAndCompare(&entriesCollector{}, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+}
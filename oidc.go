@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateCookie = "frps_auth_oidc"
+	oidcLoginTTL    = 10 * time.Minute
+	// unknown key ids refetch the JWKS at most this often.
+	oidcJwksMinInterval = time.Minute
+	oidcClockSkew       = time.Minute
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is an authorization request on its way through the provider.
+type oidcLogin struct {
+	Verifier string
+	Nonce    string
+	Created  time.Time
+}
+
+// OidcProvider discovers the provider lazily, so that frps-auth starts even
+// while the provider is down.
+type OidcProvider struct {
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+	logins      map[string]oidcLogin
+}
+
+var Oidc = &OidcProvider{logins: make(map[string]oidcLogin)}
+
+func oidcGetJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *OidcProvider) getDiscovery() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var d oidcDiscovery
+	issuer := strings.TrimSuffix(Config.OidcIssuer, "/")
+	if err := oidcGetJSON(issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, Config.OidcIssuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// getKey returns the RSA key of kid, refetching the JWKS when the provider
+// has rotated its keys.
+func (o *OidcProvider) getKey(d *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(o.keysFetched) < oidcJwksMinInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := oidcGetJSON(d.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	o.keysFetched = time.Now()
+	o.keys = make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (o *OidcProvider) putLogin(state string, l oidcLogin) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for s, pending := range o.logins {
+		if time.Since(pending.Created) > oidcLoginTTL {
+			delete(o.logins, s)
+		}
+	}
+	o.logins[state] = l
+}
+
+// takeLogin returns the pending login of state, which can only be used once.
+func (o *OidcProvider) takeLogin(state string) (oidcLogin, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	l, ok := o.logins[state]
+	delete(o.logins, state)
+	if !ok || time.Since(l.Created) > oidcLoginTTL {
+		return oidcLogin{}, false
+	}
+	return l, true
+}
+
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+// verifyIdToken checks the RS256 signature, issuer, audience, expiry and nonce
+// of an id_token and returns its claims.
+func (o *OidcProvider) verifyIdToken(d *oidcDiscovery, raw, nonce string) (idTokenClaims, map[string]interface{}, error) {
+	var claims idTokenClaims
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, nil, errors.New("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &header) != nil {
+		return claims, nil, errors.New("malformed id_token header")
+	}
+	if header.Alg != "RS256" {
+		return claims, nil, fmt.Errorf("unsupported id_token alg %q", header.Alg)
+	}
+	key, err := o.getKey(d, header.Kid)
+	if err != nil {
+		return claims, nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, nil, errors.New("malformed id_token signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return claims, nil, errors.New("bad id_token signature")
+	}
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, nil, errors.New("malformed id_token payload")
+	}
+	var all map[string]interface{}
+	if json.Unmarshal(pb, &claims) != nil || json.Unmarshal(pb, &all) != nil {
+		return claims, nil, errors.New("malformed id_token payload")
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(d.Issuer, "/") {
+		return claims, nil, fmt.Errorf("id_token issuer %q", claims.Issuer)
+	}
+	var aud []string
+	if json.Unmarshal(claims.Audience, &aud) != nil {
+		var single string
+		json.Unmarshal(claims.Audience, &single)
+		aud = []string{single}
+	}
+	if !containsString(aud, Config.OidcClientId) {
+		return claims, nil, errors.New("id_token not issued for this client")
+	}
+	if time.Now().Add(-oidcClockSkew).Unix() > claims.Expiry {
+		return claims, nil, errors.New("id_token expired")
+	}
+	if claims.Nonce != nonce {
+		return claims, nil, errors.New("id_token nonce mismatch")
+	}
+	return claims, all, nil
+}
+
+// parseRoleMap parses "group=role,group=role".
+func parseRoleMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range splitQuery(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid mapping %q", item)
+		}
+		role := strings.TrimSpace(kv[1])
+		if _, ok := roleLevels[role]; !ok {
+			return nil, fmt.Errorf("invalid role %q", role)
+		}
+		m[strings.TrimSpace(kv[0])] = role
+	}
+	return m, nil
+}
+
+// groupsRole maps the groups to the strongest role they are given.
+func groupsRole(groups []string, roleMap string, defaultRole string) string {
+	m, _ := parseRoleMap(roleMap)
+	role := defaultRole
+	for _, g := range groups {
+		// keycloak sends group paths like /frps-admins.
+		r, ok := m[g]
+		if !ok {
+			r = m[strings.TrimPrefix(g, "/")]
+		}
+		if roleLevels[r] > roleLevels[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+func claimStrings(claims map[string]interface{}, name string) []string {
+	var out []string
+	switch v := claims[name].(type) {
+	case string:
+		out = append(out, v)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func LoginOptionsServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"oidc":      Config.OidcEnabled(),
+		"oidc_name": Config.OidcName,
+	})
+}
+
+// OidcLoginServeHTTP sends the browser to the provider with a fresh state,
+// nonce and PKCE challenge.
+func OidcLoginServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !Config.OidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := Oidc.getDiscovery()
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[OidcLogin-1].", 500)
+		return
+	}
+	state := randomToken()
+	l := oidcLogin{Verifier: randomToken(), Nonce: randomToken(), Created: time.Now()}
+	Oidc.putLogin(state, l)
+	// Lax, the provider redirects back with a cross site GET.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/",
+		MaxAge:   int(oidcLoginTTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", Config.OidcClientId)
+	v.Set("redirect_uri", Config.OidcRedirectURL)
+	v.Set("scope", Config.OidcScopes)
+	v.Set("state", state)
+	v.Set("nonce", l.Nonce)
+	v.Set("code_challenge", pkceChallenge(l.Verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+v.Encode(), http.StatusFound)
+}
+
+func (o *OidcProvider) exchange(d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", Config.OidcRedirectURL)
+	form.Set("client_id", Config.OidcClientId)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if Config.OidcClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(Config.OidcClientId), url.QueryEscape(Config.OidcClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tr struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 || tr.IdToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, tr.Error)
+	}
+	return tr.IdToken, nil
+}
+
+// OidcCallbackServeHTTP finishes the login: the code is exchanged, the
+// id_token verified and its groups mapped to a role.
+func OidcCallbackServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !Config.OidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/oidc/", MaxAge: -1})
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		Log.Warning(fmt.Sprintf("oidc login from %s: %s %s.", r.RemoteAddr, e, q.Get("error_description")))
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || c.Value != state {
+		http.Error(w, "bad login state", http.StatusBadRequest)
+		return
+	}
+	l, ok := Oidc.takeLogin(state)
+	if !ok {
+		http.Error(w, "login expired", http.StatusBadRequest)
+		return
+	}
+	d, err := Oidc.getDiscovery()
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[OidcCallback-1].", 500)
+		return
+	}
+	raw, err := Oidc.exchange(d, q.Get("code"), l.Verifier)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[OidcCallback-2].", 500)
+		return
+	}
+	claims, all, err := Oidc.verifyIdToken(d, raw, l.Nonce)
+	if err != nil {
+		Log.Warning(fmt.Sprintf("oidc login from %s: %s.", r.RemoteAddr, err))
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Subject
+	}
+	role := groupsRole(claimStrings(all, Config.OidcGroupsClaim), Config.OidcRoleMap, Config.OidcDefaultRole)
+	if role == "" {
+		Log.Warning(fmt.Sprintf("oidc user %s has no role.", username))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// an SSO user must not take over the tokens of a local account.
+	if _, err := getUser(username); err == nil || username == Config.Username {
+		Log.Warning(fmt.Sprintf("oidc user %s collides with a local account.", username))
+		http.Error(w, "username is taken by a local account", http.StatusForbidden)
+		return
+	}
+	ss := Sessions.Create(Principal{User: username, Role: role, Provider: ProviderOidc})
+	Log.Info("login", username, role, "oidc", r.RemoteAddr)
+	setSessionCookies(w, r, ss)
+	// a SameSite=Strict cookie is not sent along the provider's redirect
+	// chain; continue from a page of our own.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html><meta http-equiv="refresh" content="0;url=/">`)
+}
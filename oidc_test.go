@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OIDC provider with discovery, JWKS and a token endpoint
+// that checks the PKCE verifier of each code.
+type mockIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	signer *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockCode
+	// why the token endpoint refused the last exchange
+	refused string
+}
+
+type mockCode struct {
+	challenge string
+	redirect  string
+	claims    map[string]interface{}
+}
+
+var testKey, otherKey *rsa.PrivateKey
+
+func init() {
+	var err error
+	if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if otherKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+}
+
+func newMockIssuer() *mockIssuer {
+	m := &mockIssuer{key: testKey, signer: testKey, codes: make(map[string]mockCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JwksURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jwk{{
+			Kid: "k1",
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) refuse(w http.ResponseWriter, why string) {
+	m.mu.Lock()
+	m.refused = why
+	m.mu.Unlock()
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	c, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	id, secret, _ := r.BasicAuth()
+	switch {
+	case !ok:
+		m.refuse(w, "unknown code")
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		m.refuse(w, "grant_type")
+	case id != Config.OidcClientId || secret != Config.OidcClientSecret:
+		m.refuse(w, "client credentials")
+	case r.PostForm.Get("redirect_uri") != c.redirect:
+		m.refuse(w, "redirect_uri")
+	case pkceChallenge(r.PostForm.Get("code_verifier")) != c.challenge:
+		m.refuse(w, "code_verifier")
+	default:
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign("k1", c.claims)})
+	}
+}
+
+func (m *mockIssuer) sign(kid string, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	p, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.signer, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize stands for the user logging in at the provider: it checks the
+// authorization request and hands out a code for claims.
+func (m *mockIssuer) authorize(t *testing.T, q url.Values, claims map[string]interface{}) string {
+	t.Helper()
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("bad authorization request %v", q)
+	}
+	if q.Get("client_id") != Config.OidcClientId || q.Get("redirect_uri") != Config.OidcRedirectURL {
+		t.Fatalf("bad client in authorization request %v", q)
+	}
+	if q.Get("state") == "" || q.Get("nonce") == "" || q.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without state, nonce or challenge %v", q)
+	}
+	code := randomToken()
+	m.mu.Lock()
+	m.codes[code] = mockCode{challenge: q.Get("code_challenge"), redirect: q.Get("redirect_uri"), claims: claims}
+	m.mu.Unlock()
+	return code
+}
+
+func setupOidc(t *testing.T) *mockIssuer {
+	m := newMockIssuer()
+	saved := Config
+	Config.OidcIssuer = m.URL
+	Config.OidcClientId = "frps-auth"
+	Config.OidcClientSecret = "s3cret"
+	Config.OidcRedirectURL = "https://frps.example/oidc/callback"
+	Config.OidcRoleMap = "frps-admins=admin,ops=operator,audit=viewer"
+	Config.OidcDefaultRole = ""
+	Oidc = &OidcProvider{logins: make(map[string]oidcLogin)}
+	resetBuckets(t, userBucket)
+	t.Cleanup(func() {
+		Config = saved
+		m.Close()
+	})
+	return m
+}
+
+func (m *mockIssuer) claims(nonce string, groups ...string) map[string]interface{} {
+	g := []interface{}{}
+	for _, s := range groups {
+		g = append(g, s)
+	}
+	return map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "0f3a",
+		"aud":                []string{"other-client", Config.OidcClientId},
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "alice",
+		"groups":             g,
+	}
+}
+
+// startLogin runs /oidc/login and returns the authorization request and the
+// state cookie.
+func startLogin(t *testing.T, m *mockIssuer) (url.Values, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	OidcLoginServeHTTP(rec, httptest.NewRequest("GET", "/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body)
+	}
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), m.URL+"/authorize?") {
+		t.Fatalf("login redirected to %q", rec.Header().Get("Location"))
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			if c.Value != loc.Query().Get("state") {
+				t.Fatal("state cookie does not match the state sent")
+			}
+			return loc.Query(), c
+		}
+	}
+	t.Fatal("no state cookie")
+	return nil, nil
+}
+
+func callback(code, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	v := url.Values{}
+	v.Set("code", code)
+	v.Set("state", state)
+	r := httptest.NewRequest("GET", "/oidc/callback?"+v.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	OidcCallbackServeHTTP(rec, r)
+	return rec
+}
+
+func sessionOf(rec *httptest.ResponseRecorder) *Session {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return Sessions.Get(c.Value)
+		}
+	}
+	return nil
+}
+
+func TestOidcLogin(t *testing.T) {
+	m := setupOidc(t)
+	q, cookie := startLogin(t, m)
+	code := m.authorize(t, q, m.claims(q.Get("nonce"), "/frps-admins", "staff"))
+	rec := callback(code, q.Get("state"), cookie)
+	if rec.Code != 200 {
+		t.Fatalf("callback: %d %s (token endpoint: %q)", rec.Code, rec.Body, m.refused)
+	}
+	ss := sessionOf(rec)
+	if ss == nil || ss.User != "alice" || ss.Role != RoleAdmin || ss.Provider != ProviderOidc {
+		t.Fatalf("got session %+v", ss)
+	}
+	// the state is good for one callback only.
+	code = m.authorize(t, q, m.claims(q.Get("nonce"), "/frps-admins"))
+	if rec := callback(code, q.Get("state"), cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("replayed state: %d", rec.Code)
+	}
+}
+
+func TestOidcCallbackState(t *testing.T) {
+	m := setupOidc(t)
+	q, cookie := startLogin(t, m)
+	code := m.authorize(t, q, m.claims(q.Get("nonce"), "ops"))
+	if rec := callback(code, q.Get("state"), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("without cookie: %d", rec.Code)
+	}
+	other := *cookie
+	other.Value = randomToken()
+	if rec := callback(code, other.Value, &other); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown state: %d", rec.Code)
+	}
+	if rec := callback(code, randomToken(), cookie); rec.Code != http.StatusBadRequest {
+		t.Errorf("state not matching the cookie: %d", rec.Code)
+	}
+}
+
+func TestOidcCallbackPkce(t *testing.T) {
+	m := setupOidc(t)
+	q, cookie := startLogin(t, m)
+	code := m.authorize(t, q, m.claims(q.Get("nonce"), "ops"))
+	// the verifier kept for the state no longer matches the challenge sent.
+	Oidc.mu.Lock()
+	l := Oidc.logins[q.Get("state")]
+	l.Verifier = randomToken()
+	Oidc.logins[q.Get("state")] = l
+	Oidc.mu.Unlock()
+	rec := callback(code, q.Get("state"), cookie)
+	if rec.Code != 500 || m.refused != "code_verifier" {
+		t.Errorf("wrong verifier: %d, token endpoint refused %q", rec.Code, m.refused)
+	}
+	if sessionOf(rec) != nil {
+		t.Error("session created")
+	}
+}
+
+func TestOidcIdTokenChecks(t *testing.T) {
+	m := setupOidc(t)
+	cases := []struct {
+		name   string
+		tweak  func(c map[string]interface{})
+		signer *rsa.PrivateKey
+	}{
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other-client" }, nil},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, nil},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix() }, nil},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, nil},
+		{"bad signature", func(c map[string]interface{}) {}, otherKey},
+	}
+	for _, c := range cases {
+		q, cookie := startLogin(t, m)
+		claims := m.claims(q.Get("nonce"), "/frps-admins")
+		c.tweak(claims)
+		m.signer = testKey
+		if c.signer != nil {
+			m.signer = c.signer
+		}
+		rec := callback(m.authorize(t, q, claims), q.Get("state"), cookie)
+		if rec.Code != http.StatusUnauthorized || sessionOf(rec) != nil {
+			t.Errorf("%s: got %d, want 401 and no session", c.name, rec.Code)
+		}
+	}
+	m.signer = testKey
+	// a token that is only just expired is within the allowed clock skew.
+	q, cookie := startLogin(t, m)
+	claims := m.claims(q.Get("nonce"), "/frps-admins")
+	claims["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix()
+	if rec := callback(m.authorize(t, q, claims), q.Get("state"), cookie); rec.Code != 200 {
+		t.Errorf("within clock skew: %d", rec.Code)
+	}
+}
+
+func TestOidcGroupRoles(t *testing.T) {
+	m := setupOidc(t)
+	cases := []struct {
+		groups      []string
+		defaultRole string
+		code        int
+		role        string
+	}{
+		{[]string{"ops"}, "", 200, RoleOperator},
+		{[]string{"audit", "ops"}, "", 200, RoleOperator},
+		{[]string{"/frps-admins", "audit"}, "", 200, RoleAdmin},
+		{[]string{"staff"}, "", http.StatusForbidden, ""},
+		{nil, "", http.StatusForbidden, ""},
+		{[]string{"staff"}, RoleViewer, 200, RoleViewer},
+		{[]string{"ops"}, RoleViewer, 200, RoleOperator},
+	}
+	for _, c := range cases {
+		Config.OidcDefaultRole = c.defaultRole
+		q, cookie := startLogin(t, m)
+		rec := callback(m.authorize(t, q, m.claims(q.Get("nonce"), c.groups...)), q.Get("state"), cookie)
+		if rec.Code != c.code {
+			t.Errorf("%v default %q: got %d, want %d", c.groups, c.defaultRole, rec.Code, c.code)
+			continue
+		}
+		if ss := sessionOf(rec); c.code == 200 && (ss == nil || ss.Role != c.role) {
+			t.Errorf("%v default %q: got session %+v, want role %s", c.groups, c.defaultRole, ss, c.role)
+		}
+	}
+}
+
+func TestOidcLocalAccountCollision(t *testing.T) {
+	m := setupOidc(t)
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		return putUser(tx, UserEntity{Username: "alice", Role: RoleViewer})
+	})
+	q, cookie := startLogin(t, m)
+	rec := callback(m.authorize(t, q, m.claims(q.Get("nonce"), "/frps-admins")), q.Get("state"), cookie)
+	if rec.Code != http.StatusForbidden || sessionOf(rec) != nil {
+		t.Errorf("got %d, want 403 and no session", rec.Code)
+	}
+}
+
+func TestParseRoleMap(t *testing.T) {
+	m, err := parseRoleMap("a=admin, b = viewer")
+	if err != nil || m["a"] != RoleAdmin || m["b"] != RoleViewer {
+		t.Errorf("got %v %v", m, err)
+	}
+	for _, bad := range []string{"a", "=admin", "a=root"} {
+		if _, err := parseRoleMap(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
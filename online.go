@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// OnlineProxy is a proxy that frps reported through the plugin and that has not
+// been closed since.
+type OnlineProxy struct {
+	RunId string `json:"run_id"`
+
+	ProxyName string `json:"proxy_name"`
+
+	Key string `json:"id"`
+
+	Since time.Time `json:"since"`
+
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// OnlineProxies tracks proxies accepted by NewProxy/Heartbeat and removed by
+// CloseProxy. CloseProxy carries no proxy type or port, so proxies are keyed by
+// frpc run_id and proxy name. Proxies not seen for online_ttl are dropped, as
+// frps does not send CloseProxy when it restarts or crashes.
+type OnlineProxies struct {
+	mu      sync.RWMutex
+	proxies map[string]*OnlineProxy
+}
+
+var Online = &OnlineProxies{proxies: make(map[string]*OnlineProxy)}
+
+func onlineKey(runId, proxyName string) string {
+	return runId + "/" + proxyName
+}
+
+func (o *OnlineProxies) Put(runId, proxyName, key string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	if p, ok := o.proxies[onlineKey(runId, proxyName)]; ok && p.Key == key {
+		p.LastSeen = now
+		return
+	}
+	o.proxies[onlineKey(runId, proxyName)] = &OnlineProxy{
+		RunId:     runId,
+		ProxyName: proxyName,
+		Key:       key,
+		Since:     now,
+		LastSeen:  now,
+	}
+}
+
+func (o *OnlineProxies) Remove(runId, proxyName string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.proxies, onlineKey(runId, proxyName))
+}
+
+// Touch marks every proxy of an frpc client as seen, on the client's Ping.
+func (o *OnlineProxies) Touch(runId string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	for _, p := range o.proxies {
+		if p.RunId == runId {
+			p.LastSeen = now
+		}
+	}
+}
+
+// expire drops the proxies last seen before now-online_ttl; the caller holds
+// the write lock.
+func (o *OnlineProxies) expire(now time.Time) {
+	if Config.OnlineTTL <= 0 {
+		return
+	}
+	for k, p := range o.proxies {
+		if now.Sub(p.LastSeen) > Config.OnlineTTL {
+			delete(o.proxies, k)
+		}
+	}
+}
+
+func (o *OnlineProxies) List() []OnlineProxy {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire(time.Now())
+	list := make([]OnlineProxy, 0, len(o.proxies))
+	for _, p := range o.proxies {
+		list = append(list, *p)
+	}
+	return list
+}
+
+func (o *OnlineProxies) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.expire(time.Now())
+	return len(o.proxies)
+}
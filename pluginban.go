@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// PluginBans counts bad signatures on the frps plugin endpoint. A banned
+// client is rejected unless its signature matches the stored entry.
+var PluginBans = NewLockoutTracker(func() LockoutPolicy {
+	return Config.PluginBan()
+})
+
+// pluginBanKeys are the frpc run_id, the frpc user and the proxy an attempt
+// counts against; frpc leaves the user empty unless configured. The user and
+// the proxy are taken as sent by whoever calls the plugin endpoint, so they
+// only count together with the address of the caller: bad signatures sent
+// from elsewhere cannot ban a proxy for the frps that serves it.
+func pluginBanKeys(r *http.Request, apr applyPortRequest, key string) []string {
+	ip := requestIP(r)
+	keys := []string{"run_id:" + apr.Content.User.RunId, "proxy:" + ip + "/" + key}
+	if apr.Content.User.User != "" {
+		keys = append(keys, "user:"+ip+"/"+apr.Content.User.User)
+	}
+	return keys
+}
+
+func ListPluginBanServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := PluginBans.List()
+	data, err := json.Marshal(list)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListPluginBan-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(list), data))
+}
+
+func ClearPluginBanServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var cr ClearLockoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	Log.Info("clear plugin ban", cr.Keys, "by", RequestUser(r))
+	PluginBans.Clear(cr.Keys...)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePluginBans gives the test a fresh tracker banning from the second bad
+// signature on.
+func usePluginBans(t *testing.T) {
+	saved, savedBans := Config, PluginBans
+	Config.PluginBanThreshold = 2
+	Config.PluginBanDuration = time.Minute
+	Config.PluginBanMaxDuration = time.Hour
+	Config.PluginBanReset = time.Hour
+	PluginBans = NewLockoutTracker(func() LockoutPolicy {
+		return Config.PluginBan()
+	})
+	t.Cleanup(func() { Config, PluginBans = saved, savedBans })
+}
+
+func TestPluginBanKeys(t *testing.T) {
+	cases := []struct {
+		user applyPortContentUser
+		want []string
+	}{
+		{applyPortContentUser{RunId: "r1"}, []string{"run_id:r1", "proxy:192.0.2.1/k"}},
+		{applyPortContentUser{RunId: "r1", User: "u"}, []string{"run_id:r1", "proxy:192.0.2.1/k", "user:192.0.2.1/u"}},
+	}
+	r := httptest.NewRequest("POST", "/auth", nil)
+	r.RemoteAddr = "192.0.2.1:1000"
+	for _, c := range cases {
+		got := pluginBanKeys(r, applyPortRequest{Content: applyPortContent{User: c.user}}, "k")
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Errorf("%+v: got %v, want %v", c.user, got, c.want)
+		}
+	}
+}
+
+// callPluginFrom sends NewProxy from the address remote and returns whether
+// it was rejected as banned.
+func callPluginFrom(t *testing.T, remote string, content applyPortContent) bool {
+	t.Helper()
+	body, _ := json.Marshal(applyPortRequest{Version: "0.1.0", OpType: "NewProxy", Content: content})
+	r := httptest.NewRequest("POST", "/auth", strings.NewReader(string(body)))
+	r.RemoteAddr = remote
+	rec := httptest.NewRecorder()
+	ServeHTTP(rec, r)
+	var res struct {
+		RejectReason string `json:"reject_reason"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %q", rec.Code, rec.Body)
+	}
+	return res.RejectReason == "banned"
+}
+
+func TestPluginBanPerAddress(t *testing.T) {
+	usePluginBans(t)
+	resetBuckets(t, bucket)
+	ae := signedEntry("addr", "tcp", 6101, "k", time.Hour)
+	putEntries(t, ae)
+	for i, run := range []string{"x1", "x2", "x3"} {
+		callPluginFrom(t, "198.51.100.7:1000", pluginContent(ae, "bad", run))
+		if i == 2 && !callPluginFrom(t, "198.51.100.7:1000", pluginContent(ae, "bad", "x4")) {
+			t.Error("proxy not banned for the caller sending bad signatures")
+		}
+	}
+	if callPluginFrom(t, "192.0.2.1:1000", pluginContent(ae, "k", "r1")) {
+		t.Error("proxy banned for another frps")
+	}
+}
+
+func TestPluginBan(t *testing.T) {
+	usePluginBans(t)
+	resetBuckets(t, bucket)
+	ae := signedEntry("ban", "tcp", 6100, "k", time.Hour)
+	putEntries(t, ae)
+	banned := pluginDecisions.WithLabelValues("NewProxy", "reject", "banned")
+	before := testutil.ToFloat64(banned)
+	steps := []struct {
+		name    string
+		content applyPortContent
+		banned  bool
+	}{
+		{"first bad sign", pluginContent(ae, "bad", "r1"), false},
+		{"second bad sign", pluginContent(ae, "bad", "r1"), false},
+		{"banned", pluginContent(ae, "bad", "r1"), true},
+		{"banned from another run", pluginContent(ae, "bad", "r2"), true},
+	}
+	for _, s := range steps {
+		if reject, reason := callPlugin(t, "NewProxy", s.content); !reject || (reason == "banned") != s.banned {
+			t.Errorf("%s: got %v %q, banned %v", s.name, reject, reason, s.banned)
+		}
+	}
+	if got := testutil.ToFloat64(banned) - before; got != 2 {
+		t.Errorf("banned counted %v times", got)
+	}
+	if list := PluginBans.List(); len(list) != 2 {
+		t.Errorf("got %+v", list)
+	}
+	rec := httptest.NewRecorder()
+	ClearPluginBanServeHTTP(rec, httptest.NewRequest("POST", "/clear-plugin-ban", strings.NewReader(`{"keys":["run_id:r1","proxy:192.0.2.1/`+ae.Id+`"]}`)))
+	if rec.Code != 200 {
+		t.Fatalf("clear: %d %q", rec.Code, rec.Body)
+	}
+	if reject, reason := callPlugin(t, "NewProxy", pluginContent(ae, "k", "r1")); reject {
+		t.Errorf("after clear: rejected %q", reason)
+	}
+}
+
+func TestPluginBanPassesValidSignature(t *testing.T) {
+	usePluginBans(t)
+	resetBuckets(t, bucket)
+	ae := signedEntry("valid", "tcp", 6102, "k", time.Hour)
+	off := signedEntry("off", "tcp", 6103, "k", time.Hour)
+	off.Disabled = true
+	putEntries(t, ae, off)
+	for i := 0; i < 3; i++ {
+		callPlugin(t, "NewProxy", pluginContent(ae, "bad", "r1"))
+		callPlugin(t, "NewProxy", pluginContent(off, "bad", "r1"))
+	}
+	cases := []struct {
+		name    string
+		content applyPortContent
+		reject  bool
+		reason  string
+	}{
+		{"bad sign banned", pluginContent(ae, "bad", "r1"), true, "banned"},
+		{"valid sign of banned run and proxy", pluginContent(ae, "k", "r1"), false, ""},
+		{"valid sign from another run", pluginContent(ae, "k", "r2"), false, ""},
+		{"valid sign of disabled entry", pluginContent(off, "k", "r1"), true, "invalid[disabled]"},
+	}
+	for _, c := range cases {
+		if reject, reason := callPlugin(t, "NewProxy", c.content); reject != c.reject || reason != c.reason {
+			t.Errorf("%s: got %v %q, want %v %q", c.name, reject, reason, c.reject, c.reason)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// RequestPort is remote_port in AddAuthRequest: a port, or "auto" for the
+// lowest free port of the pool.
+type RequestPort struct {
+	Port uint16
+
+	Auto bool
+}
+
+func (p *RequestPort) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return json.Unmarshal(b, &p.Port)
+	}
+	if s == "auto" {
+		p.Auto = true
+		return nil
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid remote_port %q", s)
+	}
+	p.Port = uint16(port)
+	return nil
+}
+
+func (p RequestPort) String() string {
+	if p.Auto {
+		return "auto"
+	}
+	return strconv.Itoa(int(p.Port))
+}
+
+// portlessTypes are the proxy types frps gives no remote port.
+var portlessTypes = []string{"http", "https", "stcp", "sudp", "xtcp"}
+
+var (
+	errNoPortPool = errors.New("no port pool is configured")
+	errNoFreePort = errors.New("no free port in the pool")
+)
+
+// PortInUseError is a remote port that another entry has already, or that is
+// reserved when Id is empty.
+type PortInUseError struct {
+	Port uint16
+
+	Id string
+}
+
+func (e *PortInUseError) Error() string {
+	if e.Id == "" {
+		return fmt.Sprintf("remote port %d is reserved", e.Port)
+	}
+	return fmt.Sprintf("remote port %d is used by %s", e.Port, e.Id)
+}
+
+type portRange struct {
+	lo, hi uint16
+}
+
+func (pr portRange) String() string {
+	if pr.lo == pr.hi {
+		return strconv.Itoa(int(pr.lo))
+	}
+	return fmt.Sprintf("%d-%d", pr.lo, pr.hi)
+}
+
+func (pr portRange) contains(port uint16) bool {
+	return port >= pr.lo && port <= pr.hi
+}
+
+// parsePortRanges reads ports and port ranges like 6000-6999,7000.
+func parsePortRanges(items []string) ([]portRange, error) {
+	var ranges []portRange
+	for _, s := range items {
+		lo, hi, err := parsePortRange(s)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, portRange{lo, hi})
+	}
+	return ranges, nil
+}
+
+func inPortRanges(ranges []portRange, port uint16) bool {
+	for _, pr := range ranges {
+		if pr.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// portPool is a range ports are allocated from. The ranges of a tenant are
+// its own pool; port_pool serves everyone else, tenants without ranges
+// included, and skips them.
+type portPool struct {
+	portRange
+
+	Tenant string
+}
+
+func loadPortPools(tx *nutsdb.Tx) ([]portPool, error) {
+	var pools []portPool
+	tenants, err := tx.GetAll(tenantBucket)
+	if err != nil && err != nutsdb.ErrBucketEmpty {
+		return nil, err
+	}
+	for _, e := range tenants {
+		var t Tenant
+		if err := json.Unmarshal(e.Value, &t); err != nil {
+			return nil, err
+		}
+		ranges, err := parsePortRanges(t.PortRanges)
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range ranges {
+			pools = append(pools, portPool{pr, t.Name})
+		}
+	}
+	ranges, err := parsePortRanges(splitQuery(Config.PortPool))
+	if err != nil {
+		return nil, err
+	}
+	for _, pr := range ranges {
+		pools = append(pools, portPool{pr, ""})
+	}
+	sort.SliceStable(pools, func(i, j int) bool {
+		return pools[i].lo < pools[j].lo
+	})
+	return pools, nil
+}
+
+// tenantOwnsPort is whether port lies in the range of some tenant.
+func tenantOwnsPort(pools []portPool, port uint16) bool {
+	for _, p := range pools {
+		if p.Tenant != "" && p.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolTenant is the tenant whose pools serve the entries of tenant: itself
+// when it has port ranges, otherwise those of port_pool.
+func poolTenant(pools []portPool, tenant string) string {
+	for _, p := range pools {
+		if p.Tenant == tenant {
+			return tenant
+		}
+	}
+	return ""
+}
+
+func reservedPorts() []portRange {
+	// checked by Validate.
+	ranges, _ := parsePortRanges(splitQuery(Config.PortReserved))
+	return ranges
+}
+
+type portUser struct {
+	Id string
+
+	ProxyType string
+
+	Tenant string
+
+	Trashed bool
+}
+
+// usedPorts maps the remote ports of the entries, those in the trash
+// included as they come back with their port, to who uses them. Reads do not
+// see the writes of their transaction, so the map is made once per
+// transaction; ports taken in it are in the claims of checkPortFree.
+func usedPorts(tx *nutsdb.Tx) (map[uint16][]portUser, error) {
+	if v, ok := txLocals.get(tx, "used-ports"); ok {
+		return v.(map[uint16][]portUser), nil
+	}
+	used := make(map[uint16][]portUser)
+	for _, b := range []string{bucket, trashBucket} {
+		entries, err := tx.GetAll(b)
+		if err == nutsdb.ErrBucketEmpty {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			var ae AuthDataEntity
+			if err := json.Unmarshal(e.Value, &ae); err != nil {
+				return nil, err
+			}
+			if ae.RemotePort == 0 || containsString(portlessTypes, ae.ProxyType) {
+				continue
+			}
+			used[ae.RemotePort] = append(used[ae.RemotePort], portUser{ae.Id, ae.ProxyType, ae.Tenant, b == trashBucket})
+		}
+	}
+	txLocals.set(tx, "used-ports", used)
+	return used, nil
+}
+
+// portTransport is what frps listens on for a proxy type; tcp and udp
+// proxies may share a port number.
+func portTransport(proxyType string) string {
+	if proxyType == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// allocatePort picks the lowest free port for a new entry of tenant. It runs
+// in the update transaction that writes the entry, which nutsdb runs one at a
+// time, so two adds never get the same port.
+func allocatePort(tx *nutsdb.Tx, tenant string) (uint16, error) {
+	pools, err := loadPortPools(tx)
+	if err != nil {
+		return 0, err
+	}
+	tenant = poolTenant(pools, tenant)
+	used, err := usedPorts(tx)
+	if err != nil {
+		return 0, err
+	}
+	reserved := reservedPorts()
+	found := false
+	for _, p := range pools {
+		if p.Tenant != tenant {
+			continue
+		}
+		found = true
+		for port := int(p.lo); port <= int(p.hi); port++ {
+			if len(used[uint16(port)]) > 0 || inPortRanges(reserved, uint16(port)) {
+				continue
+			}
+			if tenant == "" && tenantOwnsPort(pools, uint16(port)) {
+				continue
+			}
+			return uint16(port), nil
+		}
+	}
+	if !found {
+		return 0, errNoPortPool
+	}
+	return 0, errNoFreePort
+}
+
+// checkPortChange is checkPortFree for ae as it is about to be written, before
+// as it is, nil for a new entry. Like the quota, a port the entry has already
+// is not checked again.
+func checkPortChange(tx *nutsdb.Tx, ae, before *AuthDataEntity) error {
+	if before != nil && before.RemotePort == ae.RemotePort && portTransport(before.ProxyType) == portTransport(ae.ProxyType) {
+		return nil
+	}
+	return checkPortFree(tx, ae)
+}
+
+// checkPortFree refuses a remote port that is reserved or that another entry
+// of the same transport has, and claims it for ae in the transaction.
+func checkPortFree(tx *nutsdb.Tx, ae *AuthDataEntity) error {
+	if ae.RemotePort == 0 || containsString(portlessTypes, ae.ProxyType) {
+		return nil
+	}
+	if inPortRanges(reservedPorts(), ae.RemotePort) {
+		return &PortInUseError{ae.RemotePort, ""}
+	}
+	used, err := usedPorts(tx)
+	if err != nil {
+		return err
+	}
+	for _, u := range used[ae.RemotePort] {
+		if u.Id != ae.Id && portTransport(u.ProxyType) == portTransport(ae.ProxyType) {
+			id := u.Id
+			if u.Trashed {
+				id += " (in trash)"
+			}
+			return &PortInUseError{ae.RemotePort, id}
+		}
+	}
+	claim := fmt.Sprintf("port-claim/%s/%d", portTransport(ae.ProxyType), ae.RemotePort)
+	if id, ok := txLocals.get(tx, claim); ok && id.(string) != ae.Id {
+		return &PortInUseError{ae.RemotePort, id.(string)}
+	}
+	txLocals.set(tx, claim, ae.Id)
+	return nil
+}
+
+type PoolUsage struct {
+	Range string `json:"range"`
+
+	Tenant string `json:"tenant"`
+
+	Size int `json:"size"`
+
+	Allocated int `json:"allocated"`
+
+	Online int `json:"online"`
+
+	Reserved int `json:"reserved"`
+
+	Free int `json:"free"`
+
+	// 0 when the pool is full
+	NextFree uint16 `json:"next_free"`
+}
+
+type PortUsage struct {
+	Port uint16 `json:"port"`
+
+	// allocated or reserved
+	State string `json:"state"`
+
+	Ids []string `json:"ids,omitempty"`
+
+	Online bool `json:"online"`
+
+	// the pool the port is in, if any
+	Pool string `json:"pool"`
+
+	Tenant string `json:"tenant"`
+}
+
+// PortUsageServeHTTP maps the remote ports: per pool how many are allocated,
+// online, reserved and free, and every port that is not free. Users of a
+// tenant see the pools their entries come from and their own entries only.
+func PortUsageServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var pools []portPool
+	var used map[uint16][]portUser
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		var err error
+		if pools, err = loadPortPools(tx); err != nil {
+			return err
+		}
+		used, err = usedPorts(tx)
+		return err
+	}); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[PortUsage-1].", 500)
+		return
+	}
+	tenant := RequestPrincipal(r).Tenant
+	view := poolTenant(pools, tenant)
+	online := make(map[string]bool)
+	for _, p := range Online.List() {
+		online[p.Key] = true
+	}
+	reserved := reservedPorts()
+	poolOf := func(port uint16) *portPool {
+		for i := range pools {
+			if pools[i].contains(port) && (pools[i].Tenant != "" || !tenantOwnsPort(pools, port)) {
+				return &pools[i]
+			}
+		}
+		return nil
+	}
+	portsOut := []PortUsage{}
+	seen := make(map[uint16]bool)
+	add := func(port uint16, users []portUser) {
+		pu := PortUsage{Port: port, State: "allocated"}
+		if len(users) == 0 {
+			pu.State = "reserved"
+		}
+		for _, u := range users {
+			if tenant == "" || u.Tenant == tenant {
+				pu.Ids = append(pu.Ids, u.Id)
+			}
+			pu.Online = pu.Online || online[u.Id]
+		}
+		if p := poolOf(port); p != nil {
+			pu.Pool, pu.Tenant = p.String(), p.Tenant
+		}
+		if tenant != "" && (pu.Pool == "" || pu.Tenant != view) && len(pu.Ids) == 0 {
+			return
+		}
+		seen[port] = true
+		portsOut = append(portsOut, pu)
+	}
+	for port, users := range used {
+		add(port, users)
+	}
+	for _, p := range pools {
+		for port := int(p.lo); port <= int(p.hi); port++ {
+			if !seen[uint16(port)] && inPortRanges(reserved, uint16(port)) {
+				add(uint16(port), nil)
+			}
+		}
+	}
+	sort.Slice(portsOut, func(i, j int) bool {
+		return portsOut[i].Port < portsOut[j].Port
+	})
+	poolsOut := []PoolUsage{}
+	for _, p := range pools {
+		if tenant != "" && p.Tenant != view {
+			continue
+		}
+		pu := PoolUsage{Range: p.String(), Tenant: p.Tenant}
+		for port := int(p.lo); port <= int(p.hi); port++ {
+			if p.Tenant == "" && tenantOwnsPort(pools, uint16(port)) {
+				continue
+			}
+			pu.Size++
+			users := used[uint16(port)]
+			switch {
+			case len(users) > 0:
+				pu.Allocated++
+				for _, u := range users {
+					if online[u.Id] {
+						pu.Online++
+						break
+					}
+				}
+			case inPortRanges(reserved, uint16(port)):
+				pu.Reserved++
+			default:
+				pu.Free++
+				if pu.NextFree == 0 {
+					pu.NextFree = uint16(port)
+				}
+			}
+		}
+		poolsOut = append(poolsOut, pu)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code":  0,
+		"pools": poolsOut,
+		"count": len(portsOut),
+		"data":  portsOut,
+	})
+}
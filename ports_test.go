@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"testing"
+)
+
+func setupPorts(t *testing.T, pool, reserved string) {
+	t.Helper()
+	saved := Config
+	Config.PortPool = pool
+	Config.PortReserved = reserved
+	t.Cleanup(func() { Config = saved })
+	resetBuckets(t, bucket, trashBucket, tenantBucket)
+}
+
+func putTrash(t *testing.T, ae AuthDataEntity) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		val, err := json.Marshal(TrashEntry{AuthDataEntity: ae})
+		if err != nil {
+			return err
+		}
+		return tx.Put(trashBucket, []byte(ae.Id), val, 0)
+	})
+}
+
+func allocate(t *testing.T, tenant string) (uint16, error) {
+	t.Helper()
+	var port uint16
+	var err error
+	dbView(func(tx *nutsdb.Tx) error {
+		port, err = allocatePort(tx, tenant)
+		return nil
+	})
+	return port, err
+}
+
+func TestAllocatePort(t *testing.T) {
+	setupPorts(t, "7000-7007", "7001")
+	putTenant(t, Tenant{Name: "acme", PortRanges: []string{"7004-7005"}})
+	putTenant(t, Tenant{Name: "open"})
+	putEntries(t,
+		AuthDataEntity{Id: "a", ProxyType: "tcp", RemotePort: 7000},
+		// http entries have no remote port of their own.
+		AuthDataEntity{Id: "h", ProxyType: "http", RemotePort: 7002},
+	)
+	putTrash(t, AuthDataEntity{Id: "t", ProxyType: "udp", RemotePort: 7003})
+	cases := []struct {
+		tenant string
+		port   uint16
+	}{
+		{"", 7002},
+		// tenants without ranges share port_pool.
+		{"open", 7002},
+		{"unknown", 7002},
+		{"acme", 7004},
+	}
+	for _, c := range cases {
+		if port, err := allocate(t, c.tenant); err != nil || port != c.port {
+			t.Errorf("%q: got %d %v, want %d", c.tenant, port, err, c.port)
+		}
+	}
+	// port_pool skips the ranges of tenants.
+	putEntries(t,
+		AuthDataEntity{Id: "b", ProxyType: "tcp", RemotePort: 7002},
+		AuthDataEntity{Id: "c", ProxyType: "tcp", RemotePort: 7006},
+	)
+	if port, err := allocate(t, ""); err != nil || port != 7007 {
+		t.Errorf("got %d %v, want 7007", port, err)
+	}
+	putEntries(t,
+		AuthDataEntity{Id: "d", ProxyType: "tcp", RemotePort: 7007},
+		AuthDataEntity{Id: "e", Tenant: "acme", ProxyType: "tcp", RemotePort: 7004},
+		AuthDataEntity{Id: "f", Tenant: "acme", ProxyType: "tcp", RemotePort: 7005},
+	)
+	for _, tenant := range []string{"", "open", "acme"} {
+		if _, err := allocate(t, tenant); err != errNoFreePort {
+			t.Errorf("%q: got %v, want errNoFreePort", tenant, err)
+		}
+	}
+}
+
+func TestAllocatePortWithoutPool(t *testing.T) {
+	setupPorts(t, "", "")
+	putTenant(t, Tenant{Name: "acme", PortRanges: []string{"6000"}})
+	if _, err := allocate(t, "open"); err != errNoPortPool {
+		t.Errorf("got %v, want errNoPortPool", err)
+	}
+	if port, err := allocate(t, "acme"); err != nil || port != 6000 {
+		t.Errorf("acme: got %d %v", port, err)
+	}
+}
+
+func TestCheckPortFree(t *testing.T) {
+	setupPorts(t, "", "22,7100-7199")
+	putEntries(t, AuthDataEntity{Id: "a", ProxyType: "tcp", RemotePort: 6000})
+	putTrash(t, AuthDataEntity{Id: "t", ProxyType: "tcp", RemotePort: 6001})
+	cases := []struct {
+		ae  AuthDataEntity
+		err string
+	}{
+		{AuthDataEntity{Id: "n", ProxyType: "tcp", RemotePort: 6002}, ""},
+		{AuthDataEntity{Id: "n", ProxyType: "tcp", RemotePort: 6000}, "remote port 6000 is used by a"},
+		{AuthDataEntity{Id: "n", ProxyType: "stcp", RemotePort: 6000}, ""},
+		// tcp and udp listen on different sockets.
+		{AuthDataEntity{Id: "n", ProxyType: "udp", RemotePort: 6000}, ""},
+		{AuthDataEntity{Id: "a", ProxyType: "tcp", RemotePort: 6000}, ""},
+		{AuthDataEntity{Id: "n", ProxyType: "tcp", RemotePort: 6001}, "remote port 6001 is used by t (in trash)"},
+		{AuthDataEntity{Id: "n", ProxyType: "tcp", RemotePort: 22}, "remote port 22 is reserved"},
+		{AuthDataEntity{Id: "n", ProxyType: "udp", RemotePort: 7150}, "remote port 7150 is reserved"},
+	}
+	for _, c := range cases {
+		var err error
+		dbView(func(tx *nutsdb.Tx) error {
+			err = checkPortFree(tx, &c.ae)
+			return nil
+		})
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%+v: got %q, want %q", c.ae, got, c.err)
+		}
+	}
+}
+
+func TestCheckPortFreeClaims(t *testing.T) {
+	setupPorts(t, "", "")
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := checkPortFree(tx, &AuthDataEntity{Id: "x", ProxyType: "tcp", RemotePort: 6000}); err != nil {
+			t.Errorf("x: %v", err)
+		}
+		if err := checkPortFree(tx, &AuthDataEntity{Id: "x", ProxyType: "tcp", RemotePort: 6000}); err != nil {
+			t.Errorf("x again: %v", err)
+		}
+		if err := checkPortFree(tx, &AuthDataEntity{Id: "y", ProxyType: "tcp", RemotePort: 6000}); err == nil {
+			t.Error("y took the port claimed by x")
+		}
+		if err := checkPortFree(tx, &AuthDataEntity{Id: "z", ProxyType: "udp", RemotePort: 6000}); err != nil {
+			t.Errorf("z: %v", err)
+		}
+		return nil
+	})
+	// claims end with their transaction.
+	dbView(func(tx *nutsdb.Tx) error {
+		if err := checkPortFree(tx, &AuthDataEntity{Id: "y", ProxyType: "tcp", RemotePort: 6000}); err != nil {
+			t.Errorf("y in a new transaction: %v", err)
+		}
+		return nil
+	})
+}
+
+func TestCheckPortChange(t *testing.T) {
+	setupPorts(t, "", "6000")
+	before := &AuthDataEntity{Id: "a", ProxyType: "tcp", RemotePort: 6000}
+	cases := []struct {
+		ae    AuthDataEntity
+		ok    bool
+		title string
+	}{
+		{AuthDataEntity{Id: "a", ProxyType: "tcp", RemotePort: 6000, Memo: "x"}, true, "port kept"},
+		{AuthDataEntity{Id: "a", ProxyType: "stcp", RemotePort: 6000}, true, "same transport"},
+		{AuthDataEntity{Id: "a", ProxyType: "udp", RemotePort: 6000}, false, "other transport"},
+	}
+	for _, c := range cases {
+		var err error
+		dbView(func(tx *nutsdb.Tx) error {
+			err = checkPortChange(tx, &c.ae, before)
+			return nil
+		})
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.title, err)
+		}
+	}
+	dbView(func(tx *nutsdb.Tx) error {
+		if err := checkPortChange(tx, before, nil); err == nil {
+			t.Error("new entry on a reserved port accepted")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"mime"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var remindBucket = "remind"
+
+var remindCheckInterval = time.Hour
+
+var defaultRemindTpl = `{{define "subject"}}[frps-auth] {{.Entry.ProxyName}} {{if gt .DaysLeft 0}}expires in {{.DaysLeft}} day(s){{else}}has expired{{end}}{{end}}
+{{define "body"}}Hello,
+
+The frp proxy authorization below {{if gt .DaysLeft 0}}expires in {{.DaysLeft}} day(s){{else}}has expired{{end}}.
+
+  id:          {{.Entry.Id}}
+  proxy name:  {{.Entry.ProxyName}}
+  proxy type:  {{.Entry.ProxyType}}
+  remote port: {{.Entry.RemotePort}}
+  valid to:    {{.ValidTo}}
+  memo:        {{.Entry.Memo}}
+
+Please contact the administrator to extend it.
+{{end}}`
+
+// RemindRecord keeps the reminders already mailed for an entry, so that a restart
+// does not mail them again. It is reset when the entry's ValidTo changes.
+type RemindRecord struct {
+	ValidTo int64 `json:"auth_valid_to"`
+
+	Sent []int `json:"sent"`
+}
+
+type remindTplData struct {
+	Entry AuthDataEntity
+
+	DaysLeft int
+
+	ValidTo string
+}
+
+func remindDays() []int {
+	var days []int
+	for _, s := range strings.Split(Config.RemindDays, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		d, err := strconv.Atoi(s)
+		if err != nil || d < 0 {
+			Log.Warning(fmt.Sprintf("invalid remind_days item %q.", s))
+			continue
+		}
+		days = append(days, d)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(days)))
+	return days
+}
+
+func loadRemindTpl() (*template.Template, error) {
+	if Config.RemindTpl != "" {
+		return template.ParseFiles(Config.RemindTpl)
+	}
+	return template.New("remind").Parse(defaultRemindTpl)
+}
+
+func RunRemindScheduler() {
+	if Config.SmtpHost == "" {
+		Log.Info("smtp_host is not set, expiry reminders are off.")
+		return
+	}
+	tpl, err := loadRemindTpl()
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	ticker := time.NewTicker(remindCheckInterval)
+	defer ticker.Stop()
+	for {
+		checkReminders(tpl, time.Now())
+		<-ticker.C
+	}
+}
+
+func checkReminders(tpl *template.Template, now time.Time) {
+	days := remindDays()
+	if len(days) == 0 {
+		return
+	}
+	entries, err := loadAllAuth()
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+
+	for _, ae := range entries {
+		if ae.Email == "" || ae.Disabled {
+			continue
+		}
+		rr := getRemindRecord(ae)
+		validTo := time.Unix(0, ae.ValidTo*int64(time.Millisecond))
+		due := -1
+		for _, d := range days {
+			if now.Before(validTo.AddDate(0, 0, -d)) || containsInt(rr.Sent, d) {
+				continue
+			}
+			// several thresholds may be due at once (e.g. after a long downtime);
+			// only the closest one is mailed, the others are just marked as sent.
+			due = d
+			rr.Sent = append(rr.Sent, d)
+		}
+		if due < 0 {
+			continue
+		}
+		if err := sendReminder(tpl, ae, due); err != nil {
+			Log.Error(fmt.Sprintf("remind %s failed: %s", ae.Id, err))
+			continue
+		}
+		Log.Info("remind", ae.Id, ae.Email, due)
+		if err := putRemindRecord(ae.Id, rr); err != nil {
+			Log.Error(err)
+		}
+	}
+}
+
+func getRemindRecord(ae AuthDataEntity) RemindRecord {
+	rr := RemindRecord{ValidTo: ae.ValidTo}
+	_ = dbView(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(remindBucket, []byte(ae.Id))
+		if err != nil {
+			return err
+		}
+		var stored RemindRecord
+		if err := json.Unmarshal(e.Value, &stored); err != nil {
+			return err
+		}
+		if stored.ValidTo == ae.ValidTo {
+			rr = stored
+		}
+		return nil
+	})
+	return rr
+}
+
+func putRemindRecord(id string, rr RemindRecord) error {
+	val, err := json.Marshal(rr)
+	if err != nil {
+		return err
+	}
+	return dbUpdate(func(tx *nutsdb.Tx) error {
+		return tx.Put(remindBucket, []byte(id), val, 0)
+	})
+}
+
+func sendReminder(tpl *template.Template, ae AuthDataEntity, daysLeft int) error {
+	data := remindTplData{
+		Entry:    ae,
+		DaysLeft: daysLeft,
+		ValidTo:  time.Unix(0, ae.ValidTo*int64(time.Millisecond)).Format("2006-01-02"),
+	}
+	var subject, body bytes.Buffer
+	if err := tpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := tpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+	return sendMail([]string{ae.Email}, strings.TrimSpace(subject.String()), body.String())
+}
+
+func sendMail(to []string, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", Config.SmtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if Config.SmtpUsername != "" {
+		auth = smtp.PlainAuth("", Config.SmtpUsername, Config.SmtpPassword, Config.SmtpHost)
+	}
+	addr := net.JoinHostPort(Config.SmtpHost, Config.SmtpPort)
+	return smtp.SendMail(addr, auth, Config.SmtpFrom, to, msg.Bytes())
+}
+
+func containsInt(s []int, v int) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockSMTP is an SMTP server that keeps the mails it is sent.
+type mockSMTP struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	mails []string
+}
+
+func newMockSMTP(t *testing.T) *mockSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mockSMTP{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	saved := Config
+	Config.SmtpHost, Config.SmtpPort, _ = net.SplitHostPort(ln.Addr().String())
+	Config.SmtpFrom = "frps-auth@example.com"
+	t.Cleanup(func() {
+		Config = saved
+		ln.Close()
+	})
+	return s
+}
+
+func (s *mockSMTP) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	reply := func(line string) { c.Write([]byte(line + "\r\n")) }
+	reply("220 localhost")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, msg.String())
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// take returns the mails sent since the last call.
+func (s *mockSMTP) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.mails
+	s.mails = nil
+	return m
+}
+
+func TestRemindDays(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	cases := []struct {
+		in   string
+		want []int
+	}{
+		{"14,3,1,0", []int{14, 3, 1, 0}},
+		{"1, 7 ,30", []int{30, 7, 1}},
+		{"3,x,-1,,5", []int{5, 3}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		Config.RemindDays = c.in
+		if got := remindDays(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestCheckReminders(t *testing.T) {
+	smtp := newMockSMTP(t)
+	Config.RemindDays = "14,3,1,0"
+	tpl, err := loadRemindTpl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	day := 24 * time.Hour
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+	resetBuckets(t, bucket, remindBucket)
+	entry := AuthDataEntity{Id: "tcp-web-6000", ProxyName: "web", ProxyType: "tcp", RemotePort: 6000, Email: "ops@example.com"}
+	steps := []struct {
+		name    string
+		validTo time.Time
+		at      time.Time
+		subject string
+	}{
+		{"far ahead", now.Add(20 * day), now, ""},
+		{"first threshold", now.Add(20 * day), now.Add(7 * day), "web expires in 14 day(s)"},
+		{"same threshold again", now.Add(20 * day), now.Add(8 * day), ""},
+		// thresholds passed while the server was down, only the closest is mailed.
+		{"after a downtime", now.Add(20 * day), now.Add(19*day + time.Hour), "web expires in 1 day(s)"},
+		{"expired", now.Add(20 * day), now.Add(21 * day), "web has expired"},
+		{"nothing left", now.Add(20 * day), now.Add(30 * day), ""},
+		// a renewed entry starts over.
+		{"renewed", now.Add(40 * day), now.Add(30 * day), "web expires in 14 day(s)"},
+	}
+	for _, s := range steps {
+		e := entry
+		e.ValidTo = ms(s.validTo)
+		putEntries(t, e)
+		checkReminders(tpl, s.at)
+		mails := smtp.take()
+		if s.subject == "" {
+			if len(mails) != 0 {
+				t.Errorf("%s: got %d mails", s.name, len(mails))
+			}
+			continue
+		}
+		if len(mails) != 1 || !strings.Contains(mails[0], "Subject: [frps-auth] "+s.subject) || !strings.Contains(mails[0], "To: ops@example.com") {
+			t.Errorf("%s: got %q, want %q", s.name, mails, s.subject)
+		}
+	}
+}
+
+func TestCheckRemindersSkips(t *testing.T) {
+	smtp := newMockSMTP(t)
+	Config.RemindDays = "3"
+	tpl, _ := loadRemindTpl()
+	resetBuckets(t, bucket, remindBucket)
+	soon := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+	putEntries(t,
+		AuthDataEntity{Id: "no-mail", ProxyName: "a", ValidTo: soon},
+		AuthDataEntity{Id: "disabled", ProxyName: "b", ValidTo: soon, Email: "b@example.com", Disabled: true},
+	)
+	checkReminders(tpl, time.Now())
+	if mails := smtp.take(); len(mails) != 0 {
+		t.Errorf("got %q", mails)
+	}
+}
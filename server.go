@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"os"
+)
+
+type listenServer struct {
+	name   string
+	server *http.Server
+	ln     net.Listener
+}
+
+func (s *listenServer) Serve() error {
+	err := s.server.Serve(s.ln)
+	return fmt.Errorf("%s listener stopped: %s", s.name, err)
+}
+
+// createServers binds the admin listener and, when configured, a separate
+// listener for the frps plugin endpoint.
+func createServers() ([]*listenServer, error) {
+	separate := Config.SeparatePlugin()
+	admin, err := newListenServer("admin", newAdminRouter(!separate), Config.Address, Config.Port, "", Config.AdminTLS())
+	if err != nil {
+		return nil, err
+	}
+	servers := []*listenServer{admin}
+	if separate {
+		plugin, err := newListenServer("plugin", newPluginRouter(), Config.PluginAddress, Config.PluginPort, Config.PluginUnix, Config.PluginTLS())
+		if err != nil {
+			admin.ln.Close()
+			return nil, err
+		}
+		servers = append(servers, plugin)
+	}
+	return servers, nil
+}
+
+func newListenServer(name string, handler http.Handler, addr, port, unix string, ts TLSSettings) (*listenServer, error) {
+	tlsConfig, err := ts.TLSConfig(name, selfSignedHosts(addr))
+	if err != nil {
+		return nil, err
+	}
+	var ln net.Listener
+	if unix != "" {
+		// a stale socket from an unclean shutdown would make Listen fail.
+		if fi, statErr := os.Stat(unix); statErr == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(unix)
+		}
+		Log.Info(fmt.Sprintf("%s bind unix:%s", name, unix))
+		ln, err = net.Listen("unix", unix)
+	} else {
+		address := fmt.Sprintf("%s:%s", addr, port)
+		Log.Info(fmt.Sprintf("%s bind %s", name, address))
+		ln, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return &listenServer{
+		name: name,
+		ln:   ln,
+		server: &http.Server{
+			Handler:      handler,
+			ReadTimeout:  httpServerReadTimeout,
+			WriteTimeout: httpServerWriteTimeout,
+		},
+	}, nil
+}
+
+func newPluginRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Use(NewIPAllowMiddleware(Config.PluginAllowIPs).Middleware)
+	router.HandleFunc("/auth", RequireClientCert(RequirePluginToken(ServeHTTP), Config.PluginTLS())).Methods("POST")
+	router.HandleFunc("/healthz", HealthzServeHTTP).Methods("GET")
+	router.HandleFunc("/readyz", ReadyzServeHTTP).Methods("GET")
+	return router
+}
+
+func newAdminRouter(withPlugin bool) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(NewIPAllowMiddleware(Config.AdminAllowIPs).Middleware)
+	router.Use(AdminMetricsMiddleware("/auth"))
+	skip := []string{"/healthz", "/readyz", "/login", "/login.html", "/login-options", "/oidc/", "/layui/"}
+	if withPlugin {
+		skip = append(skip, "/auth")
+		router.HandleFunc("/auth", RequireClientCert(RequirePluginToken(ServeHTTP), Config.PluginTLS())).Methods("POST")
+	}
+	router.Use(NewHttpAuthMiddleware(Config.Username, Config.Password, skip...).Middleware)
+	router.HandleFunc("/healthz", HealthzServeHTTP).Methods("GET")
+	router.HandleFunc("/readyz", ReadyzServeHTTP).Methods("GET")
+	router.HandleFunc("/login", LoginServeHTTP).Methods("POST")
+	router.HandleFunc("/logout", LogoutServeHTTP).Methods("POST")
+	router.HandleFunc("/login-options", LoginOptionsServeHTTP).Methods("GET")
+	router.HandleFunc("/oidc/login", OidcLoginServeHTTP).Methods("GET")
+	router.HandleFunc("/oidc/callback", OidcCallbackServeHTTP).Methods("GET")
+	router.HandleFunc("/whoami", WhoamiServeHTTP).Methods("GET")
+	router.HandleFunc("/add-auth", RequireRole(RoleAdmin, AddAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/update-auth", RequireRole(RoleOperator, UpdateAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/delete-auth/{id}", RequireRole(RoleAdmin, DeleteAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/rotate-auth-key/{id}", RequireRole(RoleAdmin, RotateAuthKeyServeHTTP)).Methods("POST")
+	router.HandleFunc("/disable-auth/{id}", RequireRole(RoleOperator, DisableAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/enable-auth/{id}", RequireRole(RoleOperator, EnableAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/bulk-auth", RequireRole(RoleOperator, BulkAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/export-auth", RequireRole(RoleViewer, ExportAuthServeHTTP)).Methods("GET")
+	router.HandleFunc("/import-auth", RequireGlobalRole(RoleAdmin, ImportAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/list-auth", RequireRole(RoleViewer, ListAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/get-auth/{id}", RequireRole(RoleViewer, GetAuthServeHTTP)).Methods("GET")
+	router.HandleFunc("/get-auth-config/{id}", RequireRole(RoleViewer, GetAuthConfigServerHTTP)).Methods("GET")
+	router.HandleFunc("/auth-calendar.ics", RequireRole(RoleViewer, AuthCalendarServeHTTP)).Methods("GET")
+	router.Handle("/metrics", RequireGlobalRole(RoleViewer, MetricsHandler().ServeHTTP)).Methods("GET")
+	router.HandleFunc("/list-token", RequireRole(RoleViewer, ListTokenServeHTTP)).Methods("POST")
+	router.HandleFunc("/add-token", RequireRole(RoleViewer, AddTokenServeHTTP)).Methods("POST")
+	router.HandleFunc("/revoke-token/{id}", RequireRole(RoleViewer, RevokeTokenServeHTTP)).Methods("POST")
+	router.HandleFunc("/totp-status", RequireRole(RoleViewer, TotpStatusServeHTTP)).Methods("GET")
+	router.HandleFunc("/totp-enroll", RequireRole(RoleViewer, TotpEnrollServeHTTP)).Methods("POST")
+	router.HandleFunc("/totp-confirm", RequireRole(RoleViewer, TotpConfirmServeHTTP)).Methods("POST")
+	router.HandleFunc("/totp-disable", RequireRole(RoleViewer, TotpDisableServeHTTP)).Methods("POST")
+	router.HandleFunc("/totp-reset/{username}", RequireGlobalRole(RoleAdmin, TotpResetServeHTTP)).Methods("POST")
+	router.HandleFunc("/sync-status", RequireGlobalRole(RoleViewer, SyncStatusServeHTTP)).Methods("GET")
+	router.HandleFunc("/sync-now", RequireGlobalRole(RoleAdmin, SyncNowServeHTTP)).Methods("POST")
+	router.HandleFunc("/backup", RequireGlobalRole(RoleAdmin, BackupServeHTTP)).Methods("POST")
+	router.HandleFunc("/audit-log", RequireGlobalRole(RoleAdmin, AuditLogServeHTTP)).Methods("GET")
+	router.HandleFunc("/list-trash", RequireRole(RoleViewer, ListTrashServeHTTP)).Methods("POST")
+	router.HandleFunc("/restore-trash/{id}", RequireRole(RoleAdmin, RestoreTrashServeHTTP)).Methods("POST")
+	router.HandleFunc("/purge-trash/{id}", RequireRole(RoleAdmin, PurgeTrashServeHTTP)).Methods("POST")
+	router.HandleFunc("/auth-history/{id}", RequireRole(RoleViewer, AuthHistoryServeHTTP)).Methods("GET")
+	router.HandleFunc("/auth-diff/{id}", RequireRole(RoleViewer, AuthDiffServeHTTP)).Methods("GET")
+	router.HandleFunc("/restore-auth/{id}/{rev}", RequireRole(RoleOperator, RestoreAuthServeHTTP)).Methods("POST")
+	router.HandleFunc("/list-lockout", RequireGlobalRole(RoleAdmin, ListLockoutServeHTTP)).Methods("POST")
+	router.HandleFunc("/clear-lockout", RequireGlobalRole(RoleAdmin, ClearLockoutServeHTTP)).Methods("POST")
+	router.HandleFunc("/list-plugin-ban", RequireGlobalRole(RoleViewer, ListPluginBanServeHTTP)).Methods("POST")
+	router.HandleFunc("/clear-plugin-ban", RequireGlobalRole(RoleOperator, ClearPluginBanServeHTTP)).Methods("POST")
+	router.HandleFunc("/list-user", RequireGlobalRole(RoleAdmin, ListUserServeHTTP)).Methods("POST")
+	router.HandleFunc("/add-user", RequireGlobalRole(RoleAdmin, AddUserServeHTTP)).Methods("POST")
+	router.HandleFunc("/update-user", RequireGlobalRole(RoleAdmin, UpdateUserServeHTTP)).Methods("POST")
+	router.HandleFunc("/delete-user/{username}", RequireGlobalRole(RoleAdmin, DeleteUserServeHTTP)).Methods("POST")
+	router.HandleFunc("/port-usage", RequireRole(RoleViewer, PortUsageServeHTTP)).Methods("GET")
+	router.HandleFunc("/list-tenant", RequireGlobalRole(RoleAdmin, ListTenantServeHTTP)).Methods("POST")
+	router.HandleFunc("/put-tenant", RequireGlobalRole(RoleAdmin, PutTenantServeHTTP)).Methods("POST")
+	router.HandleFunc("/delete-tenant/{name}", RequireGlobalRole(RoleAdmin, DeleteTenantServeHTTP)).Methods("POST")
+	router.PathPrefix("/").Handler(MakeHttpGzipHandler(http.StripPrefix("/", http.FileServer(getStaticFS(Config.Static))))).Methods("GET")
+	return router
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "frps_auth_session"
+	csrfCookie    = "frps_auth_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+type ctxKey int
+
+const ctxPrincipalKey ctxKey = 0
+
+// Session is a logged in admin. Sessions live in memory only; a restart logs
+// everybody out.
+type Session struct {
+	Id       string
+	User     string
+	Role     string
+	Provider string
+	Tenant   string
+	CSRF     string
+	Created  time.Time
+	LastSeen time.Time
+}
+
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+var Sessions = &SessionStore{sessions: make(map[string]*Session)}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *SessionStore) Create(p Principal) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, ss := range s.sessions {
+		if s.expired(ss, now) {
+			delete(s.sessions, id)
+		}
+	}
+	ss := &Session{
+		Id:       randomToken(),
+		User:     p.User,
+		Role:     p.Role,
+		Provider: p.Provider,
+		Tenant:   p.Tenant,
+		CSRF:     randomToken(),
+		Created:  now,
+		LastSeen: now,
+	}
+	s.sessions[ss.Id] = ss
+	return ss
+}
+
+// Get returns the session and refreshes its idle timer, or nil when it is
+// unknown or has timed out.
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if s.expired(ss, now) {
+		delete(s.sessions, id)
+		return nil
+	}
+	ss.LastSeen = now
+	copied := *ss
+	return &copied
+}
+
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// DeleteUser logs out every session of user.
+func (s *SessionStore) DeleteUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ss := range s.sessions {
+		if ss.User == user {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *SessionStore) expired(ss *Session, now time.Time) bool {
+	return now.Sub(ss.LastSeen) > Config.SessionIdleTimeout || now.Sub(ss.Created) > Config.SessionMaxAge
+}
+
+// sessionFromRequest returns the session of the cookie and whether the request
+// passes the CSRF check. Safe methods need no token; the others must echo the
+// session's token in the X-CSRF-Token header.
+func sessionFromRequest(r *http.Request) (*Session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	ss := Sessions.Get(c.Value)
+	if ss == nil {
+		return nil, false
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return ss, true
+	}
+	return ss, r.Header.Get(csrfHeader) != "" && constantTimeEqual(r.Header.Get(csrfHeader), ss.CSRF)
+}
+
+func withPrincipal(r *http.Request, p Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxPrincipalKey, p))
+}
+
+// RequestPrincipal is who a request was authenticated as; the zero Principal
+// has no role at all.
+func RequestPrincipal(r *http.Request) Principal {
+	p, _ := r.Context().Value(ctxPrincipalKey).(Principal)
+	return p
+}
+
+// RequestUser is the admin a request was authenticated as, if any.
+func RequestUser(r *http.Request) string {
+	return RequestPrincipal(r).User
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, ss *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    ss.Id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// readable by the UI scripts, which send it back in the X-CSRF-Token header.
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    ss.CSRF,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  "",
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+
+	Password string `json:"password"`
+
+	// TOTP or recovery code, for users with a second factor
+	Code string `json:"code"`
+}
+
+func LoginServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var lr LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	keys := loginLockoutKeys(r, lr.Username)
+	if lockedOut(w, r, keys...) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	p, ok := authenticate(lr.Username, lr.Password)
+	if !ok {
+		Lockouts.Fail(keys...)
+		Log.Warning(fmt.Sprintf("%s login from %s failed.", lr.Username, r.RemoteAddr))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"status":1}`)
+		return
+	}
+	if totpEnabled(p.User) {
+		if lr.Code == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":2,"totp_required":true}`)
+			return
+		}
+		if !verifySecondFactor(p.User, strings.TrimSpace(lr.Code)) {
+			Lockouts.Fail(keys...)
+			Log.Warning(fmt.Sprintf("%s login from %s bad totp code.", lr.Username, r.RemoteAddr))
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"status":3}`)
+			return
+		}
+	}
+	Lockouts.Clear("user:" + lr.Username)
+	ss := Sessions.Create(p)
+	Log.Info("login", lr.Username, r.RemoteAddr)
+	setSessionCookies(w, r, ss)
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+func LogoutServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		Sessions.Delete(c.Value)
+	}
+	Log.Info("logout", RequestUser(r))
+	clearSessionCookies(w)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
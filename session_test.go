@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUser answers with the user the request was authenticated as.
+var echoUser = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(RequestUser(r)))
+})
+
+func login(t *testing.T, user, passwd string) (*httptest.ResponseRecorder, *Session) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	LoginServeHTTP(rec, httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"`+user+`","password":"`+passwd+`"}`)))
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return rec, Sessions.Get(c.Value)
+		}
+	}
+	return rec, nil
+}
+
+func TestLogin(t *testing.T) {
+	rec, ss := login(t, Config.Username, Config.Password)
+	if rec.Code != 200 || ss == nil || ss.User != Config.Username {
+		t.Fatalf("got %d %+v", rec.Code, ss)
+	}
+	var csrf *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		switch c.Name {
+		case sessionCookie:
+			if !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+				t.Errorf("session cookie %+v", c)
+			}
+		case csrfCookie:
+			csrf = c
+		}
+	}
+	if csrf == nil || csrf.HttpOnly || csrf.Value != ss.CSRF {
+		t.Errorf("csrf cookie %+v", csrf)
+	}
+	if rec, ss := login(t, Config.Username, "wrong"); rec.Code != http.StatusUnauthorized || ss != nil {
+		t.Errorf("wrong password: %d %+v", rec.Code, ss)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	_, ss := login(t, Config.Username, Config.Password)
+	h := NewHttpAuthMiddleware(Config.Username, Config.Password, "/auth", "/public/").Middleware(echoUser)
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		prepare func(r *http.Request)
+		code    int
+		user    string
+	}{
+		{"session GET", "GET", "/list-auth", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ss.Id})
+		}, 200, Config.Username},
+		{"session POST without token", "POST", "/add-auth", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ss.Id})
+		}, 403, ""},
+		{"session POST with wrong token", "POST", "/add-auth", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ss.Id})
+			r.Header.Set(csrfHeader, "x"+ss.CSRF)
+		}, 403, ""},
+		{"session POST with token", "POST", "/add-auth", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ss.Id})
+			r.Header.Set(csrfHeader, ss.CSRF)
+		}, 200, Config.Username},
+		{"unknown session", "GET", "/list-auth", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "nope"})
+			r.Header.Set("X-Requested-With", "XMLHttpRequest")
+		}, 401, ""},
+		// basic auth needs no CSRF token, browsers do not send it on their own.
+		{"basic auth", "POST", "/add-auth", func(r *http.Request) {
+			r.SetBasicAuth(Config.Username, Config.Password)
+		}, 200, Config.Username},
+		{"wrong basic auth", "GET", "/list-auth", func(r *http.Request) {
+			r.SetBasicAuth(Config.Username, "wrong")
+		}, 401, ""},
+		{"browser page", "GET", "/index.html", func(r *http.Request) {
+			r.Header.Set("Accept", "text/html,*/*")
+		}, 302, ""},
+		{"skipped path", "POST", "/auth", func(r *http.Request) {}, 200, ""},
+		{"skipped prefix", "GET", "/public/x", func(r *http.Request) {}, 200, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		c.prepare(r)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != c.code {
+			t.Errorf("%s: got %d, want %d", c.name, rec.Code, c.code)
+			continue
+		}
+		if c.code == 200 && rec.Body.String() != c.user {
+			t.Errorf("%s: user %q, want %q", c.name, rec.Body, c.user)
+		}
+	}
+	// scripts get a bare 401 so that the browser does not prompt.
+	r := httptest.NewRequest("GET", "/list-auth", nil)
+	r.Header.Set("X-Requested-With", "XMLHttpRequest")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Header().Get("WWW-Authenticate") != "" {
+		t.Error("basic auth prompt for a script")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+	Config.SessionIdleTimeout = time.Hour
+	Config.SessionMaxAge = 2 * time.Hour
+	ss := Sessions.Create(Principal{User: Config.Username, Role: RoleAdmin})
+	Sessions.mu.Lock()
+	Sessions.sessions[ss.Id].LastSeen = time.Now().Add(-time.Hour - time.Minute)
+	Sessions.mu.Unlock()
+	if Sessions.Get(ss.Id) != nil {
+		t.Error("idle session still valid")
+	}
+	ss = Sessions.Create(Principal{User: Config.Username, Role: RoleAdmin})
+	Sessions.mu.Lock()
+	Sessions.sessions[ss.Id].Created = time.Now().Add(-3 * time.Hour)
+	Sessions.mu.Unlock()
+	if Sessions.Get(ss.Id) != nil {
+		t.Error("session past its max age still valid")
+	}
+	ss = Sessions.Create(Principal{User: Config.Username, Role: RoleAdmin})
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: ss.Id})
+	LogoutServeHTTP(httptest.NewRecorder(), r)
+	if Sessions.Get(ss.Id) != nil {
+		t.Error("session valid after logout")
+	}
+}
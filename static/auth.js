@@ -0,0 +1,28 @@
+// 后台页面公用：请求时带上CSRF令牌；会话过期时跳转到登录页
+(function () {
+    function csrfToken() {
+        var m = document.cookie.match(/(?:^|;\s*)frps_auth_csrf=([^;]*)/);
+        return m ? decodeURIComponent(m[1]) : '';
+    }
+
+    window.csrfToken = csrfToken;
+
+    var rawFetch = window.fetch;
+    window.fetch = function (input, init) {
+        init = init || {};
+        var headers = new Headers(init.headers || {});
+        headers.set('X-CSRF-Token', csrfToken());
+        headers.set('X-Requested-With', 'fetch');
+        init.headers = headers;
+        init.credentials = init.credentials || 'same-origin';
+        return rawFetch(input, init).then(function (resp) {
+            if (resp.status === 401) {
+                top.location.href = '/login.html';
+            } else if (resp.status === 403) {
+                var layer = window.layui && layui.layer;
+                layer ? layer.msg('没有权限') : alert('没有权限');
+            }
+            return resp;
+        });
+    };
+})();
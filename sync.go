@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/xujiajun/nutsdb"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncEntry is an entry as declared in a sync file. The auth key may be left
+// out; a new entry then gets a generated one and an existing entry keeps its
+// own.
+type SyncEntry struct {
+	ProxyName string `yaml:"proxy_name" toml:"proxy_name"`
+
+	ProxyType string `yaml:"proxy_type" toml:"proxy_type"`
+
+	RemotePort uint16 `yaml:"remote_port" toml:"remote_port"`
+
+	// unix millis or 2006-01-02
+	ValidTo string `yaml:"auth_valid_to" toml:"auth_valid_to"`
+
+	Memo string `yaml:"memo" toml:"memo"`
+
+	Email string `yaml:"email" toml:"email"`
+
+	Owner string `yaml:"owner" toml:"owner"`
+
+	Contact string `yaml:"contact" toml:"contact"`
+
+	Tags map[string]string `yaml:"tags" toml:"tags"`
+
+	Tenant string `yaml:"tenant" toml:"tenant"`
+
+	Disabled bool `yaml:"disabled" toml:"disabled"`
+
+	AuthKey string `yaml:"auth_key" toml:"auth_key"`
+}
+
+type syncFile struct {
+	Entries []SyncEntry `yaml:"entries" toml:"entries"`
+}
+
+// SyncChange is what a sync does, or would do, to one entry.
+type SyncChange struct {
+	Id string `json:"id"`
+
+	// create, update, disable or delete
+	Action string `json:"action"`
+
+	Source string `json:"source"`
+
+	Changes map[string]AuditChange `json:"changes,omitempty"`
+
+	entity *AuthDataEntity
+}
+
+type SyncStatus struct {
+	Path string `json:"path"`
+
+	Prune bool `json:"prune"`
+
+	// unix millis
+	LastSync int64 `json:"last_sync"`
+
+	LastCheck int64 `json:"last_check"`
+
+	LastError string `json:"last_error"`
+
+	Entries int `json:"entries"`
+
+	Applied int `json:"applied"`
+
+	// what a sync would change now; empty when the store matches the files
+	Drift []SyncChange `json:"drift"`
+}
+
+var syncState = struct {
+	sync.Mutex
+	SyncStatus
+	fingerprint string
+}{}
+
+var syncExts = []string{".yaml", ".yml", ".toml"}
+
+// readSyncFiles reads sync_path, a file or a directory of files, and
+// fingerprints the content so that a poll can tell whether it changed.
+func readSyncFiles(path string) (map[string][]byte, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", err
+	}
+	var names []string
+	if info.IsDir() {
+		fis, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, fi := range fis {
+			if !fi.IsDir() && containsString(syncExts, strings.ToLower(filepath.Ext(fi.Name()))) {
+				names = append(names, filepath.Join(path, fi.Name()))
+			}
+		}
+	} else {
+		names = []string{path}
+	}
+	sort.Strings(names)
+	files := make(map[string][]byte)
+	h := sha256.New()
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, "", err
+		}
+		files[filepath.Base(name)] = data
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(name), len(data))
+		h.Write(data)
+	}
+	return files, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseSyncFiles turns the files into the declared entries by id. Any error
+// fails the whole sync, a half applied file is worse than none.
+func parseSyncFiles(files map[string][]byte) (map[string]TransferEntry, map[string]string, error) {
+	declared := make(map[string]TransferEntry)
+	sources := make(map[string]string)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var sf syncFile
+		var err error
+		if strings.ToLower(filepath.Ext(name)) == ".toml" {
+			_, err = toml.NewDecoder(bytes.NewReader(files[name])).Decode(&sf)
+		} else {
+			err = yaml.Unmarshal(files[name], &sf)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for i, se := range sf.Entries {
+			te := TransferEntry{
+				ProxyName:  se.ProxyName,
+				ProxyType:  se.ProxyType,
+				RemotePort: se.RemotePort,
+				Memo:       se.Memo,
+				Email:      se.Email,
+				Owner:      se.Owner,
+				Contact:    se.Contact,
+				Tags:       se.Tags,
+				Tenant:     se.Tenant,
+				Disabled:   se.Disabled,
+				AuthKey:    se.AuthKey,
+			}
+			if se.ValidTo != "" {
+				if te.ValidTo, err = parseValidTo(se.ValidTo); err != nil {
+					return nil, nil, fmt.Errorf("%s entry %d: %s", name, i+1, err)
+				}
+			}
+			if err := te.validate(); err != nil {
+				return nil, nil, fmt.Errorf("%s entry %d: %s", name, i+1, err)
+			}
+			id := te.key()
+			if src, ok := sources[id]; ok {
+				return nil, nil, fmt.Errorf("%s entry %d: %s is declared in %s already", name, i+1, id, src)
+			}
+			declared[id] = te
+			sources[id] = name
+		}
+	}
+	return declared, sources, nil
+}
+
+// syncPlan compares the store with the declared entries. Declared entries
+// are created or updated, taking over entries made by hand; entries that were
+// synced before and are no longer declared are disabled and handed back to the
+// UI, or with prune moved to the trash. Entries made by hand are never touched
+// otherwise.
+func syncPlan(tx *nutsdb.Tx, declared map[string]TransferEntry, sources map[string]string, prune bool) ([]SyncChange, error) {
+	current := make(map[string]AuthDataEntity)
+	entries, err := tx.GetAll(bucket)
+	if err != nil && err != nutsdb.ErrBucketEmpty {
+		return nil, err
+	}
+	for _, e := range entries {
+		var ae AuthDataEntity
+		if err := json.Unmarshal(e.Value, &ae); err != nil {
+			return nil, err
+		}
+		current[ae.Id] = ae
+	}
+	var plan []SyncChange
+	for id, te := range declared {
+		cur, exists := current[id]
+		if te.AuthKey == "" {
+			te.AuthKey = cur.AuthKey
+		}
+		want := te.entity()
+		want.Managed = sources[id]
+		if !exists {
+			plan = append(plan, SyncChange{Id: id, Action: "create", Source: want.Managed, entity: &want})
+			continue
+		}
+		if changes := auditChanges(&cur, &want); len(changes) > 0 {
+			plan = append(plan, SyncChange{Id: id, Action: "update", Source: want.Managed, Changes: changes, entity: &want})
+		}
+	}
+	for id, cur := range current {
+		if _, ok := declared[id]; ok || cur.Managed == "" {
+			continue
+		}
+		if prune {
+			plan = append(plan, SyncChange{Id: id, Action: "delete", Source: cur.Managed})
+		} else {
+			want := cur
+			want.Disabled = true
+			want.Managed = ""
+			plan = append(plan, SyncChange{Id: id, Action: "disable", Source: cur.Managed, Changes: auditChanges(&cur, &want), entity: &want})
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].Id < plan[j].Id
+	})
+	return plan, nil
+}
+
+func applySyncPlan(tx *nutsdb.Tx, plan []SyncChange) error {
+	for _, c := range plan {
+		if c.Action == "delete" {
+			if err := trashAuth(tx, nil, c.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.entity.AuthKey == "" {
+			c.entity.AuthKey = createSignKey()
+			signBody := &SignBody{
+				ProxyType:  c.entity.ProxyType,
+				RemotePort: c.entity.RemotePort,
+				Subdomain:  c.entity.ProxyName,
+				AuthKey:    c.entity.AuthKey,
+				ValidTo:    strconv.FormatInt(c.entity.ValidTo, 10),
+			}
+			c.entity.Sign = signBody.Sign()
+		}
+		var before *AuthDataEntity
+		if e, err := tx.Get(bucket, []byte(c.Id)); err == nil {
+			before = &AuthDataEntity{}
+			if err := json.Unmarshal(e.Value, before); err != nil {
+				return err
+			}
+		}
+		// a QuotaError fails the whole sync, unknown tenants included.
+		if err := checkQuota(tx, c.entity, before); err != nil {
+			return err
+		}
+		if err := checkPortChange(tx, c.entity, before); err != nil {
+			return err
+		}
+		val, err := json.Marshal(c.entity)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(bucket, []byte(c.Id), val, 0); err != nil {
+			return err
+		}
+		if err := recordChange(tx, nil, "sync", c.Id, before, c.entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSync reads the files and, when they changed or force is set, applies
+// them. Either way the drift between files and store is updated.
+func runSync(force bool) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	syncState.Lock()
+	defer syncState.Unlock()
+	syncState.Path = Config.SyncPath
+	syncState.Prune = Config.SyncPrune
+	syncState.LastCheck = now
+	fail := func(err error) error {
+		syncState.LastError = err.Error()
+		return err
+	}
+	files, fingerprint, err := readSyncFiles(Config.SyncPath)
+	if err != nil {
+		return fail(err)
+	}
+	declared, sources, err := parseSyncFiles(files)
+	if err != nil {
+		return fail(err)
+	}
+	syncState.Entries = len(declared)
+	if force || fingerprint != syncState.fingerprint {
+		applied := 0
+		if err := dbUpdate(func(tx *nutsdb.Tx) error {
+			plan, err := syncPlan(tx, declared, sources, Config.SyncPrune)
+			if err != nil {
+				return err
+			}
+			applied = len(plan)
+			return applySyncPlan(tx, plan)
+		}); err != nil {
+			return fail(err)
+		}
+		if applied > 0 {
+			Log.Info(fmt.Sprintf("sync applied %d changes from %s", applied, Config.SyncPath))
+		}
+		syncState.fingerprint = fingerprint
+		syncState.LastSync = now
+		syncState.Applied = applied
+	}
+	var drift []SyncChange
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		drift, err = syncPlan(tx, declared, sources, Config.SyncPrune)
+		return err
+	}); err != nil {
+		return fail(err)
+	}
+	if len(drift) > 0 && len(syncState.Drift) == 0 {
+		Log.Warning(fmt.Sprintf("store drifted from %s on %d entries", Config.SyncPath, len(drift)))
+	}
+	syncState.Drift = drift
+	syncDrift.Set(float64(len(drift)))
+	syncState.LastError = ""
+	return nil
+}
+
+func RunSync() {
+	if Config.SyncPath == "" {
+		return
+	}
+	ticker := time.NewTicker(Config.SyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := runSync(false); err != nil {
+			Log.Error(fmt.Sprintf("sync %s failed: %s", Config.SyncPath, err))
+		}
+		<-ticker.C
+	}
+}
+
+func SyncStatusServeHTTP(w http.ResponseWriter, r *http.Request) {
+	syncState.Lock()
+	status := syncState.SyncStatus
+	syncState.Unlock()
+	if status.Drift == nil {
+		status.Drift = []SyncChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled": Config.SyncPath != "",
+		"status":  status,
+	})
+}
+
+// SyncNowServeHTTP applies the files right away, also undoing drift while
+// they did not change.
+func SyncNowServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if Config.SyncPath == "" {
+		http.Error(w, "sync_path is not set", 400)
+		return
+	}
+	Log.Info("sync by", RequestUser(r))
+	if err := runSync(true); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyncFiles(t *testing.T) {
+	yml := "entries:\n  - proxy_name: ssh\n    proxy_type: tcp\n    remote_port: 6000\n    auth_valid_to: 2099-01-02\n"
+	tml := "[[entries]]\nproxy_name = \"www\"\nproxy_type = \"http\"\nauth_valid_to = \"4070908800000\"\n"
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		ids   []string
+		err   string
+	}{
+		{"yaml and toml", map[string][]byte{"a.yaml": []byte(yml), "b.toml": []byte(tml)}, []string{"tcp-ssh-6000", TransferEntry{ProxyName: "www", ProxyType: "http"}.key()}, ""},
+		{"declared twice", map[string][]byte{"a.yaml": []byte(yml), "b.yml": []byte(yml)}, nil, "b.yml entry 1: tcp-ssh-6000 is declared in a.yaml already"},
+		{"bad date", map[string][]byte{"a.yaml": []byte(strings.Replace(yml, "2099-01-02", "soon", 1))}, nil, "a.yaml entry 1: "},
+		{"bad type", map[string][]byte{"a.yaml": []byte(strings.Replace(yml, "tcp", "ssh", 1))}, nil, "a.yaml entry 1: invalid proxy_type"},
+		{"bad syntax", map[string][]byte{"b.toml": []byte("[[entries]\n")}, nil, "b.toml: "},
+	}
+	for _, c := range cases {
+		declared, sources, err := parseSyncFiles(c.files)
+		if c.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+				t.Errorf("%s: got %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil || len(declared) != len(c.ids) {
+			t.Errorf("%s: got %v %v", c.name, err, declared)
+			continue
+		}
+		for _, id := range c.ids {
+			if _, ok := declared[id]; !ok || sources[id] == "" {
+				t.Errorf("%s: %s not declared", c.name, id)
+			}
+		}
+	}
+}
+
+// useSyncFile points sync_path at a file with content.
+func useSyncFile(t *testing.T, prune bool) func(content string) {
+	t.Helper()
+	saved := Config
+	t.Cleanup(func() { Config = saved })
+	Config.SyncPath = filepath.Join(t.TempDir(), "entries.yaml")
+	Config.SyncPrune = prune
+	return func(content string) {
+		if err := ioutil.WriteFile(Config.SyncPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const syncTwo = `entries:
+  - proxy_name: a
+    proxy_type: tcp
+    remote_port: 6600
+    auth_valid_to: 2099-01-02
+  - proxy_name: b
+    proxy_type: tcp
+    remote_port: 6601
+    auth_valid_to: 2099-01-02
+    auth_key: bkey
+`
+
+func TestRunSync(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket)
+	write := useSyncFile(t, false)
+	hand := signedEntry("hand", "tcp", 6602, "k", time.Hour)
+	putEntries(t, hand)
+	write(syncTwo)
+	if err := runSync(false); err != nil {
+		t.Fatal(err)
+	}
+	a, okA := getEntry(t, "tcp-a-6600")
+	b, okB := getEntry(t, "tcp-b-6601")
+	if !okA || !okB || a.AuthKey == "" || b.AuthKey != "bkey" || a.Managed != "entries.yaml" {
+		t.Fatalf("got %+v %+v", a, b)
+	}
+	if reject, reason := callPlugin(t, "NewProxy", pluginContent(b, "bkey", "r1")); reject {
+		t.Errorf("synced entry rejected: %s", reason)
+	}
+	// synced entries are read-only through the API.
+	vars := map[string]string{"id": a.Id}
+	readOnly := []struct {
+		name string
+		code int
+	}{
+		{"disable", serve(DisableAuthServeHTTP, "POST", "/disable-auth/"+a.Id, vars, "", RoleOperator).Code},
+		{"rotate", serve(RotateAuthKeyServeHTTP, "POST", "/rotate-auth-key/"+a.Id, vars, "", RoleAdmin).Code},
+		{"delete", serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+a.Id, vars, "", RoleAdmin).Code},
+		{"add over", serve(AddAuthServeHTTP, "POST", "/add-auth", nil, `{"proxy_name":"a","proxy_type":"tcp","remote_port":6600,"auth_valid_to":4070908800000}`, RoleAdmin).Code},
+	}
+	for _, c := range readOnly {
+		if c.code != 409 {
+			t.Errorf("%s a synced entry: %d", c.name, c.code)
+		}
+	}
+	if got, _ := getEntry(t, a.Id); !reflect.DeepEqual(got, a) {
+		t.Errorf("synced entry changed: %+v", got)
+	}
+	// a change behind the sync's back is drift until the next forced sync.
+	changed := a
+	changed.Memo = "by hand"
+	putEntries(t, changed)
+	runSync(false)
+	if len(syncState.Drift) != 1 || syncState.Drift[0].Action != "update" || syncState.Drift[0].Id != a.Id {
+		t.Errorf("drift %+v", syncState.Drift)
+	}
+	if got, _ := getEntry(t, a.Id); got.Memo != "by hand" {
+		t.Error("unchanged files applied again")
+	}
+	runSync(true)
+	if got, _ := getEntry(t, a.Id); got.Memo != "" || got.AuthKey != a.AuthKey || len(syncState.Drift) != 0 {
+		t.Errorf("forced sync: %+v, drift %+v", got, syncState.Drift)
+	}
+	// an entry dropped from the files is disabled and handed back.
+	write(syncTwo[:strings.Index(syncTwo, "  - proxy_name: b")])
+	runSync(false)
+	if got, _ := getEntry(t, b.Id); !got.Disabled || got.Managed != "" {
+		t.Errorf("dropped entry: %+v", got)
+	}
+	if got, ok := getEntry(t, hand.Id); !ok || !reflect.DeepEqual(got, hand) {
+		t.Errorf("entry made by hand changed: %+v", got)
+	}
+}
+
+func TestRunSyncPrune(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket)
+	write := useSyncFile(t, true)
+	write(syncTwo)
+	runSync(false)
+	write(syncTwo[:strings.Index(syncTwo, "  - proxy_name: b")])
+	if err := runSync(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getEntry(t, "tcp-b-6601"); ok {
+		t.Error("pruned entry kept")
+	}
+	if ids := trashIds(t); len(ids) != 1 || ids[0] != "tcp-b-6601" {
+		t.Errorf("trash %v", ids)
+	}
+	// a broken file changes nothing.
+	write("entries: [")
+	if err := runSync(true); err == nil || syncState.LastError == "" {
+		t.Errorf("got %v", err)
+	}
+	if _, ok := getEntry(t, "tcp-a-6600"); !ok {
+		t.Error("entry lost on a broken file")
+	}
+}
+
+func TestRunSyncQuota(t *testing.T) {
+	resetBuckets(t, bucket, tenantBucket)
+	write := useSyncFile(t, false)
+	putTenant(t, Tenant{Name: "acme", PortRanges: []string{"6600"}})
+	write(strings.Replace(syncTwo, "    auth_valid_to", "    tenant: acme\n    auth_valid_to", -1))
+	if err := runSync(false); err == nil || !strings.Contains(err.Error(), "6601") {
+		t.Errorf("quota: got %v", err)
+	}
+	write(strings.Replace(syncTwo, "    auth_valid_to", "    tenant: nope\n    auth_valid_to", 1))
+	if err := runSync(false); err == nil {
+		t.Error("unknown tenant accepted")
+	}
+	if _, ok := getEntry(t, "tcp-a-6600"); ok {
+		t.Error("failed sync applied")
+	}
+}
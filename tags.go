@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tags are key=value labels to group entries by, like customer=acme or
+// env=prod. Keys are short identifiers; values may not hold the separators of
+// the text form.
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-/]{0,62}$`)
+
+func validateTags(tags map[string]string) error {
+	for k, v := range tags {
+		if !tagKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid tag key %q", k)
+		}
+		if len(v) > 255 || strings.ContainsAny(v, ",=\r\n") {
+			return fmt.Errorf("invalid value of tag %s", k)
+		}
+	}
+	return nil
+}
+
+// parseTags reads the text form k=v,k=v as used in CSV files and forms.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("tag %q is not key=value", part)
+		}
+		tags[strings.TrimSpace(part[:i])] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, validateTags(tags)
+}
+
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + tags[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+// matchTags checks selectors of the form key=value, or key for any value;
+// all of them have to match.
+func matchTags(tags map[string]string, selectors []string) bool {
+	for _, s := range selectors {
+		if i := strings.Index(s, "="); i >= 0 {
+			if v, ok := tags[s[:i]]; !ok || v != s[i+1:] {
+				return false
+			}
+		} else if _, ok := tags[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	cases := []struct {
+		in   string
+		want map[string]string
+		err  string
+	}{
+		{"customer=acme, env=prod", map[string]string{"customer": "acme", "env": "prod"}, ""},
+		{"", map[string]string{}, ""},
+		{"team/a.b=x,,", map[string]string{"team/a.b": "x"}, ""},
+		{"env", nil, `tag "env" is not key=value`},
+		{"-env=prod", nil, `invalid tag key "-env"`},
+		{"env=a=b", nil, "invalid value of tag env"},
+		{"k=" + strings.Repeat("v", 256), nil, "invalid value of tag k"},
+	}
+	for _, c := range cases {
+		got, err := parseTags(c.in)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if msg != c.err || (err == nil && !reflect.DeepEqual(got, c.want)) {
+			t.Errorf("%q: got %v %q, want %v %q", c.in, got, msg, c.want, c.err)
+		}
+	}
+	if got := formatTags(map[string]string{"env": "prod", "customer": "acme"}); got != "customer=acme,env=prod" {
+		t.Errorf("format: %q", got)
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	tags := map[string]string{"customer": "acme", "env": "prod"}
+	cases := []struct {
+		selectors []string
+		want      bool
+	}{
+		{nil, true},
+		{[]string{"env"}, true},
+		{[]string{"env=prod", "customer=acme"}, true},
+		{[]string{"env=dev"}, false},
+		{[]string{"env=prod", "team"}, false},
+		{[]string{"env="}, false},
+	}
+	for _, c := range cases {
+		if got := matchTags(tags, c.selectors); got != c.want {
+			t.Errorf("%v: got %v", c.selectors, got)
+		}
+	}
+}
+
+func TestUpdateAuthKeepsOwner(t *testing.T) {
+	resetBuckets(t, bucket)
+	ae := signedEntry("own", "tcp", 6700, "k", time.Hour)
+	ae.Owner, ae.Contact, ae.Tags = "alice", "alice@example.com", map[string]string{"env": "prod"}
+	putEntries(t, ae)
+	update := func(extra string) AuthDataEntity {
+		body := fmt.Sprintf(`{"id":%q,"auth_valid_to":%d%s}`, ae.Id, ae.ValidTo, extra)
+		if rec := serve(UpdateAuthServeHTTP, "POST", "/update-auth", nil, body, RoleOperator); rec.Code != 200 {
+			t.Fatalf("%s: %d %q", extra, rec.Code, rec.Body)
+		}
+		got, _ := getEntry(t, ae.Id)
+		return got
+	}
+	cases := []struct {
+		extra   string
+		owner   string
+		contact string
+		tags    map[string]string
+	}{
+		{"", "alice", "alice@example.com", map[string]string{"env": "prod"}},
+		{`,"owner":"bob","tags":{"env":"dev"}`, "bob", "alice@example.com", map[string]string{"env": "dev"}},
+		{`,"contact":"","tags":{}`, "bob", "", nil},
+	}
+	for _, c := range cases {
+		got := update(c.extra)
+		if got.Owner != c.owner || got.Contact != c.contact || !reflect.DeepEqual(got.Tags, c.tags) {
+			t.Errorf("%s: got %q %q %v", c.extra, got.Owner, got.Contact, got.Tags)
+		}
+	}
+	body := fmt.Sprintf(`{"id":%q,"auth_valid_to":%d,"tags":{"bad key":"x"}}`, ae.Id, ae.ValidTo)
+	if rec := serve(UpdateAuthServeHTTP, "POST", "/update-auth", nil, body, RoleOperator); rec.Code != 400 {
+		t.Errorf("bad tag: %d", rec.Code)
+	}
+}
+
+func TestBulkTags(t *testing.T) {
+	resetBuckets(t, bucket)
+	a := signedEntry("a", "tcp", 6701, "k", time.Hour)
+	a.Tags = map[string]string{"env": "prod", "team": "x"}
+	b := signedEntry("b", "tcp", 6702, "k", time.Hour)
+	putEntries(t, a, b)
+	if code, res := bulk(t, `{"op":"tags","ids":["`+a.Id+`","`+b.Id+`"],"tags":{"env":"dev","team":""}}`, RoleOperator); code != 200 || res.Status != 0 {
+		t.Fatalf("tags: %d %+v", code, res)
+	}
+	for _, ae := range []AuthDataEntity{a, b} {
+		if got, _ := getEntry(t, ae.Id); !reflect.DeepEqual(got.Tags, map[string]string{"env": "dev"}) {
+			t.Errorf("%s: tags %v", ae.Id, got.Tags)
+		}
+	}
+	if code, _ := bulk(t, `{"op":"tags","ids":["`+a.Id+`"],"tags":{"env":"a,b"}}`, RoleOperator); code != 400 {
+		t.Errorf("bad tag value: %d", code)
+	}
+	rec := serve(ListAuthServeHTTP, "POST", "/list-auth?tag=env=dev&owner=nobody", nil, "", RoleViewer)
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), a.Id) {
+		t.Errorf("list by owner: %d %q", rec.Code, rec.Body)
+	}
+	rec = serve(ListAuthServeHTTP, "POST", "/list-auth?tag=env=dev", nil, "", RoleViewer)
+	if !strings.Contains(rec.Body.String(), a.Id) || !strings.Contains(rec.Body.String(), b.Id) {
+		t.Errorf("list by tag: %q", rec.Body)
+	}
+}
+
+func TestAuthConfigInfo(t *testing.T) {
+	resetBuckets(t, bucket)
+	ae := signedEntry("cfg", "tcp", 6703, "k", time.Hour)
+	ae.Owner, ae.Tags = "<alice>", map[string]string{"env": "prod"}
+	putEntries(t, ae)
+	rec := serve(GetAuthConfigServerHTTP, "GET", "/get-auth-config/"+ae.Id, map[string]string{"id": ae.Id}, "", RoleViewer)
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "<html>") {
+		t.Fatalf("owner block outside the page: %q", body)
+	}
+	for _, s := range []string{"# owner: &lt;alice&gt;", "# tags: env=prod", "remote_port=6703"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("no %q in %q", s, body)
+		}
+	}
+	if strings.Index(body, "# owner") > strings.Index(body, "[cfg]") || strings.Index(body, "# owner") < strings.Index(body, "<body>") {
+		t.Errorf("owner block misplaced: %q", body)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var tenantBucket = "tenant"
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Tenant is a customer that owns entries. Users of a tenant only see and
+// change its entries, within its quota; zero values are no limit.
+type Tenant struct {
+	Name string `json:"name"`
+
+	MaxEntries int `json:"max_entries"`
+
+	// empty allows every type
+	ProxyTypes []string `json:"proxy_types"`
+
+	// remote ports like 6000-6999 or 7000; empty allows every port
+	PortRanges []string `json:"port_ranges"`
+
+	// how far ahead auth_valid_to may be, in days
+	MaxValidDays int `json:"max_valid_days"`
+
+	Memo string `json:"memo"`
+
+	Created int64 `json:"created"`
+}
+
+// QuotaError is a change that the quota of a tenant does not allow.
+type QuotaError struct {
+	Tenant string
+
+	Reason string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("tenant %s: %s", e.Tenant, e.Reason)
+}
+
+var (
+	errNotFound = errors.New("not found")
+	errIdTaken  = errors.New("the id is taken by an entry of another tenant")
+)
+
+func parsePortRange(s string) (uint16, uint16, error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil || l == 0 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil || h < l {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return uint16(l), uint16(h), nil
+}
+
+func (t Tenant) validate() error {
+	if !tenantNamePattern.MatchString(t.Name) {
+		return errors.New("invalid tenant name")
+	}
+	if t.MaxEntries < 0 || t.MaxValidDays < 0 {
+		return errors.New("limits may not be negative")
+	}
+	for _, pt := range t.ProxyTypes {
+		if !containsString(proxyTypes, pt) {
+			return fmt.Errorf("invalid proxy type %q", pt)
+		}
+	}
+	for _, pr := range t.PortRanges {
+		if _, _, err := parsePortRange(pr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t Tenant) allowsPort(port uint16) bool {
+	if len(t.PortRanges) == 0 {
+		return true
+	}
+	for _, pr := range t.PortRanges {
+		if lo, hi, err := parsePortRange(pr); err == nil && port >= lo && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func getTenant(tx *nutsdb.Tx, name string) (*Tenant, error) {
+	e, err := tx.Get(tenantBucket, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	var t Tenant
+	if err := json.Unmarshal(e.Value, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func tenantKnown(tx *nutsdb.Tx, name string) bool {
+	_, err := getTenant(tx, name)
+	return err == nil
+}
+
+func tenantExists(name string) bool {
+	known := false
+	dbView(func(tx *nutsdb.Tx) error {
+		known = tenantKnown(tx, name)
+		return nil
+	})
+	return known
+}
+
+// moveTenantEntry notes that id belongs to tenant from now on, "" once it has
+// none or is deleted. Reads do not see the writes of their transaction, so
+// countTenantEntries counts with the moves noted in it.
+func moveTenantEntry(tx *nutsdb.Tx, id, tenant string) {
+	v, _ := txLocals.get(tx, "tenant-moves")
+	moves, _ := v.(map[string]string)
+	if moves == nil {
+		moves = make(map[string]string)
+		txLocals.set(tx, "tenant-moves", moves)
+	}
+	moves[id] = tenant
+}
+
+// countTenantEntries counts the entries of a tenant but id, as the
+// transaction has left them so far.
+func countTenantEntries(tx *nutsdb.Tx, tenant, id string) (int, error) {
+	v, _ := txLocals.get(tx, "tenant-moves")
+	moves, _ := v.(map[string]string)
+	entries, err := tx.GetAll(bucket)
+	if err != nil && err != nutsdb.ErrBucketEmpty {
+		return 0, err
+	}
+	stored := make(map[string]bool, len(entries))
+	n := 0
+	for _, e := range entries {
+		var ae AuthDataEntity
+		if err := json.Unmarshal(e.Value, &ae); err != nil {
+			return 0, err
+		}
+		stored[ae.Id] = true
+		if t, ok := moves[ae.Id]; ok {
+			ae.Tenant = t
+		}
+		if ae.Tenant == tenant && ae.Id != id {
+			n++
+		}
+	}
+	for mid, t := range moves {
+		if !stored[mid] && t == tenant && mid != id {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkQuota checks ae, the entry as it is about to be written, against the
+// quota of its tenant; before is the entry as it is, nil for a new one. Only
+// what changes is checked, so lowering a quota does not lock existing entries.
+// An entry that passes is counted in its tenant for the rest of the
+// transaction.
+func checkQuota(tx *nutsdb.Tx, ae, before *AuthDataEntity) error {
+	if ae.Tenant == "" {
+		moveTenantEntry(tx, ae.Id, "")
+		return nil
+	}
+	t, err := getTenant(tx, ae.Tenant)
+	if err != nil {
+		return &QuotaError{ae.Tenant, "unknown tenant"}
+	}
+	isNew := before == nil || before.Tenant != ae.Tenant
+	if len(t.ProxyTypes) > 0 && (isNew || ae.ProxyType != before.ProxyType) && !containsString(t.ProxyTypes, ae.ProxyType) {
+		return &QuotaError{t.Name, fmt.Sprintf("proxy type %s is not allowed", ae.ProxyType)}
+	}
+	if ae.RemotePort != 0 && (isNew || ae.RemotePort != before.RemotePort) && !t.allowsPort(ae.RemotePort) {
+		return &QuotaError{t.Name, fmt.Sprintf("remote port %d is outside %s", ae.RemotePort, strings.Join(t.PortRanges, ","))}
+	}
+	if t.MaxValidDays > 0 && (isNew || ae.ValidTo > before.ValidTo) {
+		limit := time.Now().AddDate(0, 0, t.MaxValidDays).UnixNano() / int64(time.Millisecond)
+		if ae.ValidTo > limit {
+			return &QuotaError{t.Name, fmt.Sprintf("auth_valid_to is more than %d days ahead", t.MaxValidDays)}
+		}
+	}
+	if t.MaxEntries > 0 && isNew {
+		n, err := countTenantEntries(tx, t.Name, ae.Id)
+		if err != nil {
+			return err
+		}
+		if n >= t.MaxEntries {
+			return &QuotaError{t.Name, fmt.Sprintf("at most %d entries", t.MaxEntries)}
+		}
+	}
+	moveTenantEntry(tx, ae.Id, ae.Tenant)
+	return nil
+}
+
+// checkTenant hides the entries of other tenants from users of a tenant, as
+// if they did not exist.
+func checkTenant(r *http.Request, ae *AuthDataEntity) error {
+	if r == nil {
+		return nil
+	}
+	if t := RequestPrincipal(r).Tenant; t != "" && ae.Tenant != t {
+		return errNotFound
+	}
+	return nil
+}
+
+// scopeFilter limits a filter to the tenant of the request.
+func scopeFilter(r *http.Request, f *AuthFilter) {
+	if t := RequestPrincipal(r).Tenant; t != "" {
+		f.Tenant = t
+	}
+}
+
+// requestTenant is the tenant a new entry goes to: that of the user, or for
+// users of no tenant the one asked for.
+func requestTenant(r *http.Request, asked string) (string, error) {
+	t := RequestPrincipal(r).Tenant
+	if t == "" {
+		return asked, nil
+	}
+	if asked != "" && asked != t {
+		return "", errNotFound
+	}
+	return t, nil
+}
+
+type TenantUsage struct {
+	Tenant
+
+	Entries int `json:"entries"`
+
+	Users int `json:"users"`
+}
+
+func ListTenantServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := []TenantUsage{}
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(tenantBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var tu TenantUsage
+			if err := json.Unmarshal(e.Value, &tu.Tenant); err != nil {
+				return err
+			}
+			if tu.Entries, err = countTenantEntries(tx, tu.Name, ""); err != nil {
+				return err
+			}
+			if tu.Users, err = countTenantUsers(tx, tu.Name); err != nil {
+				return err
+			}
+			result = append(result, tu)
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		Log.Error(err)
+		http.Error(w, "server error[ListTenant-1].", 500)
+		return
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	data, err := json.Marshal(result)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListTenant-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(result), data))
+}
+
+func countTenantUsers(tx *nutsdb.Tx, tenant string) (int, error) {
+	entries, err := tx.GetAll(userBucket)
+	if err == nutsdb.ErrBucketEmpty {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		var ue UserEntity
+		if err := json.Unmarshal(e.Value, &ue); err != nil {
+			return 0, err
+		}
+		if ue.Tenant == tenant {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PutTenantServeHTTP adds a tenant or, with update=1, changes one.
+func PutTenantServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var t Tenant
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if err := t.validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	update := r.URL.Query().Get("update") == "1"
+	Log.Info("put tenant", t.Name, "update", update, "by", RequestUser(r))
+	status := 0
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		old, err := getTenant(tx, t.Name)
+		switch {
+		case update && err != nil:
+			status = 404
+			return errors.New("no such tenant")
+		case !update && err == nil:
+			status = 409
+			return errors.New("tenant exists")
+		case update:
+			t.Created = old.Created
+		default:
+			t.Created = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		val, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return tx.Put(tenantBucket, []byte(t.Name), val, 0)
+	}); err != nil {
+		if status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[PutTenant-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+// DeleteTenantServeHTTP removes a tenant that no entry or user belongs to.
+func DeleteTenantServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("delete tenant", params["name"], "by", RequestUser(r))
+	status := 0
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		if _, err := getTenant(tx, params["name"]); err != nil {
+			status = 404
+			return errors.New("no such tenant")
+		}
+		entries, err := countTenantEntries(tx, params["name"], "")
+		if err != nil {
+			return err
+		}
+		users, err := countTenantUsers(tx, params["name"])
+		if err != nil {
+			return err
+		}
+		if entries > 0 || users > 0 {
+			status = 409
+			return fmt.Errorf("the tenant still has %d entries and %d users", entries, users)
+		}
+		return tx.Delete(tenantBucket, []byte(params["name"]))
+	}); err != nil {
+		if status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[DeleteTenant-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/xujiajun/nutsdb"
+	"testing"
+	"time"
+)
+
+func putTenant(t *testing.T, tn Tenant) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		val, err := json.Marshal(tn)
+		if err != nil {
+			return err
+		}
+		return tx.Put(tenantBucket, []byte(tn.Name), val, 0)
+	})
+}
+
+func quotaReason(err error) string {
+	if qe, ok := err.(*QuotaError); ok {
+		return qe.Reason
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func TestCheckQuota(t *testing.T) {
+	resetBuckets(t, bucket, tenantBucket)
+	putTenant(t, Tenant{Name: "acme", ProxyTypes: []string{"tcp"}, PortRanges: []string{"6000-6099", "7000"}, MaxValidDays: 30})
+	entry := func(pt string, port uint16, valid time.Duration) *AuthDataEntity {
+		return &AuthDataEntity{Id: "e", Tenant: "acme", ProxyType: pt, RemotePort: port, ValidTo: validIn(valid)}
+	}
+	day := 24 * time.Hour
+	cases := []struct {
+		ae, before *AuthDataEntity
+		reason     string
+	}{
+		{entry("tcp", 6050, day), nil, ""},
+		{entry("tcp", 7000, day), nil, ""},
+		{entry("udp", 6050, day), nil, "proxy type udp is not allowed"},
+		{entry("tcp", 6100, day), nil, "remote port 6100 is outside 6000-6099,7000"},
+		{entry("tcp", 6050, 31*day), nil, "auth_valid_to is more than 30 days ahead"},
+		{&AuthDataEntity{Tenant: "nope", ProxyType: "tcp"}, nil, "unknown tenant"},
+		{&AuthDataEntity{ProxyType: "udp", RemotePort: 1}, nil, ""},
+		// what an entry had before the quota was lowered may stay.
+		{entry("udp", 5000, 40*day), entry("udp", 5000, 40*day), ""},
+		{entry("udp", 5000, 35*day), entry("udp", 5000, 40*day), ""},
+		{entry("udp", 5000, 41*day), entry("udp", 5000, 40*day), "auth_valid_to is more than 30 days ahead"},
+		{entry("udp", 5001, 40*day), entry("udp", 5000, 40*day), "remote port 5001 is outside 6000-6099,7000"},
+		{entry("tcp", 5000, 40*day), entry("udp", 5000, 40*day), ""},
+		// moving an entry into the tenant checks it like a new one.
+		{entry("udp", 5000, day), &AuthDataEntity{ProxyType: "udp", RemotePort: 5000}, "proxy type udp is not allowed"},
+	}
+	for i, c := range cases {
+		var err error
+		dbView(func(tx *nutsdb.Tx) error {
+			err = checkQuota(tx, c.ae, c.before)
+			return nil
+		})
+		if got := quotaReason(err); got != c.reason {
+			t.Errorf("case %d: got %q, want %q", i, got, c.reason)
+		}
+	}
+}
+
+func TestCheckQuotaMaxEntries(t *testing.T) {
+	resetBuckets(t, bucket, tenantBucket)
+	putTenant(t, Tenant{Name: "acme", MaxEntries: 3})
+	putEntries(t,
+		AuthDataEntity{Id: "a", Tenant: "acme"},
+		AuthDataEntity{Id: "other", Tenant: "beta"},
+	)
+	check := func(tx *nutsdb.Tx, ae, before *AuthDataEntity) string {
+		return quotaReason(checkQuota(tx, ae, before))
+	}
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		// entries admitted earlier in the transaction count.
+		if r := check(tx, &AuthDataEntity{Id: "b", Tenant: "acme"}, nil); r != "" {
+			t.Errorf("b: %s", r)
+		}
+		if r := check(tx, &AuthDataEntity{Id: "c", Tenant: "acme"}, nil); r != "" {
+			t.Errorf("c: %s", r)
+		}
+		if r := check(tx, &AuthDataEntity{Id: "d", Tenant: "acme"}, nil); r != "at most 3 entries" {
+			t.Errorf("d: got %q", r)
+		}
+		// updating an entry of the tenant does not add one.
+		a := &AuthDataEntity{Id: "a", Tenant: "acme"}
+		if r := check(tx, a, a); r != "" {
+			t.Errorf("update a: %s", r)
+		}
+		return nil
+	})
+	// the count is per transaction.
+	dbView(func(tx *nutsdb.Tx) error {
+		if r := check(tx, &AuthDataEntity{Id: "b", Tenant: "acme"}, nil); r != "" {
+			t.Errorf("b in a new transaction: %s", r)
+		}
+		return nil
+	})
+}
+
+func TestCheckQuotaMovesInTransaction(t *testing.T) {
+	resetBuckets(t, bucket, tenantBucket, trashBucket, historyBucket, historyRevBucket)
+	putTenant(t, Tenant{Name: "acme", MaxEntries: 2})
+	putTenant(t, Tenant{Name: "beta"})
+	putEntries(t,
+		AuthDataEntity{Id: "a", Tenant: "acme"},
+		AuthDataEntity{Id: "x", Tenant: "acme"},
+	)
+	check := func(ae, before *AuthDataEntity) func(tx *nutsdb.Tx) string {
+		return func(tx *nutsdb.Tx) string {
+			return quotaReason(checkQuota(tx, ae, before))
+		}
+	}
+	steps := []struct {
+		name   string
+		step   func(tx *nutsdb.Tx) string
+		reason string
+	}{
+		{"move a out", check(&AuthDataEntity{Id: "a", Tenant: "beta"}, &AuthDataEntity{Id: "a", Tenant: "acme"}), ""},
+		{"add b in its place", check(&AuthDataEntity{Id: "b", Tenant: "acme"}, nil), ""},
+		{"check b again", check(&AuthDataEntity{Id: "b", Tenant: "acme"}, nil), ""},
+		{"add c", check(&AuthDataEntity{Id: "c", Tenant: "acme"}, nil), "at most 2 entries"},
+		{"delete x", func(tx *nutsdb.Tx) string { return quotaReason(trashAuth(tx, nil, "x")) }, ""},
+		{"add c after x is gone", check(&AuthDataEntity{Id: "c", Tenant: "acme"}, nil), ""},
+		{"move a back", check(&AuthDataEntity{Id: "a", Tenant: "acme"}, &AuthDataEntity{Id: "a", Tenant: "beta"}), "at most 2 entries"},
+	}
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		for _, s := range steps {
+			if got := s.step(tx); got != s.reason {
+				t.Errorf("%s: got %q, want %q", s.name, got, s.reason)
+			}
+		}
+		return nil
+	})
+}
+
+func TestTenantValidate(t *testing.T) {
+	good := Tenant{Name: "acme-1", ProxyTypes: []string{"tcp", "udp"}, PortRanges: []string{"6000-6099", "7000"}}
+	if err := good.validate(); err != nil {
+		t.Errorf("good: %v", err)
+	}
+	bad := []Tenant{
+		{Name: "a b"},
+		{Name: "acme", MaxEntries: -1},
+		{Name: "acme", ProxyTypes: []string{"ssh"}},
+		{Name: "acme", PortRanges: []string{"7000-6000"}},
+		{Name: "acme", PortRanges: []string{"0"}},
+		{Name: "acme", PortRanges: []string{"70000"}},
+	}
+	for _, tn := range bad {
+		if err := tn.validate(); err == nil {
+			t.Errorf("%+v accepted", tn)
+		}
+	}
+}
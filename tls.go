@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	certCheckInterval = 5 * time.Second
+	selfSignedValid   = 10 * 365 * 24 * time.Hour
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the key pair from disk and reloads it when either file's
+// modification time changes, so renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil && certInfo.ModTime().Equal(cr.certMod) && keyInfo.ModTime().Equal(cr.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		Log.Info(fmt.Sprintf("reloaded certificate %s", cr.certFile))
+	}
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if time.Since(cr.lastCheck) > certCheckInterval {
+		cr.lastCheck = time.Now()
+		// a half written pair fails to load; keep serving the old one until
+		// both files are in place.
+		if err := cr.reload(); err != nil {
+			Log.Warning(fmt.Sprintf("reload certificate %s failed: %s", cr.certFile, err))
+		}
+	}
+	return cr.cert, nil
+}
+
+// TLSSettings is the TLS part of one listener's configuration.
+type TLSSettings struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion string
+	SelfSigned bool
+	ClientCA   string
+}
+
+func (ts TLSSettings) Enabled() bool {
+	return ts.CertFile != "" || ts.SelfSigned
+}
+
+func (ts TLSSettings) Validate(name string) error {
+	if !ts.Enabled() {
+		if ts.ClientCA != "" {
+			return fmt.Errorf("%s: client ca needs tls", name)
+		}
+		return nil
+	}
+	if (ts.CertFile == "") != (ts.KeyFile == "") {
+		return fmt.Errorf("%s: tls cert and key files go together", name)
+	}
+	if _, ok := tlsVersions[ts.MinVersion]; !ok {
+		return fmt.Errorf("%s: invalid tls min version %q", name, ts.MinVersion)
+	}
+	if !ts.SelfSigned {
+		for _, f := range []string{ts.CertFile, ts.KeyFile} {
+			if _, err := os.Stat(f); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	if ts.ClientCA != "" {
+		if _, err := os.Stat(ts.ClientCA); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// TLSConfig builds the server side tls.Config of the named listener, generating
+// a self-signed pair first if asked to and none exists yet. It returns nil when
+// TLS is off.
+func (ts TLSSettings) TLSConfig(name string, hosts []string) (*tls.Config, error) {
+	if !ts.Enabled() {
+		return nil, nil
+	}
+	certFile, keyFile := ts.CertFile, ts.KeyFile
+	if certFile == "" {
+		certFile, keyFile = fmt.Sprintf("frps-auth-%s.crt", name), fmt.Sprintf("frps-auth-%s.key", name)
+	}
+	if ts.SelfSigned {
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			if err := generateSelfSigned(certFile, keyFile, hosts); err != nil {
+				return nil, err
+			}
+			Log.Info(fmt.Sprintf("generated self-signed certificate %s", certFile))
+		}
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tlsVersions[ts.MinVersion],
+		GetCertificate: cr.GetCertificate,
+	}
+	if ts.ClientCA != "" {
+		caPem, err := ioutil.ReadFile(ts.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in %s", ts.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		// the admin UI may share the listener, so the certificate is only
+		// demanded on the plugin route, see RequireClientCert.
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"frps-auth"}, CommonName: "frps-auth"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValid),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			if !ip.IsUnspecified() {
+				tpl.IPAddresses = append(tpl.IPAddresses, ip)
+			}
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// pinnedClientConfig is for the command line talking to its own server: the
+// address it dials may not be named in the certificate, so instead of the
+// names it checks that the server shows the certificate file of name.
+func (ts TLSSettings) pinnedClientConfig(name string) (*tls.Config, error) {
+	certFile := ts.CertFile
+	if certFile == "" {
+		certFile = fmt.Sprintf("frps-auth-%s.crt", name)
+	}
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], block.Bytes) {
+				return fmt.Errorf("the server does not show %s", certFile)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func selfSignedHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1", addr}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	return hosts
+}
+
+// RequireClientCert rejects requests that did not present a client certificate
+// verified against the configured CA. Without a CA it lets everything through.
+func RequireClientCert(h http.HandlerFunc, ts TLSSettings) http.HandlerFunc {
+	if ts.ClientCA == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			Log.Warning(fmt.Sprintf("%s %s without client certificate.", r.RemoteAddr, r.RequestURI))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tokenBucket = "token"
+
+// lastUsed is only persisted this often per token, to keep API calls from
+// turning into store writes.
+var tokenTouchInterval = time.Minute
+
+const tokenPrefix = "fat_"
+
+const (
+	ScopeRead   = "read"
+	ScopeWrite  = "write"
+	ScopePlugin = "plugin"
+)
+
+// scopeRoles is the role a scope stands for on the admin API. plugin grants no
+// admin access, only the frps plugin endpoint.
+var scopeRoles = map[string]string{
+	ScopeRead:   RoleViewer,
+	ScopeWrite:  RoleAdmin,
+	ScopePlugin: "",
+}
+
+type ApiToken struct {
+	Id string `json:"id"`
+
+	Name string `json:"name"`
+
+	Owner string `json:"owner"`
+
+	Scopes []string `json:"scopes"`
+
+	// unix millis, 0 never expires
+	ExpiresAt int64 `json:"expires_at"`
+
+	AllowIPs string `json:"allow_ips"`
+
+	Hash string `json:"hash,omitempty"`
+
+	Created int64 `json:"created"`
+
+	LastUsed int64 `json:"last_used"`
+
+	LastUsedIP string `json:"last_used_ip"`
+
+	Revoked bool `json:"revoked"`
+}
+
+type AddTokenRequest struct {
+	Name string `json:"name"`
+
+	Scopes []string `json:"scopes"`
+
+	ExpiresAt int64 `json:"expires_at"`
+
+	AllowIPs string `json:"allow_ips"`
+}
+
+func (t ApiToken) HasScope(scope string) bool {
+	return containsString(t.Scopes, scope)
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseToken splits "fat_<id>_<secret>".
+func parseToken(raw string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(raw, tokenPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(raw, tokenPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+func getToken(id string) (ApiToken, error) {
+	var t ApiToken
+	err := dbView(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(tokenBucket, []byte(id))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(e.Value, &t)
+	})
+	return t, err
+}
+
+func putToken(tx *nutsdb.Tx, t ApiToken) error {
+	val, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Put(tokenBucket, []byte(t.Id), val, 0)
+}
+
+// authenticateToken checks a bearer token and its expiry, revocation, owner
+// and IP restriction.
+func authenticateToken(raw string, r *http.Request) (ApiToken, error) {
+	id, secret, ok := parseToken(raw)
+	if !ok {
+		return ApiToken{}, errors.New("malformed token")
+	}
+	t, err := getToken(id)
+	if err != nil {
+		return ApiToken{}, errors.New("unknown token")
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashTokenSecret(secret))) != 1 {
+		return ApiToken{}, errors.New("wrong token secret")
+	}
+	if t.Revoked {
+		return ApiToken{}, errors.New("token revoked")
+	}
+	if t.ExpiresAt > 0 && time.Now().UnixNano()/int64(time.Millisecond) > t.ExpiresAt {
+		return ApiToken{}, errors.New("token expired")
+	}
+	if t.Owner != Config.Username {
+		if _, err := getUser(t.Owner); err != nil {
+			return ApiToken{}, fmt.Errorf("token owner %s no longer exists", t.Owner)
+		}
+	}
+	if t.AllowIPs != "" {
+		nets, _ := parseIPNets(t.AllowIPs)
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		allowed := false
+		for _, n := range nets {
+			if err == nil && ip != nil && n.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return ApiToken{}, fmt.Errorf("token not allowed from %s", r.RemoteAddr)
+		}
+	}
+	touchToken(t, r.RemoteAddr)
+	return t, nil
+}
+
+// tokenPrincipal is the principal a token acts as: the strongest role of its
+// scopes, but never more than what its owner may do today, and for the tenant
+// of its owner.
+func tokenPrincipal(t ApiToken) Principal {
+	role := ""
+	for _, s := range t.Scopes {
+		if roleLevels[scopeRoles[s]] > roleLevels[role] {
+			role = scopeRoles[s]
+		}
+	}
+	ownerRole, tenant := "", ""
+	if t.Owner == Config.Username {
+		ownerRole = RoleAdmin
+	} else if ue, err := getUser(t.Owner); err == nil {
+		ownerRole, tenant = ue.Role, ue.Tenant
+	}
+	if roleLevels[ownerRole] < roleLevels[role] {
+		role = ownerRole
+	}
+	return Principal{User: t.Owner, Role: role, Token: t.Id, Tenant: tenant}
+}
+
+// revokeUserTokens revokes the tokens of a user that is deleted.
+func revokeUserTokens(tx *nutsdb.Tx, username string) error {
+	entries, err := tx.GetAll(tokenBucket)
+	if err == nutsdb.ErrBucketEmpty {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var t ApiToken
+		if err := json.Unmarshal(e.Value, &t); err != nil {
+			return err
+		}
+		if t.Owner != username || t.Revoked {
+			continue
+		}
+		t.Revoked = true
+		if err := putToken(tx, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var tokenTouched = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+func touchToken(t ApiToken, remoteAddr string) {
+	tokenTouched.Lock()
+	if time.Since(tokenTouched.at[t.Id]) < tokenTouchInterval {
+		tokenTouched.Unlock()
+		return
+	}
+	tokenTouched.at[t.Id] = time.Now()
+	tokenTouched.Unlock()
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		cur, err := tx.Get(tokenBucket, []byte(t.Id))
+		if err != nil {
+			return err
+		}
+		var stored ApiToken
+		if err := json.Unmarshal(cur.Value, &stored); err != nil {
+			return err
+		}
+		stored.LastUsed = time.Now().UnixNano() / int64(time.Millisecond)
+		stored.LastUsedIP = host
+		return putToken(tx, stored)
+	}); err != nil {
+		Log.Error(err)
+	}
+}
+
+// RequirePluginToken guards the frps plugin endpoint with a token of the plugin
+// scope, given as bearer or, since frps cannot send custom headers, as the
+// token query parameter of the plugin path.
+func RequirePluginToken(h http.HandlerFunc) http.HandlerFunc {
+	if !Config.PluginRequireToken {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := bearerToken(r)
+		if raw == "" {
+			raw = r.URL.Query().Get("token")
+		}
+		t, err := authenticateToken(raw, r)
+		if err == nil && !t.HasScope(ScopePlugin) {
+			err = errors.New("token lacks the plugin scope")
+		}
+		if err != nil {
+			Log.Warning(fmt.Sprintf("%s %s: %s.", r.RemoteAddr, r.URL.Path, err))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+func canManageToken(p Principal, t ApiToken) bool {
+	return t.Owner == p.User || (p.HasRole(RoleAdmin) && p.Tenant == "")
+}
+
+// ListTokenServeHTTP lists the caller's tokens, or every token for admins.
+func ListTokenServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := RequestPrincipal(r)
+	tokens := []ApiToken{}
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(tokenBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var t ApiToken
+			if err := json.Unmarshal(e.Value, &t); err != nil {
+				return err
+			}
+			if !canManageToken(p, t) {
+				continue
+			}
+			t.Hash = ""
+			tokens = append(tokens, t)
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		Log.Error(err)
+		http.Error(w, "server error[ListToken-1].", 500)
+		return
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created > tokens[j].Created
+	})
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListToken-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(tokens), data))
+}
+
+// AddTokenServeHTTP creates a token owned by the caller. The secret is only
+// returned here; the store keeps its hash.
+func AddTokenServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var at AddTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&at); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if strings.TrimSpace(at.Name) == "" || len(at.Scopes) == 0 {
+		http.Error(w, "name and scopes are required", 400)
+		return
+	}
+	for _, s := range at.Scopes {
+		if _, ok := scopeRoles[s]; !ok {
+			http.Error(w, fmt.Sprintf("invalid scope %q", s), 400)
+			return
+		}
+	}
+	if _, err := parseIPNets(at.AllowIPs); err != nil {
+		http.Error(w, "invalid allow_ips", 400)
+		return
+	}
+	p := RequestPrincipal(r)
+	if p.Token != "" {
+		http.Error(w, "tokens cannot create tokens", 403)
+		return
+	}
+	// the role of a single sign-on user lives in the provider, a token could
+	// not be capped by it.
+	if p.Provider != "" {
+		http.Error(w, "API tokens need a local account", 403)
+		return
+	}
+	if containsString(at.Scopes, ScopePlugin) && (!p.HasRole(RoleAdmin) || p.Tenant != "") {
+		http.Error(w, "the plugin scope needs the admin role of no tenant", 403)
+		return
+	}
+	secret := randomToken()
+	t := ApiToken{
+		Id:        randomToken()[:16],
+		Name:      at.Name,
+		Owner:     p.User,
+		Scopes:    at.Scopes,
+		ExpiresAt: at.ExpiresAt,
+		AllowIPs:  at.AllowIPs,
+		Hash:      hashTokenSecret(secret),
+		Created:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	Log.Info("add token", t.Id, t.Name, t.Scopes, "by", p.User)
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		return putToken(tx, t)
+	}); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AddToken-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": 0,
+		"id":     t.Id,
+		"token":  tokenPrefix + t.Id + "_" + secret,
+	})
+}
+
+func RevokeTokenServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	p := RequestPrincipal(r)
+	Log.Info("revoke token", params["id"], "by", p.User)
+	forbidden := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(tokenBucket, []byte(params["id"]))
+		if err != nil {
+			return err
+		}
+		var t ApiToken
+		if err := json.Unmarshal(e.Value, &t); err != nil {
+			return err
+		}
+		if !canManageToken(p, t) {
+			forbidden = true
+			return errors.New("forbidden")
+		}
+		t.Revoked = true
+		return putToken(tx, t)
+	}); err != nil {
+		if forbidden {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[RevokeToken-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/xujiajun/nutsdb"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenPrincipalCapsScopes(t *testing.T) {
+	resetBuckets(t, userBucket)
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := putUser(tx, UserEntity{Username: "view", Role: RoleViewer}); err != nil {
+			return err
+		}
+		return putUser(tx, UserEntity{Username: "op", Role: RoleOperator, Tenant: "acme"})
+	})
+	cases := []struct {
+		owner  string
+		scopes []string
+		role   string
+		tenant string
+	}{
+		{Config.Username, []string{ScopeWrite}, RoleAdmin, ""},
+		{Config.Username, []string{ScopeRead}, RoleViewer, ""},
+		{Config.Username, []string{ScopePlugin}, "", ""},
+		{"view", []string{ScopeWrite}, RoleViewer, ""},
+		{"op", []string{ScopeRead, ScopeWrite}, RoleOperator, "acme"},
+		{"op", []string{ScopeRead}, RoleViewer, "acme"},
+		{"gone", []string{ScopeWrite}, "", ""},
+	}
+	for _, c := range cases {
+		p := tokenPrincipal(ApiToken{Id: "t", Owner: c.owner, Scopes: c.scopes})
+		if p.Role != c.role || p.Tenant != c.tenant {
+			t.Errorf("%s %v: got role %q tenant %q, want %q %q", c.owner, c.scopes, p.Role, p.Tenant, c.role, c.tenant)
+		}
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	resetBuckets(t, userBucket, tokenBucket)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	tokens := []ApiToken{
+		{Id: "ok", Owner: "op"},
+		{Id: "revoked", Owner: "op", Revoked: true},
+		{Id: "expired", Owner: "op", ExpiresAt: now - 1000},
+		{Id: "orphan", Owner: "gone"},
+		{Id: "lan", Owner: "op", AllowIPs: "10.0.0.0/8"},
+	}
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := putUser(tx, UserEntity{Username: "op", Role: RoleOperator}); err != nil {
+			return err
+		}
+		for _, tok := range tokens {
+			tok.Hash = hashTokenSecret("secret")
+			if err := putToken(tx, tok); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	cases := []struct {
+		raw    string
+		remote string
+		ok     bool
+	}{
+		{"fat_ok_secret", "192.0.2.1:1000", true},
+		{"fat_ok_wrong", "192.0.2.1:1000", false},
+		{"ok_secret", "192.0.2.1:1000", false},
+		{"fat_nope_secret", "192.0.2.1:1000", false},
+		{"fat_revoked_secret", "192.0.2.1:1000", false},
+		{"fat_expired_secret", "192.0.2.1:1000", false},
+		{"fat_orphan_secret", "192.0.2.1:1000", false},
+		{"fat_lan_secret", "192.0.2.1:1000", false},
+		{"fat_lan_secret", "10.1.2.3:1000", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		_, err := authenticateToken(c.raw, r)
+		if (err == nil) != c.ok {
+			t.Errorf("%s from %s: got %v, want ok=%v", c.raw, c.remote, err, c.ok)
+		}
+	}
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	resetBuckets(t, tokenBucket)
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := putToken(tx, ApiToken{Id: "a", Owner: "op"}); err != nil {
+			return err
+		}
+		if err := putToken(tx, ApiToken{Id: "b", Owner: "other"}); err != nil {
+			return err
+		}
+		return nil
+	})
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		return revokeUserTokens(tx, "op")
+	})
+	for id, want := range map[string]bool{"a": true, "b": false} {
+		tok, err := getToken(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.Revoked != want {
+			t.Errorf("token %s: revoked %v, want %v", id, tok.Revoked, want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var totpBucket = "totp"
+
+const (
+	totpPeriod   = 30
+	totpDigits   = 6
+	totpSkew     = 1
+	totpIssuer   = "frps-auth"
+	recoveryKeep = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TotpEntity is the RFC 6238 second factor of an admin user, the account from
+// frps-auth.ini included.
+type TotpEntity struct {
+	Username string `json:"username"`
+
+	Secret string `json:"secret"`
+
+	// secret being enrolled, until confirmed with a first code
+	Pending string `json:"pending"`
+
+	Enabled bool `json:"enabled"`
+
+	// sha256 of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes"`
+
+	// last accepted time step, a code is never accepted twice
+	LastCounter int64 `json:"last_counter"`
+}
+
+type TotpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000), nil
+}
+
+// matchTotp returns the time step code is valid for, allowing one step of
+// clock skew either way, or -1.
+func matchTotp(secret, code string, now time.Time) int64 {
+	counter := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		c, err := totpCode(secret, counter+int64(i))
+		if err != nil {
+			return -1
+		}
+		if subtle.ConstantTimeCompare([]byte(c), []byte(code)) == 1 {
+			return counter + int64(i)
+		}
+	}
+	return -1
+}
+
+func totpURI(user, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(totpIssuer), url.PathEscape(user), v.Encode())
+}
+
+func hashRecoveryCode(code string) string {
+	return hashTokenSecret(strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1)))
+}
+
+func newRecoveryCodes() (plain []string, hashed []string) {
+	for i := 0; i < recoveryKeep; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		code := hex.EncodeToString(b)
+		plain = append(plain, code[:5]+"-"+code[5:])
+		hashed = append(hashed, hashRecoveryCode(code))
+	}
+	return
+}
+
+func getTotp(tx *nutsdb.Tx, user string) (TotpEntity, error) {
+	var te TotpEntity
+	e, err := tx.Get(totpBucket, []byte(user))
+	if err != nil {
+		return TotpEntity{Username: user}, err
+	}
+	err = json.Unmarshal(e.Value, &te)
+	return te, err
+}
+
+func putTotp(tx *nutsdb.Tx, te TotpEntity) error {
+	val, err := json.Marshal(te)
+	if err != nil {
+		return err
+	}
+	return tx.Put(totpBucket, []byte(te.Username), val, 0)
+}
+
+func totpEnabled(user string) bool {
+	enabled := false
+	dbView(func(tx *nutsdb.Tx) error {
+		te, err := getTotp(tx, user)
+		enabled = err == nil && te.Enabled
+		return nil
+	})
+	return enabled
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code,
+// and burns it.
+func verifySecondFactor(user, code string) bool {
+	ok := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		te, err := getTotp(tx, user)
+		if err != nil || !te.Enabled {
+			return nil
+		}
+		if c := matchTotp(te.Secret, code, time.Now()); c > te.LastCounter {
+			te.LastCounter = c
+			ok = true
+			return putTotp(tx, te)
+		}
+		h := hashRecoveryCode(code)
+		for i, rc := range te.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+				Log.Warning(fmt.Sprintf("%s used a recovery code, %d left.", user, len(te.RecoveryCodes)-1))
+				te.RecoveryCodes = append(te.RecoveryCodes[:i], te.RecoveryCodes[i+1:]...)
+				ok = true
+				return putTotp(tx, te)
+			}
+		}
+		return nil
+	}); err != nil {
+		Log.Error(err)
+		return false
+	}
+	return ok
+}
+
+var errTotpBasic = errors.New("two-factor users have to log in at /login.html or use an API token")
+
+// authenticateBasic is authenticate for basic auth. Basic auth has no room for
+// a second factor, and clients resend the same credentials on every request
+// where a code is only good once, so users with TOTP are refused; that is
+// only told once the password is right.
+func authenticateBasic(user, passwd string) (Principal, error) {
+	p, ok := authenticate(user, passwd)
+	if !ok {
+		return Principal{}, errors.New("bad credentials")
+	}
+	if totpEnabled(user) {
+		return Principal{}, errTotpBasic
+	}
+	return p, nil
+}
+
+// requirePasswordSession keeps API tokens and single sign-on users, whose
+// second factor is up to their provider, away from the TOTP settings.
+func requirePasswordSession(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	p := RequestPrincipal(r)
+	if p.Token != "" || p.Provider != "" || p.User == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return p, false
+	}
+	return p, true
+}
+
+func TotpStatusServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := requirePasswordSession(w, r)
+	if !ok {
+		return
+	}
+	var te TotpEntity
+	dbView(func(tx *nutsdb.Tx) error {
+		te, _ = getTotp(tx, p.User)
+		return nil
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        te.Enabled,
+		"recovery_codes": len(te.RecoveryCodes),
+	})
+}
+
+// TotpEnrollServeHTTP starts enrolling a new secret; it only takes effect once
+// TotpConfirmServeHTTP has seen a code for it.
+func TotpEnrollServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := requirePasswordSession(w, r)
+	if !ok {
+		return
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	secret := totpEncoding.EncodeToString(b)
+	enabled := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		te, _ := getTotp(tx, p.User)
+		if te.Enabled {
+			enabled = true
+			return errors.New("totp already enabled")
+		}
+		te.Pending = secret
+		return putTotp(tx, te)
+	}); err != nil {
+		if enabled {
+			http.Error(w, "totp already enabled", 409)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[TotpEnroll-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": 0,
+		"secret": secret,
+		"uri":    totpURI(p.User, secret),
+	})
+}
+
+// TotpConfirmServeHTTP enables the pending secret and hands out the recovery
+// codes, which are never shown again.
+func TotpConfirmServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := requirePasswordSession(w, r)
+	if !ok {
+		return
+	}
+	var cr TotpCodeRequest
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&cr) != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	plain, hashed := newRecoveryCodes()
+	badCode := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		te, err := getTotp(tx, p.User)
+		if err != nil {
+			return err
+		}
+		c := matchTotp(te.Pending, strings.TrimSpace(cr.Code), time.Now())
+		if te.Pending == "" || c < 0 {
+			badCode = true
+			return errors.New("bad code")
+		}
+		te.Secret = te.Pending
+		te.Pending = ""
+		te.Enabled = true
+		te.LastCounter = c
+		te.RecoveryCodes = hashed
+		return putTotp(tx, te)
+	}); err != nil {
+		if badCode {
+			http.Error(w, "bad code", 400)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[TotpConfirm-1].", 500)
+		return
+	}
+	Log.Info("totp enabled", p.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         0,
+		"recovery_codes": plain,
+	})
+}
+
+func TotpDisableServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := requirePasswordSession(w, r)
+	if !ok {
+		return
+	}
+	var cr TotpCodeRequest
+	if r.Body == nil || json.NewDecoder(r.Body).Decode(&cr) != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	// bad codes count like those of a login, or a stolen session could
+	// guess its way through the recovery codes.
+	keys := loginLockoutKeys(r, p.User)
+	if lockedOut(w, r, keys...) {
+		return
+	}
+	if !verifySecondFactor(p.User, strings.TrimSpace(cr.Code)) {
+		Lockouts.Fail(keys...)
+		Log.Warning(fmt.Sprintf("%s totp disable from %s bad code.", p.User, r.RemoteAddr))
+		http.Error(w, "bad code", 400)
+		return
+	}
+	Lockouts.Clear("user:" + p.User)
+	if err := resetTotp(p.User); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[TotpDisable-1].", 500)
+		return
+	}
+	Log.Info("totp disabled", p.User)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+// TotpResetServeHTTP lets an admin remove the second factor of a user who lost
+// both the device and the recovery codes.
+func TotpResetServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("totp reset", params["username"], "by", RequestUser(r))
+	if err := resetTotp(params["username"]); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[TotpReset-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+func resetTotp(user string) error {
+	return dbUpdate(func(tx *nutsdb.Tx) error {
+		if _, err := getTotp(tx, user); err != nil {
+			return nil
+		}
+		return tx.Delete(totpBucket, []byte(user))
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"golang.org/x/crypto/bcrypt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// the SHA1 secret of the RFC 6238 test vectors.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, c := range cases {
+		code, err := totpCode(rfcSecret, c.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Errorf("%d: got %s, want %s", c.unix, code, c.code)
+		}
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("bad secret accepted")
+	}
+}
+
+func TestMatchTotpSkew(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	counter := now.Unix() / totpPeriod
+	for i := int64(-2); i <= 2; i++ {
+		code, _ := totpCode(rfcSecret, counter+i)
+		got := matchTotp(rfcSecret, code, now)
+		want := counter + i
+		if i < -totpSkew || i > totpSkew {
+			want = -1
+		}
+		if got != want {
+			t.Errorf("step %+d: got %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	resetBuckets(t, totpBucket)
+	plain, hashed := newRecoveryCodes()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		return putTotp(tx, TotpEntity{Username: "admin2", Secret: rfcSecret, Enabled: true, RecoveryCodes: hashed})
+	})
+	code, _ := totpCode(rfcSecret, time.Now().Unix()/totpPeriod)
+	if !verifySecondFactor("admin2", code) {
+		t.Fatal("current code refused")
+	}
+	if verifySecondFactor("admin2", code) {
+		t.Error("code accepted twice")
+	}
+	if verifySecondFactor("admin2", "000000x") {
+		t.Error("garbage accepted")
+	}
+	// recovery codes may come with spaces around them or without the dash.
+	if !verifySecondFactor("admin2", " "+plain[0]+" ") {
+		t.Error("recovery code refused")
+	}
+	if verifySecondFactor("admin2", plain[0]) {
+		t.Error("recovery code accepted twice")
+	}
+	if !verifySecondFactor("admin2", plain[1][:5]+plain[1][6:]) {
+		t.Error("recovery code without dash refused")
+	}
+	if verifySecondFactor("nobody", code) {
+		t.Error("code accepted for a user without TOTP")
+	}
+}
+
+func TestAuthenticateBasicRefusesTotpUsers(t *testing.T) {
+	resetBuckets(t, userBucket, totpBucket)
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if err := putUser(tx, UserEntity{Username: "plain", PasswordHash: string(hash), Role: RoleViewer}); err != nil {
+			return err
+		}
+		if err := putUser(tx, UserEntity{Username: "twofa", PasswordHash: string(hash), Role: RoleAdmin}); err != nil {
+			return err
+		}
+		return putTotp(tx, TotpEntity{Username: "twofa", Secret: rfcSecret, Enabled: true})
+	})
+	if _, err := authenticateBasic("plain", "pw"); err != nil {
+		t.Errorf("plain: %v", err)
+	}
+	if _, err := authenticateBasic("twofa", "pw"); err != errTotpBasic {
+		t.Errorf("twofa: got %v, want errTotpBasic", err)
+	}
+	// a wrong password must not tell that the account has TOTP.
+	if _, err := authenticateBasic("twofa", "wrong"); err == nil || err == errTotpBasic {
+		t.Errorf("twofa with a wrong password: got %v", err)
+	}
+}
+
+func TestTotpDisableLockout(t *testing.T) {
+	useLockouts(t)
+	resetBuckets(t, totpBucket)
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		return putTotp(tx, TotpEntity{Username: "admin-user", Secret: rfcSecret, Enabled: true})
+	})
+	code, _ := totpCode(rfcSecret, time.Now().Unix()/totpPeriod)
+	steps := []struct {
+		code string
+		want int
+	}{
+		{"000000", 400},
+		{"000001", 400},
+		{"000002", 400},
+		// locked out, even with the right code.
+		{code, 429},
+	}
+	for i, s := range steps {
+		body := fmt.Sprintf(`{"code":%q}`, s.code)
+		if rec := serve(TotpDisableServeHTTP, "POST", "/totp-disable", nil, body, RoleAdmin); rec.Code != s.want {
+			t.Errorf("step %d: got %d %q, want %d", i, rec.Code, rec.Body, s.want)
+		}
+	}
+	if !totpEnabled("admin-user") {
+		t.Error("totp disabled while locked out")
+	}
+	Lockouts.Clear(loginLockoutKeys(httptest.NewRequest("POST", "/", nil), "admin-user")...)
+	if rec := serve(TotpDisableServeHTTP, "POST", "/totp-disable", nil, fmt.Sprintf(`{"code":%q}`, code), RoleAdmin); rec.Code != 200 || totpEnabled("admin-user") {
+		t.Errorf("after clear: %d %q", rec.Code, rec.Body)
+	}
+}
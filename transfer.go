@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TransferEntry is an entry as exported and imported. The sign is left out:
+// it depends on the salt of the server and is computed again on import.
+type TransferEntry struct {
+	Id string `json:"id"`
+
+	ProxyName string `json:"proxy_name"`
+
+	ProxyType string `json:"proxy_type"`
+
+	RemotePort uint16 `json:"remote_port"`
+
+	ValidTo int64 `json:"auth_valid_to"`
+
+	Memo string `json:"memo"`
+
+	Email string `json:"email"`
+
+	Owner string `json:"owner,omitempty"`
+
+	Contact string `json:"contact,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+
+	Tenant string `json:"tenant,omitempty"`
+
+	Disabled bool `json:"disabled"`
+
+	AuthKey string `json:"auth_key,omitempty"`
+}
+
+var transferColumns = []string{"id", "proxy_name", "proxy_type", "remote_port", "auth_valid_to", "memo", "email", "owner", "contact", "tags", "tenant", "disabled", "auth_key"}
+
+var proxyTypes = []string{"tcp", "udp", "http", "https", "stcp", "sudp", "xtcp", "tcpmux"}
+
+func (te TransferEntry) key() string {
+	kb := &KeyBuilder{
+		ProxyName:  te.ProxyName,
+		ProxyType:  te.ProxyType,
+		RemotePort: te.RemotePort,
+		Subdomain:  te.ProxyName,
+	}
+	return kb.Key()
+}
+
+func (te TransferEntry) validate() error {
+	if te.ProxyName == "" {
+		return errors.New("proxy_name is required")
+	}
+	if !containsString(proxyTypes, te.ProxyType) {
+		return fmt.Errorf("invalid proxy_type %q", te.ProxyType)
+	}
+	if te.RemotePort == 0 && te.ProxyType != "http" && te.ProxyType != "https" {
+		return errors.New("remote_port is required")
+	}
+	if te.ValidTo <= 0 {
+		return errors.New("auth_valid_to is required")
+	}
+	if te.Email != "" && !strings.Contains(te.Email, "@") {
+		return fmt.Errorf("invalid email %q", te.Email)
+	}
+	if err := validateTags(te.Tags); err != nil {
+		return err
+	}
+	if te.Id != "" && te.Id != te.key() {
+		return fmt.Errorf("id %s does not match proxy, want %s", te.Id, te.key())
+	}
+	return nil
+}
+
+func (te TransferEntry) entity() AuthDataEntity {
+	ae := AuthDataEntity{
+		Id:         te.key(),
+		ProxyName:  te.ProxyName,
+		ProxyType:  te.ProxyType,
+		RemotePort: te.RemotePort,
+		ValidTo:    te.ValidTo,
+		Memo:       te.Memo,
+		Email:      te.Email,
+		Owner:      te.Owner,
+		Contact:    te.Contact,
+		Tags:       te.Tags,
+		Tenant:     te.Tenant,
+		AuthKey:    te.AuthKey,
+		Disabled:   te.Disabled,
+	}
+	signBody := &SignBody{
+		ProxyType:  ae.ProxyType,
+		RemotePort: ae.RemotePort,
+		Subdomain:  ae.ProxyName,
+		AuthKey:    ae.AuthKey,
+		ValidTo:    strconv.FormatInt(ae.ValidTo, 10),
+	}
+	ae.Sign = signBody.Sign()
+	return ae
+}
+
+// parseValidTo takes unix millis, or a date for hand written files.
+func parseValidTo(s string) (int64, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid auth_valid_to %q", s)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+// readTransferCSV reads rows by the header, so columns may come in any order
+// and be left out. A row that does not parse becomes an error of that row.
+func readTransferCSV(r io.Reader) ([]TransferEntry, []error, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("no header: %s", err)
+	}
+	col := make(map[string]int)
+	for i, h := range header {
+		col[strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))] = i
+	}
+	var entries []TransferEntry
+	var errs []error
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		field := func(name string) string {
+			if i, ok := col[name]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+			return ""
+		}
+		te := TransferEntry{
+			Id:        field("id"),
+			ProxyName: field("proxy_name"),
+			ProxyType: field("proxy_type"),
+			Memo:      field("memo"),
+			Email:     field("email"),
+			Owner:     field("owner"),
+			Contact:   field("contact"),
+			Tenant:    field("tenant"),
+			AuthKey:   field("auth_key"),
+		}
+		var rowErr error
+		if t := field("tags"); t != "" {
+			te.Tags, rowErr = parseTags(t)
+		}
+		if p := field("remote_port"); p != "" && rowErr == nil {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				rowErr = fmt.Errorf("invalid remote_port %q", p)
+			}
+			te.RemotePort = uint16(port)
+		}
+		if v := field("auth_valid_to"); v != "" && rowErr == nil {
+			te.ValidTo, rowErr = parseValidTo(v)
+		}
+		if d := field("disabled"); d != "" && rowErr == nil {
+			if te.Disabled, err = strconv.ParseBool(d); err != nil {
+				rowErr = fmt.Errorf("invalid disabled %q", d)
+			}
+		}
+		entries = append(entries, te)
+		errs = append(errs, rowErr)
+	}
+	return entries, errs, nil
+}
+
+func writeTransferCSV(w io.Writer, entries []TransferEntry, secrets bool) error {
+	cols := transferColumns
+	if !secrets {
+		cols = cols[:len(cols)-1]
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(cols)
+	for _, te := range entries {
+		rec := []string{
+			te.Id,
+			te.ProxyName,
+			te.ProxyType,
+			strconv.Itoa(int(te.RemotePort)),
+			strconv.FormatInt(te.ValidTo, 10),
+			te.Memo,
+			te.Email,
+			te.Owner,
+			te.Contact,
+			formatTags(te.Tags),
+			te.Tenant,
+			strconv.FormatBool(te.Disabled),
+			te.AuthKey,
+		}
+		cw.Write(rec[:len(cols)])
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportAuthServeHTTP downloads every entry as format=csv (default) or
+// format=json. secrets=1 adds the auth keys and takes the admin role.
+func ExportAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	secrets := q.Get("secrets") == "1"
+	if secrets && !RequestPrincipal(r).HasRole(RoleAdmin) {
+		http.Error(w, "exporting auth keys needs the admin role", 403)
+		return
+	}
+	all, err := loadAllAuth()
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ExportAuth-1].", 500)
+		return
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Id < all[j].Id
+	})
+	entries := make([]TransferEntry, 0, len(all))
+	for _, ae := range all {
+		if checkTenant(r, &ae) != nil {
+			continue
+		}
+		te := TransferEntry{
+			Id:         ae.Id,
+			ProxyName:  ae.ProxyName,
+			ProxyType:  ae.ProxyType,
+			RemotePort: ae.RemotePort,
+			ValidTo:    ae.ValidTo,
+			Memo:       ae.Memo,
+			Email:      ae.Email,
+			Owner:      ae.Owner,
+			Contact:    ae.Contact,
+			Tags:       ae.Tags,
+			Tenant:     ae.Tenant,
+			Disabled:   ae.Disabled,
+		}
+		if secrets {
+			te.AuthKey = ae.AuthKey
+		}
+		entries = append(entries, te)
+	}
+	Log.Info("export", len(entries), "entries, secrets", secrets, "by", RequestUser(r))
+	if q.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="frps-auth.json"`)
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="frps-auth.csv"`)
+	if err := writeTransferCSV(w, entries, secrets); err != nil {
+		Log.Error(err)
+	}
+}
+
+type ImportResult struct {
+	Row int `json:"row"`
+
+	Id string `json:"id"`
+
+	// add, overwrite or skip
+	Action string `json:"action,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ImportAuthServeHTTP imports the CSV or JSON body (format=csv|json, by
+// default from the Content-Type). Rows are validated and checked against the
+// existing ids first; with any error nothing is imported.
+//
+//	dry_run=1              only report what would happen
+//	keys=preserve          keep the auth_key of each row, frpc keeps working
+//	keys=regenerate        give every entry a new key
+//	                       (default: new entries get a new key, overwritten
+//	                       ones keep the key they have)
+//	conflict=fail|skip|overwrite  what to do with ids that exist (default fail)
+func ImportAuthServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	q := r.URL.Query()
+	dryRun := q.Get("dry_run") == "1"
+	keys := q.Get("keys")
+	conflict := q.Get("conflict")
+	if conflict == "" {
+		conflict = "fail"
+	}
+	if keys != "" && keys != "preserve" && keys != "regenerate" {
+		http.Error(w, "keys must be preserve or regenerate", 400)
+		return
+	}
+	if conflict != "fail" && conflict != "skip" && conflict != "overwrite" {
+		http.Error(w, "conflict must be fail, skip or overwrite", 400)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+		if strings.Contains(r.Header.Get("Content-Type"), "json") {
+			format = "json"
+		}
+	}
+	var entries []TransferEntry
+	var rowErrs []error
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			http.Error(w, "Please send a valid request body.", 400)
+			return
+		}
+		rowErrs = make([]error, len(entries))
+	case "csv":
+		var err error
+		if entries, rowErrs, err = readTransferCSV(r.Body); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	default:
+		http.Error(w, "format must be csv or json", 400)
+		return
+	}
+	Log.Info("import", len(entries), "entries, dry run", dryRun, "keys", keys, "conflict", conflict, "by", RequestUser(r))
+	var results []ImportResult
+	failed := errors.New("import failed")
+	apply := func(tx *nutsdb.Tx) error {
+		results = make([]ImportResult, 0, len(entries))
+		ok := true
+		seen := make(map[string]int)
+		for i, te := range entries {
+			res := ImportResult{Row: i + 1, Id: te.key()}
+			err := rowErrs[i]
+			if err == nil {
+				err = te.validate()
+			}
+			if err == nil && keys == "preserve" && te.AuthKey == "" {
+				err = errors.New("auth_key is required to preserve keys")
+			}
+			if err == nil && seen[res.Id] > 0 {
+				err = fmt.Errorf("same id as row %d", seen[res.Id])
+			}
+			var before *AuthDataEntity
+			if err == nil && te.Tenant != "" && !tenantKnown(tx, te.Tenant) {
+				err = fmt.Errorf("no such tenant %s", te.Tenant)
+			}
+			if err == nil {
+				seen[res.Id] = res.Row
+				res.Action = "add"
+				if e, gerr := tx.Get(bucket, []byte(res.Id)); gerr == nil {
+					before = &AuthDataEntity{}
+					if err := json.Unmarshal(e.Value, before); err != nil {
+						return err
+					}
+					if before.Managed != "" {
+						err = errManaged
+					} else {
+						switch conflict {
+						case "fail":
+							err = errors.New("id exists")
+						case "skip":
+							res.Action = "skip"
+						case "overwrite":
+							res.Action = "overwrite"
+						}
+					}
+				}
+			}
+			if err == nil && res.Action != "skip" {
+				want := te.entity()
+				err = checkQuota(tx, &want, before)
+				if err == nil {
+					err = checkPortChange(tx, &want, before)
+				}
+			}
+			if err != nil {
+				res.Action = ""
+				res.Error = err.Error()
+				ok = false
+			}
+			results = append(results, res)
+			if !ok || dryRun || res.Action == "skip" {
+				continue
+			}
+			switch {
+			case keys == "preserve":
+			case keys == "" && before != nil:
+				// frpc keeps working unless a new key is asked for.
+				te.AuthKey = before.AuthKey
+			default:
+				te.AuthKey = createSignKey()
+			}
+			ae := te.entity()
+			val, err := json.Marshal(ae)
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(bucket, []byte(ae.Id), val, 0); err != nil {
+				return err
+			}
+			if err := recordChange(tx, r, "import", ae.Id, before, &ae); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			return failed
+		}
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = dbView(apply)
+	} else {
+		err = dbUpdate(apply)
+	}
+	if err != nil && err != failed {
+		Log.Error(err)
+		http.Error(w, "server error[ImportAuth-1].", 500)
+		return
+	}
+	status := 0
+	if err == failed {
+		status = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"dry_run": dryRun,
+		"count":   len(results),
+		"results": results,
+	})
+}
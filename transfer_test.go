@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type importResponse struct {
+	Status  int            `json:"status"`
+	DryRun  bool           `json:"dry_run"`
+	Results []ImportResult `json:"results"`
+}
+
+func runImport(t *testing.T, query string, body string) importResponse {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/auth/import?"+query, strings.NewReader(body))
+	if strings.HasPrefix(body, "[") {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	ImportAuthServeHTTP(rec, r)
+	if rec.Code != 200 {
+		t.Fatalf("import %s: %d %s", query, rec.Code, rec.Body)
+	}
+	var res importResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func importJSON(t *testing.T, entries ...TransferEntry) string {
+	t.Helper()
+	b, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// entryOf returns the stored entry of id, nil when there is none.
+func entryOf(t *testing.T, id string) *AuthDataEntity {
+	t.Helper()
+	if ae, ok := getEntry(t, id); ok {
+		return &ae
+	}
+	return nil
+}
+
+func validIn(d time.Duration) int64 {
+	return time.Now().Add(d).UnixNano() / int64(time.Millisecond)
+}
+
+// setupImport stores one entry, web on port 6001, and returns a row that
+// collides with it and one that is new.
+func setupImport(t *testing.T) (existing, clash, fresh TransferEntry) {
+	t.Helper()
+	resetBuckets(t, bucket, tenantBucket, historyBucket, auditBucket, auditChainBucket)
+	existing = TransferEntry{ProxyName: "web", ProxyType: "tcp", RemotePort: 6001, ValidTo: validIn(time.Hour), Memo: "old", AuthKey: "oldkey"}
+	putEntries(t, existing.entity())
+	clash = existing
+	clash.Memo = "new"
+	clash.AuthKey = "newkey"
+	fresh = TransferEntry{ProxyName: "db", ProxyType: "tcp", RemotePort: 6002, ValidTo: validIn(time.Hour), AuthKey: "dbkey"}
+	return
+}
+
+func TestImportConflictFail(t *testing.T) {
+	existing, clash, fresh := setupImport(t)
+	res := runImport(t, "keys=preserve", importJSON(t, fresh, clash))
+	if res.Status != 1 || res.Results[0].Error != "" || res.Results[1].Error != "id exists" {
+		t.Fatalf("got %+v", res)
+	}
+	// one bad row and nothing is imported.
+	if entryOf(t, fresh.key()) != nil {
+		t.Error("fresh row imported")
+	}
+	if ae := entryOf(t, existing.key()); ae.Memo != "old" {
+		t.Errorf("existing entry changed: %+v", ae)
+	}
+}
+
+func TestImportConflictSkip(t *testing.T) {
+	existing, clash, fresh := setupImport(t)
+	res := runImport(t, "keys=preserve&conflict=skip", importJSON(t, fresh, clash))
+	if res.Status != 0 || res.Results[0].Action != "add" || res.Results[1].Action != "skip" {
+		t.Fatalf("got %+v", res)
+	}
+	if ae := entryOf(t, fresh.key()); ae == nil || ae.AuthKey != "dbkey" {
+		t.Errorf("fresh row: %+v", ae)
+	}
+	if ae := entryOf(t, existing.key()); ae.Memo != "old" || ae.AuthKey != "oldkey" {
+		t.Errorf("skipped entry changed: %+v", ae)
+	}
+}
+
+func TestImportConflictOverwrite(t *testing.T) {
+	existing, clash, _ := setupImport(t)
+	res := runImport(t, "keys=preserve&conflict=overwrite", importJSON(t, clash))
+	if res.Status != 0 || res.Results[0].Action != "overwrite" {
+		t.Fatalf("got %+v", res)
+	}
+	ae := entryOf(t, existing.key())
+	if ae.Memo != "new" || ae.AuthKey != "newkey" || ae.Sign != clash.entity().Sign {
+		t.Errorf("overwritten entry: %+v", ae)
+	}
+	events, err := loadAudit(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != "import" || events[0].Changes["memo"].To != "new" {
+		t.Errorf("audit: %+v", events)
+	}
+}
+
+func TestImportRegeneratesKeys(t *testing.T) {
+	_, _, fresh := setupImport(t)
+	runImport(t, "", importJSON(t, fresh))
+	ae := entryOf(t, fresh.key())
+	if ae == nil || ae.AuthKey == "" || ae.AuthKey == fresh.AuthKey {
+		t.Fatalf("got %+v", ae)
+	}
+	// the sign goes with the new key.
+	te := fresh
+	te.AuthKey = ae.AuthKey
+	if ae.Sign != te.entity().Sign {
+		t.Error("sign not computed for the new key")
+	}
+}
+
+func TestImportOverwriteKeys(t *testing.T) {
+	cases := []struct {
+		keys string
+		want func(ae *AuthDataEntity) bool
+	}{
+		// overwriting keeps the key frpc has unless a new one is asked for.
+		{"", func(ae *AuthDataEntity) bool { return ae.AuthKey == "oldkey" }},
+		{"keys=preserve", func(ae *AuthDataEntity) bool { return ae.AuthKey == "newkey" }},
+		{"keys=regenerate", func(ae *AuthDataEntity) bool { return ae.AuthKey != "oldkey" && ae.AuthKey != "newkey" }},
+	}
+	for _, c := range cases {
+		existing, clash, _ := setupImport(t)
+		res := runImport(t, c.keys+"&conflict=overwrite", importJSON(t, clash))
+		if res.Status != 0 {
+			t.Fatalf("%s: got %+v", c.keys, res)
+		}
+		ae := entryOf(t, existing.key())
+		te := clash
+		te.AuthKey = ae.AuthKey
+		if !c.want(ae) || ae.Memo != "new" || ae.Sign != te.entity().Sign {
+			t.Errorf("%s: got %+v", c.keys, ae)
+		}
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	existing, clash, fresh := setupImport(t)
+	res := runImport(t, "dry_run=1&conflict=overwrite", importJSON(t, fresh, clash))
+	if !res.DryRun || res.Status != 0 || res.Results[0].Action != "add" || res.Results[1].Action != "overwrite" {
+		t.Fatalf("got %+v", res)
+	}
+	if entryOf(t, fresh.key()) != nil || entryOf(t, existing.key()).Memo != "old" {
+		t.Error("dry run wrote entries")
+	}
+}
+
+func TestImportRowErrors(t *testing.T) {
+	_, _, fresh := setupImport(t)
+	managed := TransferEntry{ProxyName: "synced", ProxyType: "tcp", RemotePort: 6003, ValidTo: validIn(time.Hour)}
+	ae := managed.entity()
+	ae.Managed = "sync.json"
+	putEntries(t, ae)
+	samePort := fresh
+	samePort.ProxyName = "db2"
+	noKey := fresh
+	noKey.AuthKey = ""
+	noKey.ProxyName = "db3"
+	noKey.RemotePort = 6004
+	cases := []struct {
+		query string
+		rows  []TransferEntry
+		want  string
+	}{
+		{"conflict=overwrite", []TransferEntry{managed}, errManaged.Error()},
+		{"", []TransferEntry{fresh, fresh}, "same id as row 1"},
+		{"", []TransferEntry{fresh, samePort}, "is used by " + fresh.key()},
+		{"", []TransferEntry{{ProxyName: "x", ProxyType: "tcp", RemotePort: 6005, ValidTo: validIn(time.Hour), Tenant: "nope"}}, "no such tenant"},
+		{"", []TransferEntry{{ProxyName: "x", ProxyType: "ssh", RemotePort: 6005, ValidTo: validIn(time.Hour)}}, "invalid proxy_type"},
+		{"keys=preserve", []TransferEntry{noKey}, "auth_key is required"},
+	}
+	for _, c := range cases {
+		res := runImport(t, c.query, importJSON(t, c.rows...))
+		last := res.Results[len(res.Results)-1]
+		if res.Status != 1 || !strings.Contains(last.Error, c.want) {
+			t.Errorf("%s %+v: got %+v, want %q", c.query, c.rows, res.Results, c.want)
+		}
+	}
+	if entryOf(t, fresh.key()) != nil {
+		t.Error("failed import wrote entries")
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	setupImport(t)
+	body := "remote_port,proxy_type,proxy_name,auth_valid_to,memo\n" +
+		"6010,tcp,csv1,2099-01-02,first\n" +
+		"6011,udp,csv2," + time.Now().AddDate(1, 0, 0).Format("2006-01-02") + ",second\n"
+	res := runImport(t, "", body)
+	if res.Status != 0 || len(res.Results) != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	ae := entryOf(t, res.Results[0].Id)
+	if ae == nil || ae.ProxyName != "csv1" || ae.RemotePort != 6010 || ae.Memo != "first" {
+		t.Errorf("got %+v", ae)
+	}
+	res = runImport(t, "", "proxy_name,proxy_type,remote_port,auth_valid_to\nbad,tcp,notaport,2099-01-02\n")
+	if res.Status != 1 || res.Results[0].Error == "" {
+		t.Errorf("bad row: %+v", res)
+	}
+}
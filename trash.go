@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"net/http"
+	"sort"
+	"time"
+)
+
+var (
+	trashBucket        = "trash"
+	trashPurgeInterval = time.Hour
+)
+
+// TrashEntry is a deleted entry. It keeps its key so that a restore needs no
+// change on the frpc side; the plugin rejects it all the same.
+type TrashEntry struct {
+	AuthDataEntity
+
+	// unix millis
+	DeletedAt int64 `json:"deleted_at"`
+
+	DeletedBy string `json:"deleted_by"`
+
+	// the revision that deleted it; a purge leaves later revisions, which
+	// belong to a new entry with the same id.
+	Rev int `json:"rev"`
+}
+
+func getTrash(tx *nutsdb.Tx, id string) (*TrashEntry, error) {
+	e, err := tx.Get(trashBucket, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	var te TrashEntry
+	if err := json.Unmarshal(e.Value, &te); err != nil {
+		return nil, err
+	}
+	return &te, nil
+}
+
+// trashAuth moves an entry to the trash.
+func trashAuth(tx *nutsdb.Tx, r *http.Request, id string) error {
+	e, err := tx.Get(bucket, []byte(id))
+	if err != nil {
+		return err
+	}
+	var before AuthDataEntity
+	if err := json.Unmarshal(e.Value, &before); err != nil {
+		return err
+	}
+	if err := checkTenant(r, &before); err != nil {
+		return err
+	}
+	if err := checkManaged(r, &before); err != nil {
+		return err
+	}
+	// an older copy with the same id is purged, not overwritten unseen.
+	if old, err := getTrash(tx, id); err == nil {
+		if err := purgeTrash(tx, r, old); err != nil {
+			return err
+		}
+	}
+	if err := recordChange(tx, r, "delete", id, &before, nil); err != nil {
+		return err
+	}
+	rev, err := lastRevision(tx, id)
+	if err != nil {
+		return err
+	}
+	deletedBy, _ := auditActor(r)
+	val, err := json.Marshal(TrashEntry{
+		AuthDataEntity: before,
+		DeletedAt:      time.Now().UnixNano() / int64(time.Millisecond),
+		DeletedBy:      deletedBy,
+		Rev:            rev,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(trashBucket, []byte(id), val, 0); err != nil {
+		return err
+	}
+	moveTenantEntry(tx, id, "")
+	return tx.Delete(bucket, []byte(id))
+}
+
+// purgeTrash removes an entry for good, together with its revisions; only the
+// audit log, which never has the key, remembers it. Revisions after the one
+// that deleted it belong to a new entry with the same id and are kept.
+func purgeTrash(tx *nutsdb.Tx, r *http.Request, te *TrashEntry) error {
+	_, err := tx.Get(bucket, []byte(te.Id))
+	live := err == nil
+	revs, err := loadRevisions(tx, te.Id)
+	if err != nil {
+		return err
+	}
+	kept := 0
+	for _, rv := range revs {
+		if rv.Rev > te.Rev {
+			kept++
+			continue
+		}
+		if err := tx.Delete(historyBucket, historyKey(rv.Id, rv.Rev)); err != nil {
+			return err
+		}
+	}
+	if len(revs) > 0 && kept == 0 && !live {
+		if err := tx.Delete(historyRevBucket, []byte(te.Id)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Delete(trashBucket, []byte(te.Id)); err != nil {
+		return err
+	}
+	return audit(tx, r, "purge", te.Id, &te.AuthDataEntity, nil)
+}
+
+func loadTrash() ([]TrashEntry, error) {
+	result := []TrashEntry{}
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(trashBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var te TrashEntry
+			if err := json.Unmarshal(e.Value, &te); err != nil {
+				return err
+			}
+			result = append(result, te)
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DeletedAt > result[j].DeletedAt
+	})
+	return result, nil
+}
+
+// purgeExpiredTrash purges what has been in the trash longer than
+// trash_retention; 0 keeps the trash until it is emptied by hand.
+func purgeExpiredTrash(now time.Time) {
+	if Config.TrashRetention <= 0 {
+		return
+	}
+	trash, err := loadTrash()
+	if err != nil {
+		Log.Error(err)
+		return
+	}
+	cutoff := now.Add(-Config.TrashRetention).UnixNano() / int64(time.Millisecond)
+	for i := range trash {
+		te := &trash[i]
+		if te.DeletedAt > cutoff {
+			continue
+		}
+		Log.Info("purge", te.Id, "from trash")
+		if err := dbUpdate(func(tx *nutsdb.Tx) error {
+			return purgeTrash(tx, nil, te)
+		}); err != nil {
+			Log.Error(err)
+		}
+	}
+}
+
+func RunTrashPurge() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		purgeExpiredTrash(time.Now())
+		<-ticker.C
+	}
+}
+
+func ListTrashServeHTTP(w http.ResponseWriter, r *http.Request) {
+	trash, err := loadTrash()
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListTrash-1].", 500)
+		return
+	}
+	visible := trash[:0]
+	for _, te := range trash {
+		if checkTenant(r, &te.AuthDataEntity) != nil {
+			continue
+		}
+		te.AuthKey = ""
+		te.Sign = ""
+		visible = append(visible, te)
+	}
+	trash = visible
+	data, err := json.Marshal(trash)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListTrash-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(trash), data))
+}
+
+// RestoreTrashServeHTTP puts an entry back as it was deleted, key included.
+func RestoreTrashServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("restore from trash", params["id"], "by", RequestUser(r))
+	status := 0
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		te, err := getTrash(tx, params["id"])
+		if err != nil || checkTenant(r, &te.AuthDataEntity) != nil {
+			status = 404
+			return errors.New("not in trash")
+		}
+		if _, err := tx.Get(bucket, []byte(params["id"])); err == nil {
+			status = 409
+			return errors.New("an entry with this id exists")
+		}
+		if err := checkQuota(tx, &te.AuthDataEntity, nil); err != nil {
+			status = 403
+			return err
+		}
+		if err := checkPortChange(tx, &te.AuthDataEntity, nil); err != nil {
+			status = 409
+			return err
+		}
+		// restored by hand, it is no longer the sync's.
+		te.Managed = ""
+		val, err := json.Marshal(te.AuthDataEntity)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(bucket, []byte(params["id"]), val, 0); err != nil {
+			return err
+		}
+		if err := tx.Delete(trashBucket, []byte(params["id"])); err != nil {
+			return err
+		}
+		return recordChange(tx, r, "undelete", params["id"], nil, &te.AuthDataEntity)
+	}); err != nil {
+		switch status {
+		case 403, 404, 409:
+			http.Error(w, err.Error(), status)
+		default:
+			Log.Error(err)
+			http.Error(w, "server error[RestoreTrash-1].", 500)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+func PurgeTrashServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("purge", params["id"], "by", RequestUser(r))
+	notFound := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		te, err := getTrash(tx, params["id"])
+		if err == nil {
+			err = checkTenant(r, &te.AuthDataEntity)
+		}
+		if err != nil {
+			notFound = true
+			return err
+		}
+		return purgeTrash(tx, r, te)
+	}); err != nil {
+		if notFound {
+			http.Error(w, "not in trash", 404)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[PurgeTrash-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
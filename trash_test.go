@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xujiajun/nutsdb"
+	"testing"
+	"time"
+)
+
+func trashIds(t *testing.T) []string {
+	t.Helper()
+	rec := serve(ListTrashServeHTTP, "POST", "/list-trash", nil, "", RoleViewer)
+	var res struct {
+		Data []TrashEntry `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %q", rec.Code, rec.Body)
+	}
+	var ids []string
+	for _, te := range res.Data {
+		if te.AuthKey != "" || te.Sign != "" {
+			t.Errorf("key of %s listed", te.Id)
+		}
+		ids = append(ids, te.Id)
+	}
+	return ids
+}
+
+func TestTrashRestore(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket, historyBucket, historyRevBucket)
+	ae := signedEntry("bin", "tcp", 6300, "k1", time.Hour)
+	putEntries(t, ae)
+	vars := map[string]string{"id": ae.Id}
+	serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin)
+	if ids := trashIds(t); len(ids) != 1 || ids[0] != ae.Id {
+		t.Fatalf("trash %v", ids)
+	}
+	if reject, _ := callPlugin(t, "NewProxy", pluginContent(ae, "k1", "r1")); !reject {
+		t.Error("trashed entry accepted")
+	}
+	putEntries(t, ae)
+	if rec := serve(RestoreTrashServeHTTP, "POST", "/restore-trash/"+ae.Id, vars, "", RoleOperator); rec.Code != 409 {
+		t.Errorf("restore over a live entry: %d", rec.Code)
+	}
+	resetBuckets(t, bucket)
+	if rec := serve(RestoreTrashServeHTTP, "POST", "/restore-trash/"+ae.Id, vars, "", RoleOperator); rec.Code != 200 {
+		t.Fatalf("restore: %d %q", rec.Code, rec.Body)
+	}
+	if reject, reason := callPlugin(t, "NewProxy", pluginContent(ae, "k1", "r1")); reject {
+		t.Errorf("restored entry rejected: %s", reason)
+	}
+	if ids := trashIds(t); len(ids) != 0 {
+		t.Errorf("trash %v after restore", ids)
+	}
+	if rec := serve(RestoreTrashServeHTTP, "POST", "/restore-trash/"+ae.Id, vars, "", RoleOperator); rec.Code != 404 {
+		t.Errorf("restore twice: %d", rec.Code)
+	}
+	// restoring the revision of a trashed entry takes it out of the trash.
+	serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin)
+	rec := serve(RestoreAuthServeHTTP, "POST", "/restore-auth/"+ae.Id+"/1", map[string]string{"id": ae.Id, "rev": "1"}, "", RoleAdmin)
+	if ids := trashIds(t); rec.Code != 200 || len(ids) != 0 {
+		t.Errorf("restore revision: %d, trash %v", rec.Code, ids)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket, historyBucket, historyRevBucket, auditBucket)
+	saved := Config
+	defer func() { Config = saved }()
+	Config.TrashRetention = 24 * time.Hour
+	a := signedEntry("a", "tcp", 6301, "k", time.Hour)
+	b := signedEntry("b", "tcp", 6302, "k", time.Hour)
+	putEntries(t, a, b)
+	for _, ae := range []AuthDataEntity{a, b} {
+		serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, map[string]string{"id": ae.Id}, "", RoleAdmin)
+	}
+	if rec := serve(PurgeTrashServeHTTP, "POST", "/purge-trash/"+a.Id, map[string]string{"id": a.Id}, "", RoleAdmin); rec.Code != 200 {
+		t.Fatalf("purge: %d %q", rec.Code, rec.Body)
+	}
+	if rec := serve(PurgeTrashServeHTTP, "POST", "/purge-trash/"+a.Id, map[string]string{"id": a.Id}, "", RoleAdmin); rec.Code != 404 {
+		t.Errorf("purge twice: %d", rec.Code)
+	}
+	if revs := history(t, a.Id); len(revs) != 0 {
+		t.Errorf("history kept: %+v", revs)
+	}
+	// b stays until the retention is over.
+	purgeExpiredTrash(time.Now())
+	if ids := trashIds(t); len(ids) != 1 || ids[0] != b.Id {
+		t.Fatalf("trash %v", ids)
+	}
+	purgeExpiredTrash(time.Now().Add(25 * time.Hour))
+	if ids := trashIds(t); len(ids) != 0 {
+		t.Errorf("trash %v after retention", ids)
+	}
+	events, err := loadAudit(AuditFilter{Action: []string{"purge"}})
+	if err != nil || len(events) != 2 || events[0].Actor != "system" || events[1].Actor != RoleAdmin+"-user" {
+		t.Errorf("purge events %v %+v", err, events)
+	}
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		if _, err := tx.Get(historyRevBucket, []byte(b.Id)); err == nil {
+			t.Error("revision counter kept")
+		}
+		return nil
+	})
+}
+
+// revNumbers lists the revisions of id, newest first.
+func revNumbers(t *testing.T, id string) []int {
+	t.Helper()
+	var revs []int
+	for _, rv := range history(t, id) {
+		revs = append(revs, rv.Rev)
+	}
+	return revs
+}
+
+// TestTrashReusedId covers an id that is added again while its old entry is
+// in the trash: the new entry keeps its history, and deleting it purges the
+// old copy.
+func TestTrashReusedId(t *testing.T) {
+	resetBuckets(t, bucket, trashBucket, historyBucket, historyRevBucket, auditBucket)
+	ae := signedEntry("again", "tcp", 6303, "k", time.Hour)
+	putEntries(t, ae)
+	vars := map[string]string{"id": ae.Id}
+	add := `{"proxy_name":"again","proxy_type":"tcp","remote_port":6303,"auth_valid_to":4070908800000}`
+	steps := []struct {
+		name string
+		call func() int
+		revs []int
+	}{
+		{"delete", func() int { return serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin).Code }, []int{2, 1}},
+		{"add again", func() int { return serve(AddAuthServeHTTP, "POST", "/add-auth", nil, add, RoleAdmin).Code }, []int{3, 2, 1}},
+		{"purge keeps the new entry's history", func() int { return serve(PurgeTrashServeHTTP, "POST", "/purge-trash/"+ae.Id, vars, "", RoleAdmin).Code }, []int{3}},
+		{"delete again", func() int { return serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin).Code }, []int{4, 3}},
+		{"add a third time", func() int { return serve(AddAuthServeHTTP, "POST", "/add-auth", nil, add, RoleAdmin).Code }, []int{5, 4, 3}},
+		{"delete purges the older copy", func() int { return serve(DeleteAuthServeHTTP, "POST", "/delete-auth/"+ae.Id, vars, "", RoleAdmin).Code }, []int{6, 5}},
+	}
+	for _, s := range steps {
+		if code := s.call(); code != 200 {
+			t.Fatalf("%s: %d", s.name, code)
+		}
+		if got := revNumbers(t, ae.Id); fmt.Sprint(got) != fmt.Sprint(s.revs) {
+			t.Errorf("%s: revisions %v, want %v", s.name, got, s.revs)
+		}
+	}
+	if ids := trashIds(t); len(ids) != 1 {
+		t.Errorf("trash %v", ids)
+	}
+	events, err := loadAudit(AuditFilter{Action: []string{"purge"}})
+	if err != nil || len(events) != 2 {
+		t.Errorf("purge events %v %+v", err, events)
+	}
+	rec := serve(RestoreTrashServeHTTP, "POST", "/restore-trash/"+ae.Id, vars, "", RoleOperator)
+	if revs := revNumbers(t, ae.Id); rec.Code != 200 || fmt.Sprint(revs) != "[7 6 5]" {
+		t.Errorf("restore: %d, revisions %v", rec.Code, revs)
+	}
+}
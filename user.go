@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/xujiajun/nutsdb"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var userBucket = "user"
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,64}$`)
+
+const ProviderOidc = "oidc"
+
+// Principal is who a request was authenticated as. Token is set when it came
+// with an API token rather than a password, Provider when the user logged in
+// through single sign-on, Tenant when the user only acts for one tenant.
+type Principal struct {
+	User     string
+	Role     string
+	Token    string
+	Provider string
+	Tenant   string
+}
+
+// HasRole reports whether p may do what role may; roles are ordered
+// viewer < operator < admin.
+func (p Principal) HasRole(role string) bool {
+	return roleLevels[p.Role] >= roleLevels[role]
+}
+
+type UserEntity struct {
+	Username string `json:"username"`
+
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	Role string `json:"role"`
+
+	// the tenant the user acts for; empty for all of them
+	Tenant string `json:"tenant,omitempty"`
+
+	Created int64 `json:"created"`
+}
+
+type UserRequest struct {
+	Username string `json:"username"`
+
+	Password string `json:"password"`
+
+	Role string `json:"role"`
+
+	Tenant string `json:"tenant"`
+}
+
+// authenticate checks a username and password against the account from
+// frps-auth.ini, which is always an admin and the break-glass account when the
+// directory is down, then the users in the store and then LDAP.
+func authenticate(user, passwd string) (Principal, bool) {
+	if constantTimeEqual(user, Config.Username) && constantTimeEqual(passwd, Config.Password) {
+		return Principal{User: user, Role: RoleAdmin}, true
+	}
+	ue, err := getUser(user)
+	if err != nil && Config.LdapEnabled() && user != Config.Username {
+		p, err := ldapAuthenticate(user, passwd)
+		if err != nil {
+			Log.Warning(fmt.Sprintf("ldap %s: %s.", user, err))
+			return Principal{}, false
+		}
+		return p, true
+	}
+	if err != nil {
+		// keep the timing close to a wrong password.
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(passwd))
+		return Principal{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(ue.PasswordHash), []byte(passwd)) != nil {
+		return Principal{}, false
+	}
+	return Principal{User: ue.Username, Role: ue.Role, Tenant: ue.Tenant}, true
+}
+
+// constantTimeEqual compares secrets without leaking where they differ; only
+// their length may show.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("frps-auth"), bcrypt.DefaultCost)
+
+func getUser(username string) (UserEntity, error) {
+	var ue UserEntity
+	err := dbView(func(tx *nutsdb.Tx) error {
+		e, err := tx.Get(userBucket, []byte(username))
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(e.Value, &ue)
+	})
+	return ue, err
+}
+
+func putUser(tx *nutsdb.Tx, ue UserEntity) error {
+	val, err := json.Marshal(ue)
+	if err != nil {
+		return err
+	}
+	return tx.Put(userBucket, []byte(ue.Username), val, 0)
+}
+
+// RequireRole wraps a handler so that only principals with at least role get
+// through.
+func RequireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := RequestPrincipal(r)
+		if !p.HasRole(role) {
+			Log.Warning(fmt.Sprintf("%s(%s) %s needs role %s.", p.User, p.Role, r.RequestURI, role))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
+}
+
+// RequireGlobalRole is RequireRole for what concerns the whole server, like
+// users and backups, which users of a tenant may not touch.
+func RequireGlobalRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return RequireRole(role, func(w http.ResponseWriter, r *http.Request) {
+		p := RequestPrincipal(r)
+		if p.Tenant != "" {
+			Log.Warning(fmt.Sprintf("%s of tenant %s %s is not for tenants.", p.User, p.Tenant, r.RequestURI))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func checkUserRequest(ur UserRequest, needPassword bool) error {
+	if !usernamePattern.MatchString(ur.Username) {
+		return errors.New("invalid username")
+	}
+	if ur.Username == Config.Username {
+		return errors.New("username is taken by the account in frps-auth.ini")
+	}
+	if _, ok := roleLevels[ur.Role]; !ok {
+		return errors.New("invalid role")
+	}
+	if needPassword && len(ur.Password) < 8 {
+		return errors.New("password needs at least 8 characters")
+	}
+	if ur.Tenant != "" && !tenantExists(ur.Tenant) {
+		return errors.New("no such tenant")
+	}
+	return nil
+}
+
+func WhoamiServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := RequestPrincipal(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"username": p.User,
+		"role":     p.Role,
+		"tenant":   p.Tenant,
+	})
+}
+
+func ListUserServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var users []UserEntity
+	if err := dbView(func(tx *nutsdb.Tx) error {
+		entries, err := tx.GetAll(userBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var ue UserEntity
+			if err := json.Unmarshal(e.Value, &ue); err != nil {
+				return err
+			}
+			ue.PasswordHash = ""
+			users = append(users, ue)
+		}
+		return nil
+	}); err != nil && err != nutsdb.ErrBucketEmpty {
+		Log.Error(err)
+		http.Error(w, "server error[ListUser-1].", 500)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	if users == nil {
+		users = []UserEntity{}
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[ListUser-2].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, fmt.Sprintf(`{"code":0,"count":%d,"data":%s}`, len(users), data))
+}
+
+func AddUserServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var ur UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&ur); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if err := checkUserRequest(ur, true); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	Log.Info("add user", ur.Username, ur.Role, ur.Tenant, "by", RequestUser(r))
+	hash, err := bcrypt.GenerateFromPassword([]byte(ur.Password), bcrypt.DefaultCost)
+	if err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[AddUser-0].", 500)
+		return
+	}
+	exists := false
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		if _, err := tx.Get(userBucket, []byte(ur.Username)); err == nil {
+			exists = true
+			return errors.New("user exists")
+		}
+		return putUser(tx, UserEntity{
+			Username:     ur.Username,
+			PasswordHash: string(hash),
+			Role:         ur.Role,
+			Tenant:       ur.Tenant,
+			Created:      time.Now().UnixNano() / int64(time.Millisecond),
+		})
+	}); err != nil {
+		if exists {
+			http.Error(w, "user exists", 409)
+			return
+		}
+		Log.Error(err)
+		http.Error(w, "server error[AddUser-1].", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+// UpdateUserServeHTTP changes the role and, when given, the password.
+func UpdateUserServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Body == nil {
+		http.Error(w, "Please send a request body.", 400)
+		return
+	}
+	var ur UserRequest
+	if err := json.NewDecoder(r.Body).Decode(&ur); err != nil {
+		http.Error(w, "Please send a valid request body.", 400)
+		return
+	}
+	if err := checkUserRequest(ur, ur.Password != ""); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	Log.Info("update user", ur.Username, ur.Role, ur.Tenant, "by", RequestUser(r))
+	var hash []byte
+	if ur.Password != "" {
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(ur.Password), bcrypt.DefaultCost)
+		if err != nil {
+			Log.Error(err)
+			http.Error(w, "server error[UpdateUser-0].", 500)
+			return
+		}
+	}
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		var ue UserEntity
+		e, err := tx.Get(userBucket, []byte(ur.Username))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(e.Value, &ue); err != nil {
+			return err
+		}
+		ue.Role = ur.Role
+		ue.Tenant = ur.Tenant
+		if hash != nil {
+			ue.PasswordHash = string(hash)
+		}
+		return putUser(tx, ue)
+	}); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[UpdateUser-1].", 500)
+		return
+	}
+	// sessions keep the role and tenant they logged in with.
+	Sessions.DeleteUser(ur.Username)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
+
+func DeleteUserServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	Log.Info("delete user", params["username"], "by", RequestUser(r))
+	if err := dbUpdate(func(tx *nutsdb.Tx) error {
+		if _, err := tx.Get(userBucket, []byte(params["username"])); err != nil {
+			return err
+		}
+		if err := revokeUserTokens(tx, params["username"]); err != nil {
+			return err
+		}
+		return tx.Delete(userBucket, []byte(params["username"]))
+	}); err != nil {
+		Log.Error(err)
+		http.Error(w, "server error[DeleteUser-1].", 500)
+		return
+	}
+	Sessions.DeleteUser(params["username"])
+	if err := resetTotp(params["username"]); err != nil {
+		Log.Error(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":0}`)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/xujiajun/nutsdb"
+	"golang.org/x/crypto/bcrypt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// putUsers stores users whose password is their name repeated twice.
+func putUsers(t *testing.T, users ...UserEntity) {
+	t.Helper()
+	mustUpdate(t, func(tx *nutsdb.Tx) error {
+		for _, ue := range users {
+			hash, err := bcrypt.GenerateFromPassword([]byte(ue.Username+ue.Username), bcrypt.MinCost)
+			if err != nil {
+				return err
+			}
+			ue.PasswordHash = string(hash)
+			if err := putUser(tx, ue); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	resetBuckets(t, userBucket)
+	putUsers(t, UserEntity{Username: "alice", Role: RoleOperator})
+	cases := []struct {
+		user   string
+		passwd string
+		ok     bool
+		role   string
+	}{
+		{Config.Username, Config.Password, true, RoleAdmin},
+		{Config.Username, "wrong", false, ""},
+		{"alice", "alicealice", true, RoleOperator},
+		{"alice", "alice", false, ""},
+		{"bob", "bobbob", false, ""},
+	}
+	for _, c := range cases {
+		p, ok := authenticate(c.user, c.passwd)
+		if ok != c.ok || p.Role != c.role {
+			t.Errorf("%s/%s: got %v %+v", c.user, c.passwd, ok, p)
+		}
+	}
+}
+
+func TestRoleGating(t *testing.T) {
+	resetBuckets(t, userBucket)
+	putUsers(t,
+		UserEntity{Username: "view", Role: RoleViewer},
+		UserEntity{Username: "oper", Role: RoleOperator},
+		UserEntity{Username: "boss", Role: RoleAdmin},
+	)
+	router := newAdminRouter(false)
+	cases := []struct {
+		path  string
+		allow []string
+	}{
+		{"/list-auth", []string{"view", "oper", "boss"}},
+		{"/disable-auth/nope", []string{"oper", "boss"}},
+		{"/delete-auth/nope", []string{"boss"}},
+		{"/list-user", []string{"boss"}},
+	}
+	for _, c := range cases {
+		for _, user := range []string{"view", "oper", "boss"} {
+			allowed := false
+			for _, a := range c.allow {
+				allowed = allowed || a == user
+			}
+			r := httptest.NewRequest("POST", c.path, strings.NewReader("{}"))
+			r.SetBasicAuth(user, user+user)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, r)
+			if (rec.Code != 403) != allowed {
+				t.Errorf("%s as %s: got %d, allowed %v", c.path, user, rec.Code, allowed)
+			}
+		}
+	}
+}
+
+func TestCheckUserRequest(t *testing.T) {
+	cases := []struct {
+		ur           UserRequest
+		needPassword bool
+		err          string
+	}{
+		{UserRequest{Username: "alice", Password: "12345678", Role: RoleViewer}, true, ""},
+		{UserRequest{Username: "alice", Role: RoleAdmin}, false, ""},
+		{UserRequest{Username: "a b", Password: "12345678", Role: RoleViewer}, true, "invalid username"},
+		{UserRequest{Username: Config.Username, Password: "12345678", Role: RoleViewer}, true, "username is taken by the account in frps-auth.ini"},
+		{UserRequest{Username: "alice", Password: "12345678", Role: "root"}, true, "invalid role"},
+		{UserRequest{Username: "alice", Password: "1234567", Role: RoleViewer}, true, "password needs at least 8 characters"},
+	}
+	for _, c := range cases {
+		got := ""
+		if err := checkUserRequest(c.ur, c.needPassword); err != nil {
+			got = err.Error()
+		}
+		if got != c.err {
+			t.Errorf("%+v: got %q, want %q", c.ur, got, c.err)
+		}
+	}
+}